@@ -21,6 +21,89 @@ leaveButton.disabled = true;
 
 joinButton.onclick = join;
 leaveButton.onclick = leave;
+
+var presenterButton = document.getElementById('presenterButton');
+var presenterState = document.getElementById('presenterState');
+presenterButton.onclick = function () {
+    signalingChannel.send({cmd: "takePresenter"});
+};
+
+var screenButton = document.getElementById('screenButton');
+var screenStream;
+screenButton.onclick = function () {
+    if (screenStream) return stopScreen();
+    shareScreen();
+};
+
+// mediaStates: muted media of streams by streamKey, e.g. {audio: true}
+var mediaStates = {};
+var muteAudioButton = document.getElementById('muteAudioButton');
+var muteVideoButton = document.getElementById('muteVideoButton');
+muteAudioButton.onclick = function () { toggleMute('audio'); };
+muteVideoButton.onclick = function () { toggleMute('video'); };
+
+// toggleMute mutes the camera of the user for everyone on the server
+function toggleMute(media) {
+    var state = mediaStates[userNameInput.value] || {};
+    signalingChannel.send({cmd: state[media] ? "unmute" : "mute", media: media});
+}
+
+// role of the user in the room, moderators see moderation controls
+var myRole = '';
+// display names of users joined by tokens
+var displayNames = {};
+// roles of other users which are not participants
+var roles = {};
+var roomLocked = false;
+var roleState = document.getElementById('roleState');
+var lockButton = document.getElementById('lockButton');
+var endButton = document.getElementById('endButton');
+lockButton.onclick = function () {
+    signalingChannel.send({cmd: roomLocked ? "unlockRoom" : "lockRoom"});
+};
+endButton.onclick = function () {
+    signalingChannel.send({cmd: "endMeeting"});
+};
+
+// chat of the room, it is sent by users which can chat
+var chatMessages = document.getElementById('chatMessages');
+var chatInput = document.getElementById('chatInput');
+document.getElementById('chatButton').onclick = sendChat;
+chatInput.onkeydown = function (evt) {
+    if (evt.key == 'Enter') sendChat();
+};
+
+function sendChat() {
+    if (!chatInput.value) return;
+    signalingChannel.send({cmd: "sendMessage", text: chatInput.value});
+    chatInput.value = '';
+}
+
+function showChat(name, text) {
+    var div = document.createElement('div');
+    div.innerHTML = '<b>' + escapeHTML(displayNames[name] || name) + ':</b> ' + escapeHTML(text);
+    chatMessages.appendChild(div);
+}
+
+function isModerator() {
+    return myRole == 'owner' || myRole == 'moderator';
+}
+
+function showModeration() {
+    roleState.innerText = myRole ? 'role: ' + myRole + (roomLocked ? ', room locked' : '') : '';
+    lockButton.innerText = roomLocked ? 'Unlock room' : 'Lock room';
+    document.querySelectorAll('.moderation').forEach(function(e) {
+        e.style.display = isModerator() ? 'inline' : 'none';
+    });
+}
+showModeration();
+
+var recordButton = document.getElementById('recordButton');
+var recordingState = document.getElementById('recordingState');
+var recording = false;
+recordButton.onclick = function () {
+    signalingChannel.send({cmd: recording ? "stopRecording" : "startRecording"});
+};
 /*
 stopButton.onclick = stop;
 testButton.onclick = test;
@@ -31,6 +114,10 @@ var title = document.getElementById('titleRoom');
 
 var userNameInput = document.getElementById('userName');
 var roomNameInput = document.getElementById('roomName');
+var roomModeSelect = document.getElementById('roomMode');
+// mode of the joined room, in mcu rooms only the 'mix' stream is received,
+// in broadcast rooms only the presenter publishes and others receive the 'presenter' stream
+var roomMode = 'sfu';
 
 userNameInput.onkeyup = inputChanges;
 roomNameInput.onkeyup = inputChanges;
@@ -90,8 +177,11 @@ function trackOptions() {
     };
 }
 
+// ICE servers are sent by the server on connect and on reload of its config
+var iceServers = [{"urls":"stun:stun2.l.google.com:19302"}, {urls:"stun:stun.ekiga.net"}];
+
 function ConfigPC() {
-    return { iceServers: [{"urls":"stun:stun2.l.google.com:19302"}, {urls:"stun:stun.ekiga.net"}]}
+    return { iceServers: iceServers }
 }
 
 function changeVideoTracks() {
@@ -120,25 +210,48 @@ function gotStream(stream) {
 function join() {
     userNameInput.disabled = true;
     roomNameInput.disabled = true;
+    roomModeSelect.disabled = true;
     joinButton.disabled = true;
     //stopButton.disabled = false;
     //testButton.disabled = false;
 
     localVideo.id = userNameInput.value;
 
-    signalingChannel.send({
-        cmd:"joinRoom",
-        room: roomNameInput.value,
-        user: userNameInput.value
+    joinToken(function (token) {
+        signalingChannel.send({
+            cmd:"joinRoom",
+            room: roomNameInput.value,
+            user: userNameInput.value,
+            mode: roomModeSelect.value,
+            token: token
+        });
+        // viewers of broadcast rooms don't publish, the presenter publishes on presenterChanged
+        if (roomModeSelect.value != 'broadcast') callTo(userNameInput.value);
     });
     title.innerText = 'room: '+roomNameInput.value + ', user: '+userNameInput.value;
     firstPage.style.display = "none";
     roomPage.style.display = "block";
     leaveButton.style.display = "block";
     leaveButton.disabled = false;
-    callTo(userNameInput.value);
-
+    presenterButton.style.display = roomModeSelect.value == 'broadcast' ? "inline" : "none";
+    // rooms with a hub have the camera stream only
+    screenButton.style.display = roomModeSelect.value == 'sfu' ? "inline" : "none";
+}
 
+// joinToken gives the token of the page (?token=...) minted by the backend of the application,
+// or the token of the dev endpoint when the server serves it, or nothing when tokens are not required
+function joinToken(callback) {
+    var token = new URLSearchParams(window.location.search).get('token');
+    if (token) return callback(token);
+
+    var query = new URLSearchParams({room: roomNameInput.value, user: userNameInput.value});
+    fetch('/kurento/token?' + query.toString()).then(function (r) {
+        return r.ok ? r.json() : {};
+    }).then(function (answer) {
+        callback(answer.token);
+    }).catch(function () {
+        callback();
+    });
 }
 
 function leave() {
@@ -147,15 +260,25 @@ function leave() {
 
     Object.keys(pcs).map(function(key, ind){
         stopPC(key);
-        if (key  !=  userNameInput.value) {
-            document.getElementById('container-' + key).remove();
-        }
+        var container = document.getElementById('container-' + key);
+        if (container != null) container.remove();
     });
+    screenStream = null;
+    screenButton.innerText = 'Share screen';
+    mediaStates = {};
+    showMediaState(userNameInput.value);
+    myRole = '';
+    roles = {};
+    displayNames = {};
+    roomLocked = false;
+    showModeration();
+    chatMessages.innerHTML = '';
 
     signalingChannel.send({cmd:"leave"});
 
     userNameInput.disabled = false;
     roomNameInput.disabled = false;
+    roomModeSelect.disabled = false;
     joinButton.disabled = false;
 
     firstPage.style.display = "block";
@@ -227,7 +350,13 @@ function SignalingChannel() {
 var sendOfferCfg = {offerToReceiveVideo: -1, offerToReceiveAudio: -1, voiceActivityDetection: true, iceRestart: false};
 var recvOfferCfg = {offerToReceiveVideo: 1, offerToReceiveAudio: 1, voiceActivityDetection: true, iceRestart: false};
 
-function newPC(callee) {
+// streamKey is the key of pcs and the id of the video of the stream, the camera keeps the user name
+function streamKey(name, stream) {
+    return !stream || stream == 'camera' ? name : name + '/' + stream;
+}
+
+function newPC(callee, stream) {
+    var key = streamKey(callee, stream);
 
     var pc = new RTCPeerConnection(ConfigPC());
     // send any ice candidates to the other peer
@@ -237,6 +366,7 @@ function newPC(callee) {
             signalingChannel.send({
                 cmd: 'onIceCandidate',
                 sender: callee,
+                stream: stream,
                 candidate: {candidate:evt.candidate}
             });
         }
@@ -255,6 +385,7 @@ function newPC(callee) {
             signalingChannel.send({
                 cmd: "receiveVideoFrom",
                 sender: callee,
+                stream: stream,
                 sdpOffer: offer.sdp
             });
         }).catch(logError);
@@ -263,33 +394,34 @@ function newPC(callee) {
     pc.onaddstream = function(e) {
         console.log('received remote stream');
         if (callee != userNameInput.value) {
-            var remoteVideo = document.getElementById(callee);
+            var remoteVideo = document.getElementById(key);
             remoteVideo.srcObject = e.stream;
         }
     };
 
     pc.onclose = function () {
         if (callee != userNameInput.value) {
-            var remoteVideo = document.getElementById('container-'+callee);
+            var remoteVideo = document.getElementById('container-'+key);
             if (remoteVideo != null) remoteVideo.remove();
         }
     };
 
-    pcs[callee] = pc;
+    pcs[key] = pc;
 
     return pc;
 }
 
-function callTo(user) {
+function callTo(user, stream) {
     callee = user;
 
-    var pc = pcs[callee] || newPC(callee);
-    if (localStream != null) {
+    var pc = pcs[streamKey(callee, stream)] || newPC(callee, stream);
+    if (localStream != null || callee != userNameInput.value) {
         pc.createOffer(recvOfferCfg).then(function (offer) {
             pc.setLocalDescription(offer);
             signalingChannel.send({
                 cmd: "receiveVideoFrom",
                 sender: callee,
+                stream: stream,
                 sdpOffer: offer.sdp
             });
         }).catch(logError);
@@ -308,6 +440,26 @@ function callTo(user) {
     }
 }
 
+// shareScreen publishes the screen as the 'screen' stream next to the camera
+function shareScreen() {
+    var me = userNameInput.value;
+    navigator.mediaDevices.getDisplayMedia({video: true}).then(function (stream) {
+        screenStream = stream;
+        screenButton.innerText = 'Stop sharing';
+        // the browser bar stops sharing too
+        stream.getVideoTracks().forEach(function(t) { t.onended = stopScreen; });
+        newPC(me, 'screen').addStream(stream);
+    }).catch(logError);
+}
+
+function stopScreen() {
+    if (!screenStream) return;
+    screenStream = null;
+    screenButton.innerText = 'Share screen';
+    stopPC(streamKey(userNameInput.value, 'screen'));
+    signalingChannel.send({cmd: "unpublish", stream: "screen"});
+}
+
 function parseMsg(msg) {
     var data = msg;
     if (!data) return;
@@ -315,6 +467,10 @@ function parseMsg(msg) {
 
     if (data.error !== undefined) {
         console.error(data);
+        // denied commands change nothing, the user stays in the room without the stream
+        if (data.code == 'permission_denied') return denied(data.request);
+        // the room is kept when other commands fail
+        if (data.request && data.request.cmd != 'joinRoom' && data.request.cmd != 'receiveVideoFrom') return;
         return leave();
     }
 
@@ -324,88 +480,241 @@ function parseMsg(msg) {
     switch(data.cmd) {
         case 'receiveVideoAnswer':
             console.log('answer received');
-            var pc = pcs[data.name];
+            var pc = pcs[streamKey(data.name, data.stream)];
             runQueue(data.name);
             pc.setRemoteDescription(new RTCSessionDescription({"type":"answer","sdp":data.sdpAnswer})).catch(logError);
             break;
 
         case 'iceCandidate':
             console.log('iceCandidate');
-            var pc = pcs[data.name];
+            var pc = pcs[streamKey(data.name, data.stream)];
             pc.addIceCandidate(new RTCIceCandidate(data.candidate)).catch(logError);
             break;
 
         case  'participantLeaved':
-            var video = document.getElementById('container-'+data.name);
-            stopPC(data.name);
-
-            if (video != null) video.remove();
+            // without a stream the participant has left with all its streams
+            var keys = data.stream ? [streamKey(data.name, data.stream)] : Object.keys(pcs).filter(function(key) {
+                return key == data.name || key.indexOf(data.name + '/') == 0;
+            }).concat([data.name]);
+            keys.forEach(function(key) {
+                var video = document.getElementById('container-'+key);
+                stopPC(key);
+
+                if (video != null) video.remove();
+            });
             break;
 
         case 'newParticipantArrived':
             if (data.name==userNameInput.value) return;
+            if (data.displayName) displayNames[data.name] = data.displayName;
+            if (roomMode != 'sfu') return;
 
-            var videotag = document.getElementById(data.name);
+            var videotag = document.getElementById(streamKey(data.name, data.stream));
 
             console.log("videotag", videotag);
             if (videotag === null) {
-                CreateVideo(data.name);
+                CreateVideo(data.name, data.stream);
             }
             break;
 
         case 'existingParticipants':
             console.log('existingParticipants');
             console.log("get users: " + data.data);
+            roomMode = data.mode;
+            Object.assign(displayNames, data.names || {});
+            if (roomMode == 'broadcast') {
+                changePresenter(data.presenter);
+                return;
+            }
+            if (roomMode == 'mcu') {
+                if (document.getElementById('mix') === null) CreateVideo('mix');
+                return;
+            }
             if (data.data.length === 0 ) return;
 
             data.data.forEach(function(u) {
                 if (u==userNameInput.value) return;
 
-                var videotag = document.getElementById(u);
-                console.log("videotag", videotag);
-                if (videotag === null) {
-                    CreateVideo(u);
-                }
+                var streams = (data.streams && data.streams[u]) || ['camera'];
+                streams.forEach(function(stream) {
+                    var videotag = document.getElementById(streamKey(u, stream));
+                    console.log("videotag", videotag);
+                    if (videotag === null) {
+                        CreateVideo(u, stream);
+                    }
+                });
             });
 
             break;
+
+        case 'iceServers':
+            iceServers = data.iceServers;
+            break;
+
+        case 'recordingStarted':
+        case 'recordingStopped':
+            recording = data.cmd == 'recordingStarted';
+            recordButton.innerText = recording ? 'Stop recording' : 'Record';
+            recordingState.innerText = recording ? 'recording (started by ' + data.name + ')' : '';
+            break;
+
+        case 'presenterChanged':
+            changePresenter(data.name);
+            break;
+
+        case 'roleChanged':
+            if (data.name == userNameInput.value) {
+                myRole = data.role;
+                showModeration();
+            }
+            roles[data.name] = data.role;
+            showRole(data.name);
+            break;
+
+        case 'roomLocked':
+            roomLocked = data.locked;
+            showModeration();
+            break;
+
+        case 'kicked':
+        case 'meetingEnded':
+            console.log(data.cmd + ' by ' + data.name);
+            leave();
+            break;
+
+        case 'chatMessage':
+            showChat(data.name, data.text);
+            break;
+
+        case 'participantMediaState':
+            var key = streamKey(data.name, data.stream);
+            mediaStates[key] = mediaStates[key] || {};
+            mediaStates[key][data.media] = data.muted;
+            showMediaState(key);
+            break;
+
+        case 'serverShutdown':
+            console.log('server is shutting down, reconnect after ' + data.reconnectAfter + 's');
+            leave();
+            setTimeout(function () {
+                window.location.reload();
+            }, data.reconnectAfter * 1000);
+            break;
     }
 
     return;
 
 }
 
+// denied stops the peer connection of the stream which the user can't publish or receive
+function denied(request) {
+    if (!request || request.cmd != 'receiveVideoFrom') return;
+    if (request.sender == userNameInput.value && request.stream == 'screen') {
+        screenStream = null;
+        screenButton.innerText = 'Share screen';
+    }
+    var key = streamKey(request.sender, request.stream);
+    stopPC(key);
+    var container = document.getElementById('container-' + key);
+    if (container != null && request.sender != userNameInput.value) container.remove();
+}
+
+function changePresenter(name) {
+    var me = userNameInput.value;
+    presenterState.innerText = name ? 'presenter: ' + name : 'no presenter';
+    if (name == me) {
+        if (pcs[me] == null) callTo(me);
+        return;
+    }
+    // the server has released our In, we are a viewer
+    if (pcs[me] != null) {
+        stopPC(me);
+        localStream = null;
+    }
+    if (name && document.getElementById('presenter') === null) CreateVideo('presenter');
+}
+
+function showRole(name) {
+    var label = document.getElementById('role-' + name);
+    var role = roles[name] || 'participant';
+    if (label != null) label.innerText = role == 'participant' ? '' : ' ' + role;
+}
+
+function showMediaState(key) {
+    var state = mediaStates[key] || {};
+    if (key == userNameInput.value) {
+        muteAudioButton.innerText = state.audio ? 'Unmute audio' : 'Mute audio';
+        muteVideoButton.innerText = state.video ? 'Unmute video' : 'Mute video';
+        return;
+    }
+    var label = document.getElementById('state-' + key);
+    if (label == null) return;
+    label.innerText = (state.audio ? ' audio muted' : '') + (state.video ? ' video muted' : '');
+}
+
 var delay = 1000;
 var timeout = 0;
 
-function CreateVideo(u) {
+function CreateVideo(u, stream) {
+    var key = streamKey(u, stream);
+    // names are shown by innerHTML of the link
+    var name = escapeHTML(streamKey(displayNames[u] || u, stream));
     var container = document.createElement('div');
-    container.id = 'container-'+u;
+    container.id = 'container-'+key;
     container.className = "container";
     var video = document.createElement('video');
-    video.id = u;
+    video.id = key;
     video.autoplay = true;
     container.appendChild(video);
     var link = document.createElement('a');
     link.href = '#';
     link.className = 'video-label';
-    link.innerHTML = '<b> call to '+u+'</b>';
+    link.innerHTML = '<b> call to '+name+'</b>';
     var linkClick = false;
     link.onclick = function(e) {
         e.preventDefault();
         linkClick = true;
 
-        if (pcs[u] == null) {
-            callTo(u);
-            link.innerHTML = '<b> hang up '+u+'</b>';
+        if (pcs[key] == null) {
+            callTo(u, stream);
+            link.innerHTML = '<b> hang up '+name+'</b>';
         } else {
-            stopPC(u);
-            signalingChannel.send({cmd:"hangup",sender: u});
-            link.innerHTML = '<b> call '+u+'</b>';
+            stopPC(key);
+            signalingChannel.send({cmd:"hangup",sender: u, stream: stream});
+            link.innerHTML = '<b> call '+name+'</b>';
         }
         return false;
     };
     container.appendChild(link);
+    var state = document.createElement('span');
+    state.id = 'state-' + key;
+    state.className = 'media-state';
+    container.appendChild(state);
+    if (key == u) {
+        var role = document.createElement('span');
+        role.id = 'role-' + u;
+        container.appendChild(role);
+        showRole(u);
+        // moderators mute and kick participants
+        [['mute', function () {
+            var muted = (mediaStates[u] || {}).audio;
+            signalingChannel.send({cmd: muted ? "unmute" : "mute", user: u, media: "audio"});
+        }], ['kick', function () {
+            signalingChannel.send({cmd: "kick", user: u});
+        }]].forEach(function(action) {
+            var a = document.createElement('a');
+            a.href = '#';
+            a.className = 'moderation';
+            a.innerText = ' ' + action[0];
+            a.onclick = function (e) {
+                e.preventDefault();
+                linkClick = true;
+                action[1]();
+                return false;
+            };
+            container.appendChild(a);
+        });
+    }
 
     container.onclick = function (e) {
         e.preventDefault();
@@ -430,13 +739,15 @@ function CreateVideo(u) {
     };
 
     usersDiv.appendChild(container);
+    showMediaState(key);
+    showModeration();
 
     if (!!autoCallCheckbox.value) {
         timeout += delay;
-        link.innerHTML = '<b>Calling '+u+'...</b>';
+        link.innerHTML = '<b>Calling '+name+'...</b>';
         setTimeout(function () {
-            callTo(u);
-            link.innerHTML = '<b> hang up '+u+'</b>';
+            callTo(u, stream);
+            link.innerHTML = '<b> hang up '+name+'</b>';
             timeout -= delay;
         }, timeout);
     }
@@ -470,6 +781,12 @@ function stopPC(callee) {
     }
 }
 
+function escapeHTML(text) {
+    var div = document.createElement('div');
+    div.innerText = text;
+    return div.innerHTML;
+}
+
 function logError(error) {
     console.log(error.name + ": " + error.message);
 }
\ No newline at end of file
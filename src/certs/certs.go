@@ -0,0 +1,165 @@
+// Package certs generates certificates for local and LAN deployments: a local CA,
+// server certificates signed by it and ephemeral self-signed certificates.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const organization = `Mad Squid`
+
+// Pair is a certificate with its key.
+type Pair struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// DefaultHosts returns localhost, the host name and addresses of the host, so the certificate
+// is valid for browsers of the LAN.
+func DefaultHosts() []string {
+	hosts := []string{`localhost`, `127.0.0.1`, `::1`}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			hosts = append(hosts, ipNet.IP.String())
+		}
+	}
+	return hosts
+}
+
+// NewCA returns a CA certificate valid for the duration.
+func NewCA(validFor time.Duration) (*Pair, error) {
+	template, err := newTemplate(`Mad Squid local CA`, validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	return create(template, nil)
+}
+
+// NewServer returns a server certificate for the host names and IPs signed by ca,
+// nil ca makes the certificate self-signed.
+func NewServer(ca *Pair, hosts []string, validFor time.Duration) (*Pair, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New(`no hosts for the certificate`)
+	}
+	template, err := newTemplate(hosts[0], validFor)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return create(template, ca)
+}
+
+func newTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{organization}, CommonName: commonName},
+		// clocks of clients may be behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validFor),
+	}, nil
+}
+
+func create(template *x509.Certificate, ca *Pair) (*Pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Pair{Cert: cert, Key: key}, nil
+}
+
+// TLS returns the pair for tls.Config, chain is certificates of issuers (the CA) sent with it.
+func (p *Pair) TLS(chain ...*x509.Certificate) tls.Certificate {
+	c := tls.Certificate{Certificate: [][]byte{p.Cert.Raw}, PrivateKey: p.Key, Leaf: p.Cert}
+	for _, cert := range chain {
+		c.Certificate = append(c.Certificate, cert.Raw)
+	}
+	return c
+}
+
+// Fingerprint returns SHA-256 of the certificate in the form of browsers: AB:CD:...
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf(`%02X`, b)
+	}
+	return strings.Join(hex, `:`)
+}
+
+// Write saves the certificate and the key in PEM files, the key is readable by the owner only.
+func (p *Pair) Write(certFile, keyFile string) error {
+	keyDER, err := x509.MarshalECPrivateKey(p.Key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: p.Cert.Raw})
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: keyDER})
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// Read loads the pair written by Write.
+func Read(certFile, keyFile string) (*Pair, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf(`%s: key is not ECDSA`, keyFile)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Pair{Cert: cert, Key: key}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"certs"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// certCommand generates a local CA (or reuses the existing one) and a server certificate signed by it:
+//
+//	madsquid cert [-dir .] [-days 825] [host or IP ...]
+func certCommand(args []string) error {
+	flags := flag.NewFlagSet("cert", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: madsquid cert [flags] [host or IP ...]")
+		fmt.Fprintln(flags.Output(), "Generates a local CA and a server certificate for the hosts (localhost and addresses of this host by default).")
+		flags.PrintDefaults()
+	}
+	dir := flags.String("dir", ".", "Directory of the files")
+	caCert := flags.String("ca-cert", "ca.crt", "CA certificate file, the CA is reused when it exists")
+	caKey := flags.String("ca-key", "ca.key", "CA key file")
+	cert := flags.String("cert", "server.crt", "Server certificate file")
+	key := flags.String("key", "server.key", "Server key file")
+	days := flags.Int("days", 825, "Validity of the server certificate in days (browsers reject longer ones)")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	hosts := flags.Args()
+	if len(hosts) == 0 {
+		hosts = certs.DefaultHosts()
+	}
+	path := func(name string) string {
+		return filepath.Join(*dir, name)
+	}
+
+	ca, err := certs.Read(path(*caCert), path(*caKey))
+	switch {
+	case err == nil:
+		fmt.Printf("using CA %s\n", path(*caCert))
+	case errors.Is(err, os.ErrNotExist):
+		if ca, err = certs.NewCA(10 * 365 * 24 * time.Hour); err != nil {
+			return err
+		}
+		if err = ca.Write(path(*caCert), path(*caKey)); err != nil {
+			return err
+		}
+		fmt.Printf("created CA %s, import it to browsers as a trusted authority\n", path(*caCert))
+	default:
+		return err
+	}
+	fmt.Printf("CA SHA-256 fingerprint: %s\n", certs.Fingerprint(ca.Cert))
+
+	server, err := certs.NewServer(ca, hosts, time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	if err = server.Write(path(*cert), path(*key)); err != nil {
+		return err
+	}
+	fmt.Printf("created certificate %s for %v\n", path(*cert), hosts)
+	fmt.Printf("certificate SHA-256 fingerprint: %s\n", certs.Fingerprint(server.Cert))
+	return nil
+}
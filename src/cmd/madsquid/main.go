@@ -1,9 +1,27 @@
 package main
 
-import "server"
+import (
+	"log"
+	"os"
+	"server"
+)
 
 func main() {
-	config := server.GetConfig()
-	server := server.New(config)
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		if err := certCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := server.GetConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, level, err := server.NewLogger(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := server.New(config, logger, level)
 	server.Run()
 }
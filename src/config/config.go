@@ -0,0 +1,375 @@
+// Package config is the configuration of madsquid. It is loaded from defaults, a JSON or TOML file,
+// MADSQUID_* environment variables and command line flags, each one overrides the previous.
+//
+// A setting is addressed by the path of its json names: the file key `log.level` is the variable
+// MADSQUID_LOG_LEVEL and the flag -log.level.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jointoken"
+	"kurento"
+	"logging"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"tracing"
+)
+
+// Duration is time.Duration written as "10s" in files, plain numbers are seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var seconds float64
+		if json.Unmarshal(data, &seconds) != nil {
+			return fmt.Errorf(`bad duration %s`, data)
+		}
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	return d.Set(s)
+}
+
+func (d *Duration) Set(s string) error {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type Config struct {
+	Listen    Listen    `json:"listen"`
+	TLS       TLS       `json:"tls"`
+	Admin     Admin     `json:"admin"`
+	Kurento   Kurento   `json:"kurento"`
+	WebSocket WebSocket `json:"websocket"`
+	Limits    Limits    `json:"limits"`
+	ICE       ICE       `json:"ice"`
+	Recording Recording `json:"recording"`
+	Player    Player    `json:"player"`
+	Tokens    Tokens    `json:"tokens"`
+	Policy    Policy    `json:"policy"`
+	Static    Static    `json:"static"`
+	Log       Log       `json:"log"`
+	Trace     Trace     `json:"trace"`
+	Shutdown  Shutdown  `json:"shutdown"`
+}
+
+type Listen struct {
+	// Addr: host:port of rooms, signalling and static files
+	Addr string `json:"addr"`
+}
+
+// Admin is the listener of admin routes: schema of rooms, metrics, pprof and drain.
+// Its requests are authenticated by the bearer token, client certificates (mTLS) or both.
+type Admin struct {
+	// Addr: host:port of admin routes, empty disables them
+	Addr string `json:"addr"`
+	// Token: bearer token of requests
+	Token string `json:"token"`
+	// ClientCA: PEM file of CA of client certificates, it needs tls.enabled
+	ClientCA string `json:"client_ca"`
+}
+
+type TLS struct {
+	Enabled bool `json:"enabled"`
+	// Cert and Key: PEM files, when both are empty an ephemeral self-signed certificate is generated on start
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type Kurento struct {
+	// Addr: WS endpoint of the media server
+	Addr string `json:"addr"`
+	// Timeout: default deadline of calls to the media server
+	Timeout Duration `json:"timeout"`
+	// Timeouts: deadlines per call name, e.g. `create` or `invoke.processOffer`
+	Timeouts map[string]Duration `json:"timeouts"`
+	Retry    Retry               `json:"retry"`
+	// PingInterval: period of pings keeping the media server session
+	PingInterval Duration `json:"ping_interval"`
+	// WebSocket: timing of the websocket to the media server
+	WebSocket KurentoWebSocket `json:"websocket"`
+}
+
+// KurentoWebSocket is timing of the websocket to the media server, its loss is noticed in pong_wait.
+type KurentoWebSocket struct {
+	// WriteWait: time allowed to write a message to the media server
+	WriteWait Duration `json:"write_wait"`
+	// PongWait: time allowed to read the next pong message from the media server
+	PongWait Duration `json:"pong_wait"`
+	// PingPeriod: pings are sent with this period, it must be less than pong_wait
+	PingPeriod Duration `json:"ping_period"`
+}
+
+type Retry struct {
+	// Attempts: max number of attempts including the first one, 1 disables retries
+	Attempts int      `json:"attempts"`
+	Backoff  Duration `json:"backoff"`
+	// Calls: names of idempotent calls which may be repeated
+	Calls []string `json:"calls"`
+	// Codes: error codes of the media server treated as transient
+	Codes []int `json:"codes"`
+}
+
+// WebSocket configures websockets of clients (/kurento and /ws).
+type WebSocket struct {
+	// WriteWait: time allowed to write a message to the peer
+	WriteWait Duration `json:"write_wait"`
+	// PongWait: time allowed to read the next pong message from the peer, pings are sent every 9/10 of it
+	PongWait Duration `json:"pong_wait"`
+	// MaxMessageSize: max size of a message from the peer (SDP with many tracks may be very big)
+	MaxMessageSize int64 `json:"max_message_size"`
+}
+
+// Limits of the instance, zero means no limit.
+type Limits struct {
+	MaxRooms int `json:"max_rooms"`
+	// MaxParticipants: participants per room
+	MaxParticipants int `json:"max_participants"`
+}
+
+// ICE servers are sent to browsers for their peer connections.
+type ICE struct {
+	Servers []ICEServer `json:"servers"`
+}
+
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Recording of rooms by startRecording, files are written by the media server.
+type Recording struct {
+	// URI: file:// template of files, {room}, {user}, {stream} and {timestamp} are replaced
+	URI string `json:"uri"`
+}
+
+// Player of virtual participants added by addPlayer, the media server opens their URIs.
+type Player struct {
+	// URIs: prefixes of URIs allowed to players, e.g. file:///srv/media/ or rtsp://camera.local/,
+	// their scheme and host must match and the path must be under the prefix. Empty disables players.
+	URIs []string `json:"uris"`
+}
+
+// Tokens are HMAC-signed tokens of joinRoom minted by the backend of the application.
+type Tokens struct {
+	// Secret: shared HMAC secret, joinRoom requires a token when it is set
+	Secret string `json:"secret"`
+	// TTL: lifetime of tokens minted by the dev endpoint
+	TTL Duration `json:"ttl"`
+	// Dev: serve /kurento/token minting tokens for anyone, for development only
+	Dev bool `json:"dev"`
+}
+
+// Policy gives capabilities to users by their roles in rooms when join tokens have none.
+type Policy struct {
+	Owner       []string `json:"owner"`
+	Moderator   []string `json:"moderator"`
+	Participant []string `json:"participant"`
+	Viewer      []string `json:"viewer"`
+}
+
+// PolicyRole is capabilities of the role of Policy.
+type PolicyRole struct {
+	Name         string
+	Capabilities []string
+}
+
+// Roles returns capabilities of roles of the policy from the owner to viewers.
+func (p *Policy) Roles() []PolicyRole {
+	return []PolicyRole{
+		{`owner`, p.Owner},
+		{`moderator`, p.Moderator},
+		{`participant`, p.Participant},
+		{`viewer`, p.Viewer},
+	}
+}
+
+type Static struct {
+	// Root: directory of the test page
+	Root string `json:"root"`
+}
+
+type Log struct {
+	// Level: debug, info, warn or error
+	Level string `json:"level"`
+	// Format: text or json
+	Format string `json:"format"`
+	// Redact: redact SDP secrets, IP addresses and user names in logs
+	Redact bool `json:"redact"`
+}
+
+type Trace struct {
+	// Exporter: none, file or otlp
+	Exporter     string `json:"exporter"`
+	File         string `json:"file"`
+	OTLPEndpoint string `json:"otlp_endpoint"`
+}
+
+type Shutdown struct {
+	// Timeout: time given to rooms to drain on SIGTERM or SIGINT
+	Timeout Duration `json:"timeout"`
+	// ReconnectAfter: reconnect hint sent to clients
+	ReconnectAfter Duration `json:"reconnect_after"`
+}
+
+// Default returns defaults of the packages configured, so they can't drift apart.
+func Default() *Config {
+	client := kurento.DefaultClientConfig()
+	timeouts := make(map[string]Duration, len(client.Timeouts))
+	for name, timeout := range client.Timeouts {
+		timeouts[name] = Duration(timeout)
+	}
+	rooms := kurento.DefaultWebSocketConfig()
+	policy := kurento.DefaultPolicy()
+	return &Config{
+		Listen: Listen{Addr: `:10443`},
+		TLS:    TLS{Enabled: true},
+		Kurento: Kurento{
+			Addr:     client.Addr,
+			Timeout:  Duration(client.Timeout),
+			Timeouts: timeouts,
+			Retry: Retry{
+				Attempts: client.Retry.Attempts,
+				Backoff:  Duration(client.Retry.Backoff),
+				Calls:    client.Retry.Calls,
+				Codes:    client.Retry.Codes,
+			},
+			PingInterval: Duration(client.PingInterval),
+			WebSocket: KurentoWebSocket{
+				WriteWait:  Duration(client.WebSocket.WriteWait),
+				PongWait:   Duration(client.WebSocket.PongWait),
+				PingPeriod: Duration(client.WebSocket.PingPeriod),
+			},
+		},
+		WebSocket: WebSocket{
+			WriteWait:      Duration(rooms.WriteWait),
+			PongWait:       Duration(rooms.PongWait),
+			MaxMessageSize: rooms.MaxMessageSize,
+		},
+		ICE: ICE{Servers: []ICEServer{
+			{URLs: []string{`stun:stun2.l.google.com:19302`}},
+			{URLs: []string{`stun:stun.ekiga.net`}},
+		}},
+		Recording: Recording{URI: kurento.DefaultRecordingURI},
+		Tokens:    Tokens{TTL: Duration(time.Hour)},
+		// copies: lists of files are decoded into these slices, shared ones would be overwritten
+		Policy: Policy{
+			Owner:       append([]string(nil), policy[kurento.OwnerRole]...),
+			Moderator:   append([]string(nil), policy[kurento.ModeratorRole]...),
+			Participant: append([]string(nil), policy[kurento.ParticipantRole]...),
+			Viewer:      append([]string(nil), policy[kurento.ViewerRole]...),
+		},
+		Static: Static{Root: `public/kurento`},
+		Log:    Log{Level: `info`, Format: logging.TextFormat},
+		Trace:  Trace{Exporter: `none`, File: `traces.json`, OTLPEndpoint: tracing.DefaultOTLPEndpoint},
+		Shutdown: Shutdown{
+			Timeout:        Duration(30 * time.Second),
+			ReconnectAfter: Duration(5 * time.Second),
+		},
+	}
+}
+
+// Validate returns all problems of the config joined.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Listen.Addr != "", `listen.addr is empty`)
+	if c.TLS.Enabled {
+		check((c.TLS.Cert == "") == (c.TLS.Key == ""), `tls.cert and tls.key must be set both or none`)
+	}
+
+	if c.Admin.Addr != "" {
+		check(c.Admin.Addr != c.Listen.Addr, `admin.addr must differ from listen.addr`)
+		check(c.Admin.Token != "" || c.Admin.ClientCA != "", `admin.token or admin.client_ca is required by admin.addr`)
+		check(c.Admin.ClientCA == "" || c.TLS.Enabled, `admin.client_ca needs tls.enabled`)
+	}
+
+	u, err := url.Parse(c.Kurento.Addr)
+	check(err == nil && (u.Scheme == `ws` || u.Scheme == `wss`) && u.Host != "", `kurento.addr %q is not a ws:// or wss:// url`, c.Kurento.Addr)
+	check(c.Kurento.Timeout >= 0, `kurento.timeout is negative`)
+	for name, timeout := range c.Kurento.Timeouts {
+		check(timeout >= 0, `kurento.timeouts.%s is negative`, name)
+	}
+	check(c.Kurento.Retry.Attempts >= 0, `kurento.retry.attempts is negative`)
+	check(c.Kurento.Retry.Backoff >= 0, `kurento.retry.backoff is negative`)
+	check(c.Kurento.PingInterval > 0, `kurento.ping_interval must be positive`)
+	check(c.Kurento.WebSocket.WriteWait > 0, `kurento.websocket.write_wait must be positive`)
+	check(c.Kurento.WebSocket.PingPeriod > 0, `kurento.websocket.ping_period must be positive`)
+	check(c.Kurento.WebSocket.PongWait > c.Kurento.WebSocket.PingPeriod, `kurento.websocket.pong_wait must be greater than ping_period`)
+
+	check(c.WebSocket.WriteWait > 0, `websocket.write_wait must be positive`)
+	check(c.WebSocket.PongWait > 0, `websocket.pong_wait must be positive`)
+	check(c.WebSocket.MaxMessageSize > 0, `websocket.max_message_size must be positive`)
+
+	check(c.Limits.MaxRooms >= 0, `limits.max_rooms is negative`)
+	check(c.Limits.MaxParticipants >= 0, `limits.max_participants is negative`)
+
+	for i, server := range c.ICE.Servers {
+		check(len(server.URLs) != 0, `ice.servers[%d].urls is empty`, i)
+	}
+
+	check(strings.HasPrefix(c.Recording.URI, `file://`), `recording.uri %q is not a file:// uri`, c.Recording.URI)
+	for i, uri := range c.Player.URIs {
+		u, err := url.Parse(uri)
+		check(err == nil && u.Scheme != "" && u.Opaque == "" && (u.Host != "" || u.Scheme == `file`),
+			`player.uris[%d] %q is not an absolute uri`, i, uri)
+	}
+
+	check(c.Tokens.Secret == "" || len(c.Tokens.Secret) >= 16, `tokens.secret is shorter than 16 bytes`)
+	check(c.Tokens.TTL > 0, `tokens.ttl must be positive`)
+	check(!c.Tokens.Dev || c.Tokens.Secret != "", `tokens.dev needs tokens.secret`)
+
+	for _, role := range c.Policy.Roles() {
+		for _, capability := range role.Capabilities {
+			check(jointoken.KnownCapability(capability), `policy.%s: unknown capability %q`, role.Name, capability)
+		}
+	}
+
+	check(c.Static.Root != "", `static.root is empty`)
+
+	_, err = logging.ParseLevel(c.Log.Level)
+	check(err == nil, `log.level %q is unknown`, c.Log.Level)
+	check(c.Log.Format == logging.TextFormat || c.Log.Format == logging.JSONFormat, `log.format %q is unknown`, c.Log.Format)
+
+	switch c.Trace.Exporter {
+	case "", `none`:
+	case `file`:
+		check(c.Trace.File != "", `trace.file is empty`)
+	case `otlp`:
+		check(c.Trace.OTLPEndpoint != "", `trace.otlp_endpoint is empty`)
+	default:
+		errs = append(errs, fmt.Errorf(`trace.exporter %q is unknown`, c.Trace.Exporter))
+	}
+
+	check(c.Shutdown.Timeout >= 0, `shutdown.timeout is negative`)
+	check(c.Shutdown.ReconnectAfter >= 0, `shutdown.reconnect_after is negative`)
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables overriding settings.
+const EnvPrefix = `MADSQUID_`
+
+// EnvFile is the variable of the config file path, it is not a setting.
+const EnvFile = EnvPrefix + `CONFIG`
+
+// Load returns defaults overridden by the file (if path is not empty) and by MADSQUID_* variables of environ.
+// The result is not validated, so callers may apply more overrides before Validate.
+func Load(path string, environ []string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.ApplyEnv(environ); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadFile overrides settings present in the file, its format is chosen by the extension: .json or .toml.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case `.json`:
+	case `.toml`:
+		table, err := parseTOML(string(data))
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, path, err)
+		}
+		if data, err = json.Marshal(table); err != nil {
+			return fmt.Errorf(`%s: %w`, path, err)
+		}
+	default:
+		return fmt.Errorf(`%s: unknown config format, use .json or .toml`, path)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf(`%s: %w`, path, err)
+	}
+	return nil
+}
+
+// ApplyEnv overrides settings by MADSQUID_* variables of environ (in form KEY=value),
+// unknown variables are errors to catch typos.
+func (c *Config) ApplyEnv(environ []string) error {
+	paths := map[string]string{}
+	for _, path := range c.Paths() {
+		paths[EnvName(path)] = path
+	}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, `=`)
+		if !ok || !strings.HasPrefix(name, EnvPrefix) || name == EnvFile {
+			continue
+		}
+		path, ok := paths[name]
+		if !ok {
+			return fmt.Errorf(`%s: unknown setting`, name)
+		}
+		if err := c.Set(path, value); err != nil {
+			return fmt.Errorf(`%s: %w`, name, err)
+		}
+	}
+	return nil
+}
+
+// EnvName returns the environment variable of the setting path, e.g. MADSQUID_LOG_LEVEL of log.level.
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, `.`, `_`))
+}
+
+// Paths returns paths of settings which may be set from a string (maps and lists of tables are set in files only).
+func (c *Config) Paths() []string {
+	var paths []string
+	var walk func(prefix string, t reflect.Type)
+	walk = func(prefix string, t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			path := prefix + jsonName(f)
+			switch {
+			case f.Type.Kind() == reflect.Struct:
+				walk(path+`.`, f.Type)
+			case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			case f.Type.Kind() != reflect.Map:
+				paths = append(paths, path)
+			}
+		}
+	}
+	walk("", reflect.TypeOf(c).Elem())
+	return paths
+}
+
+// Set parses value into the setting of the path. Lists are comma separated.
+func (c *Config) Set(path, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(path, `.`) {
+		if v.Kind() != reflect.Struct {
+			return fmt.Errorf(`unknown setting %s`, path)
+		}
+		field, ok := fieldByJSONName(v, name)
+		if !ok {
+			return fmt.Errorf(`unknown setting %s`, path)
+		}
+		v = field
+	}
+	if v.Kind() == reflect.Slice {
+		items := []string{}
+		if value != "" {
+			items = strings.Split(value, `,`)
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(slice.Index(i), strings.TrimSpace(item)); err != nil {
+				return fmt.Errorf(`%s: %w`, path, err)
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf(`%s: %w`, path, err)
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, value string) error {
+	if setter, ok := v.Addr().Interface().(interface{ Set(string) error }); ok {
+		return setter.Set(value)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	default:
+		return fmt.Errorf(`setting of %s can't be set from a string`, v.Type())
+	}
+	return nil
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get(`json`), `,`)
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func fieldByJSONName(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if jsonName(v.Type().Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
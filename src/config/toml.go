@@ -0,0 +1,378 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses the subset of TOML needed by config files: tables, arrays of tables, dotted
+// and quoted keys, strings, integers, floats, booleans, arrays and inline tables.
+// Tables of the result may be decoded as JSON.
+func parseTOML(text string) (map[string]interface{}, error) {
+	p := &tomlParser{text: text, line: 1}
+	// defined: paths of tables with [table] headers, a table may have one header only
+	defined := map[string]bool{}
+	root := map[string]interface{}{}
+	current := root
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return root, nil
+		}
+		var err error
+		if p.peek() == '[' {
+			p.pos++
+			array := p.consume('[')
+			var keys []string
+			if keys, err = p.keys(); err != nil {
+				return nil, err
+			}
+			if !p.consume(']') || array && !p.consume(']') {
+				return nil, p.errorf(`expected ] after table name`)
+			}
+			path := tablePath(keys)
+			if array {
+				// tables under the new element of the array are defined anew
+				for name := range defined {
+					if strings.HasPrefix(name, path+`.`) {
+						delete(defined, name)
+					}
+				}
+				current, err = arrayTable(root, keys)
+			} else {
+				if defined[path] {
+					return nil, p.errorf(`table %s is defined twice`, strings.Join(keys, `.`))
+				}
+				defined[path] = true
+				current, err = table(root, keys)
+			}
+			if err != nil {
+				return nil, p.errorf(`%v`, err)
+			}
+		} else {
+			if err = p.keyValue(current); err != nil {
+				return nil, err
+			}
+		}
+		p.skipSpace(false)
+		if !p.eof() && p.peek() != '\n' {
+			return nil, p.errorf(`expected new line`)
+		}
+	}
+}
+
+type tomlParser struct {
+	text string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf(`toml line %d: %s`, p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.text)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.text[p.pos]
+}
+
+func (p *tomlParser) consume(c byte) bool {
+	p.skipSpace(false)
+	if !p.eof() && p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// skipSpace skips spaces and comments, and new lines too when lines is true.
+func (p *tomlParser) skipSpace(lines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && lines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// tablePath returns the path of the dotted keys which is not ambiguous for keys with dots.
+func tablePath(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = strconv.Quote(key)
+	}
+	return strings.Join(quoted, `.`)
+}
+
+// table returns the table of the dotted keys, missing tables are created.
+// Keys of arrays of tables refer to their last tables.
+func table(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	t := root
+	for _, key := range keys {
+		next, ok := t[key]
+		if !ok {
+			next = map[string]interface{}{}
+			t[key] = next
+		}
+		if array, ok := next.([]interface{}); ok && len(array) != 0 {
+			next = array[len(array)-1]
+		}
+		if t, ok = next.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf(`key %s is not a table`, key)
+		}
+	}
+	return t, nil
+}
+
+// arrayTable appends a new table to the array of tables of the dotted keys.
+func arrayTable(root map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	parent, err := table(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	key := keys[len(keys)-1]
+	var array []interface{}
+	if v, ok := parent[key]; ok {
+		if array, ok = v.([]interface{}); !ok {
+			return nil, fmt.Errorf(`key %s is not an array of tables`, key)
+		}
+	}
+	t := map[string]interface{}{}
+	parent[key] = append(array, t)
+	return t, nil
+}
+
+func (p *tomlParser) keyValue(t map[string]interface{}) error {
+	keys, err := p.keys()
+	if err != nil {
+		return err
+	}
+	if !p.consume('=') {
+		return p.errorf(`expected = after key`)
+	}
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if t, err = table(t, keys[:len(keys)-1]); err != nil {
+		return p.errorf(`%v`, err)
+	}
+	key := keys[len(keys)-1]
+	if _, ok := t[key]; ok {
+		return p.errorf(`duplicate key %s`, key)
+	}
+	t[key] = value
+	return nil
+}
+
+// keys parses a dotted key, parts may be quoted.
+func (p *tomlParser) keys() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.eof() {
+			return nil, p.errorf(`expected key`)
+		}
+		var key string
+		switch p.peek() {
+		case '"', '\'':
+			s, err := p.string()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKey(p.peek()) {
+				p.pos++
+			}
+			key = p.text[start:p.pos]
+			if key == "" {
+				return nil, p.errorf(`expected key`)
+			}
+		}
+		keys = append(keys, key)
+		if !p.consume('.') {
+			return keys, nil
+		}
+	}
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	p.skipSpace(false)
+	if p.eof() {
+		return nil, p.errorf(`expected value`)
+	}
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.string()
+	case c == '[':
+		p.pos++
+		values := []interface{}{}
+		for {
+			p.skipSpace(true)
+			if p.consume(']') {
+				return values, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			p.skipSpace(true)
+			if p.consume(']') {
+				return values, nil
+			}
+			if !p.consume(',') {
+				return nil, p.errorf(`expected , or ] in array`)
+			}
+		}
+	case c == '{':
+		p.pos++
+		t := map[string]interface{}{}
+		if p.consume('}') {
+			return t, nil
+		}
+		for {
+			if err := p.keyValue(t); err != nil {
+				return nil, err
+			}
+			if p.consume('}') {
+				return t, nil
+			}
+			if !p.consume(',') {
+				return nil, p.errorf(`expected , or } in inline table`)
+			}
+		}
+	}
+
+	start := p.pos
+	for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.peek()) < 0 {
+		p.pos++
+	}
+	word := p.text[start:p.pos]
+	switch word {
+	case `true`:
+		return true, nil
+	case `false`:
+		return false, nil
+	}
+	number := strings.ReplaceAll(word, `_`, ``)
+	if i, ok := parseInteger(number); ok {
+		return i, nil
+	}
+	if tomlFloat.MatchString(number) {
+		if f, err := strconv.ParseFloat(number, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, p.errorf(`bad value %q`, word)
+}
+
+var (
+	// tomlDecimal: decimal integers have no leading zeros, unlike the 0 prefix of Go they are never octal
+	tomlDecimal = regexp.MustCompile(`^[+-]?(0|[1-9][0-9]*)$`)
+	tomlFloat   = regexp.MustCompile(`^[+-]?((0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?|inf|nan)$`)
+)
+
+// parseInteger parses a decimal integer or an unsigned one with 0x, 0o or 0b prefix.
+func parseInteger(number string) (int64, bool) {
+	base := 10
+	if len(number) > 2 && number[0] == '0' {
+		switch number[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+	}
+	if base == 10 && !tomlDecimal.MatchString(number) {
+		return 0, false
+	}
+	if base != 10 {
+		number = number[2:]
+		// the sign is not allowed after the prefix
+		if number[0] == '+' || number[0] == '-' {
+			return 0, false
+		}
+	}
+	i, err := strconv.ParseInt(number, base, 64)
+	return i, err == nil
+}
+
+// string parses a basic "..." or a literal '...' string on one line.
+func (p *tomlParser) string() (string, error) {
+	quote := p.peek()
+	p.pos++
+	b := strings.Builder{}
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf(`unterminated string`)
+		}
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			if p.eof() {
+				return "", p.errorf(`unterminated string`)
+			}
+			e := p.peek()
+			p.pos++
+			switch e {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				size := 4
+				if e == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.text) {
+					return "", p.errorf(`bad unicode escape`)
+				}
+				r, err := strconv.ParseUint(p.text[p.pos:p.pos+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", p.errorf(`bad unicode escape`)
+				}
+				p.pos += size
+				b.WriteRune(rune(r))
+			default:
+				return "", p.errorf(`bad escape \%c`, e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
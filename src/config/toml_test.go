@@ -0,0 +1,185 @@
+package config
+
+import (
+	"kurento"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type tomlTable = map[string]interface{}
+
+func TestParseTOML(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		want tomlTable
+	}{
+		{`strings`, `a = "x y"` + "\n" + `b = 'C:\dir'` + "\n" + `c = ""`,
+			tomlTable{`a`: `x y`, `b`: `C:\dir`, `c`: ``}},
+		{`escapes`, `a = "q\"b\\t\tn\nu\u00e9U\U0001F991"`,
+			tomlTable{`a`: "q\"b\\t\tn\nu\u00e9U\U0001F991"}},
+		{`scalars`, "i = -42\nh = 0x1f\nu = 1_000\nf = 0.5\ne = 1e3\nt = true\nn = false",
+			tomlTable{`i`: int64(-42), `h`: int64(31), `u`: int64(1000), `f`: 0.5, `e`: 1000.0, `t`: true, `n`: false}},
+		{`integers`, "z = 0\nd = 10\np = +7\no = 0o17\nb = 0b101\nm = -0",
+			tomlTable{`z`: int64(0), `d`: int64(10), `p`: int64(7), `o`: int64(15), `b`: int64(5), `m`: int64(0)}},
+		{`arrays`, "a = [1, \"two\", [3]]\nb = []\nc = [\n  \"x\",\n  \"y\", # y\n]",
+			tomlTable{`a`: []interface{}{int64(1), `two`, []interface{}{int64(3)}}, `b`: []interface{}{}, `c`: []interface{}{`x`, `y`}}},
+		{`inline table`, `a = { b = 1, c.d = "e" }` + "\nf = {}",
+			tomlTable{`a`: tomlTable{`b`: int64(1), `c`: tomlTable{`d`: `e`}}, `f`: tomlTable{}}},
+		{`nested tables`, "[a]\nx = 1\n[a.b.c]\ny = 2\n[d]\n\"e.f\" = 3\ng.h = 4",
+			tomlTable{`a`: tomlTable{`x`: int64(1), `b`: tomlTable{`c`: tomlTable{`y`: int64(2)}}}, `d`: tomlTable{`e.f`: int64(3), `g`: tomlTable{`h`: int64(4)}}}},
+		{`quoted table`, "[kurento.timeouts]\n\"invoke.processOffer\" = \"10s\"",
+			tomlTable{`kurento`: tomlTable{`timeouts`: tomlTable{`invoke.processOffer`: `10s`}}}},
+		{`array of tables`, "[[ice.servers]]\nurls = [\"stun:a\"]\n[[ice.servers]]\nurls = [\"turn:b\"]\nusername = \"u\"",
+			tomlTable{`ice`: tomlTable{`servers`: []interface{}{
+				tomlTable{`urls`: []interface{}{`stun:a`}},
+				tomlTable{`urls`: []interface{}{`turn:b`}, `username`: `u`},
+			}}}},
+		{`tables of array elements`, "[[a]]\n[a.b]\nx = 1\n[[a]]\n[a.b]\nx = 2",
+			tomlTable{`a`: []interface{}{
+				tomlTable{`b`: tomlTable{`x`: int64(1)}},
+				tomlTable{`b`: tomlTable{`x`: int64(2)}},
+			}}},
+		{`super table after its table`, "[a.b]\nx = 1\n[a]\ny = 2",
+			tomlTable{`a`: tomlTable{`b`: tomlTable{`x`: int64(1)}, `y`: int64(2)}}},
+		{`comments`, "# head\n\n[a] # table\nb = \"#not comment\" # comment\n  # indented\nc = 1#tight",
+			tomlTable{`a`: tomlTable{`b`: `#not comment`, `c`: int64(1)}}},
+		{`crlf`, "a = 1\r\n[b]\r\nc = 'd'\r\n", tomlTable{`a`: int64(1), `b`: tomlTable{`c`: `d`}}},
+		{`empty`, "\n# nothing\n", tomlTable{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTOML(tc.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got  %#v\nwant %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		err  string
+	}{
+		{`no value`, "a = 1\nb =", `toml line 2: expected value`},
+		{`no equals`, "\n\na 1", `toml line 3: expected = after key`},
+		{`bad value`, "[a]\nb = yes", `toml line 2: bad value "yes"`},
+		{`unterminated string`, "# c\na = \"x\nb = 1", `toml line 2: unterminated string`},
+		{`bad escape`, `a = "\q"`, `toml line 1: bad escape \q`},
+		{`bad unicode`, `a = "\u00"`, `toml line 1: bad unicode escape`},
+		{`duplicate key`, "a = 1\n\n# again\na = 2", `toml line 4: duplicate key a`},
+		{`not a table`, "a = 1\n[a.b]", `toml line 2: key a is not a table`},
+		{`not an array of tables`, "[a]\n[[a]]", `toml line 2: key a is not an array of tables`},
+		{`table name`, "[a\nb = 1", `toml line 1: expected ] after table name`},
+		{`two values`, "a = 1 2", `toml line 1: expected new line`},
+		{`array`, "a = [\n1\n2]", `toml line 3: expected , or ] in array`},
+		{`inline table`, `a = { b = 1 c = 2 }`, `toml line 1: expected , or } in inline table`},
+		{`no key`, "= 1", `toml line 1: expected key`},
+		{`table defined twice`, "[a]\nx = 1\n[b]\n[a]\ny = 2", `toml line 4: table a is defined twice`},
+		{`leading zero`, "a = 010", `toml line 1: bad value "010"`},
+		{`float leading zero`, "a = 01.5", `toml line 1: bad value "01.5"`},
+		{`signed hex`, "a = -0x1f", `toml line 1: bad value "-0x1f"`},
+		{`sign after prefix`, "a = 0x-1", `toml line 1: bad value "0x-1"`},
+		{`hex float`, "a = 0x1p-2", `toml line 1: bad value "0x1p-2"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTOML(tc.text)
+			if err == nil {
+				t.Fatalf(`no error, got %#v`, got)
+			}
+			if err.Error() != tc.err {
+				t.Errorf(`error is %q, want %q`, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `madsquid.toml`)
+	err := os.WriteFile(path, []byte(strings.Join([]string{
+		`[kurento]`,
+		`addr = "ws://file:8888/kurento"`,
+		`timeout = "3s"`,
+		`[kurento.retry]`,
+		`calls = ["release"]`,
+		`[log]`,
+		`level = "debug"`,
+	}, "\n")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		environ []string
+		addr    string
+		timeout time.Duration
+		calls   []string
+		level   string
+	}{
+		{`defaults`, nil, `ws://localhost:8888/kurento`, 10 * time.Second, []string{`release`, `subscribe`, `invoke.getStats`}, `info`},
+		{`file`, []string{`HOME=/root`}, `ws://file:8888/kurento`, 3 * time.Second, []string{`release`}, `debug`},
+		{`env`, []string{
+			`MADSQUID_KURENTO_ADDR=ws://env:8888/kurento`,
+			`MADSQUID_KURENTO_TIMEOUT=1.5`,
+			`MADSQUID_KURENTO_RETRY_CALLS=subscribe, invoke.getStats`,
+			EnvFile + `=ignored.toml`,
+		}, `ws://env:8888/kurento`, 1500 * time.Millisecond, []string{`subscribe`, `invoke.getStats`}, `debug`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := path
+			if tc.name == `defaults` {
+				file = ""
+			}
+			c, err := Load(file, tc.environ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Kurento.Addr != tc.addr {
+				t.Errorf(`kurento.addr is %s, want %s`, c.Kurento.Addr, tc.addr)
+			}
+			if time.Duration(c.Kurento.Timeout) != tc.timeout {
+				t.Errorf(`kurento.timeout is %s, want %s`, c.Kurento.Timeout, tc.timeout)
+			}
+			if !reflect.DeepEqual(c.Kurento.Retry.Calls, tc.calls) {
+				t.Errorf(`kurento.retry.calls is %v, want %v`, c.Kurento.Retry.Calls, tc.calls)
+			}
+			if c.Log.Level != tc.level {
+				t.Errorf(`log.level is %s, want %s`, c.Log.Level, tc.level)
+			}
+		})
+	}
+
+	if _, err = Load(path, []string{`MADSQUID_KURENTO_ADRR=ws://typo`}); err == nil {
+		t.Error(`unknown variable is accepted`)
+	}
+	if _, err = Load(path, []string{`MADSQUID_KURENTO_TIMEOUT=soon`}); err == nil {
+		t.Error(`bad duration is accepted`)
+	}
+}
+
+func TestDefaultPolicyIsCopied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `madsquid.toml`)
+	if err := os.WriteFile(path, []byte("[policy]\nowner = [\"chat\"]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want := kurento.DefaultPolicy()[kurento.OwnerRole]
+	c, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Policy.Owner, []string{`chat`}) {
+		t.Errorf(`policy.owner is %v`, c.Policy.Owner)
+	}
+	if got := Default().Policy.Owner; !reflect.DeepEqual(got, want) {
+		t.Errorf(`default policy.owner is %v after a file, want %v`, got, want)
+	}
+}
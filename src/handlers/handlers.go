@@ -5,7 +5,9 @@ import (
 
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"logging"
+	"metrics"
 	"net/http"
 	"sync"
 )
@@ -13,31 +15,48 @@ import (
 type Service struct {
 	sync.RWMutex
 	clients map[string]*ws.WS
+	config  *ws.Config
+	log     *slog.Logger
+	// shutdown: new websockets are rejected
+	shutdown bool
 }
 
-func NewService() *Service {
-	return &Service{
+func NewService(config *ws.Config, logger *slog.Logger, registry *metrics.Registry) *Service {
+	s := &Service{
 		clients: map[string]*ws.WS{},
+		config:  config,
+		log:     logging.OrDefault(logger).With(logging.Component, `signalling`),
 	}
+	registry.GaugeFunc(`madsquid_signalling_users`, `Users connected to /ws signalling.`, func() float64 {
+		s.RLock()
+		defer s.RUnlock()
+		return float64(len(s.clients))
+	})
+	return s
 }
 
 func (s *Service) WSHandle(rw http.ResponseWriter, req *http.Request) {
 	user := req.FormValue("user")
 	if user == "" {
-		log.Print("Source user not found")
+		s.log.Warn("source user not found")
 		return
 	}
 	s.Lock()
+	if s.shutdown {
+		s.Unlock()
+		s.httpErr(rw, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	if _, ok := s.clients[user]; ok {
 		s.Unlock()
-		httpErr(rw, "User already exists", http.StatusBadRequest)
+		s.httpErr(rw, "User already exists", http.StatusBadRequest)
 		return
 	}
 
-	ws, err := ws.NewWS(rw, req)
+	ws, err := ws.NewWS(rw, req, s.config, s.log.With(logging.User, user))
 	if err != nil {
 		s.Unlock()
-		log.Printf("WEBSOCKET CONNECTION ERROR: %s", err)
+		s.log.Warn("websocket connection error", logging.User, user, logging.Err(err))
 		return
 	}
 
@@ -57,21 +76,21 @@ func (s *Service) WSHandle(rw http.ResponseWriter, req *http.Request) {
 	ch := ws.Run()
 	for msg := range ch {
 		if err := s.SentFrom(user, msg); err != nil {
-			log.Printf("SEND ERROR: %s", err)
+			s.log.Warn("send error", logging.User, user, logging.Err(err))
 		}
 	}
 }
 
 func (s *Service) PostMessage(rw http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
-		httpErr(rw, "Only POST allowed", http.StatusMethodNotAllowed)
+		s.httpErr(rw, "Only POST allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	decoder := json.NewDecoder(req.Body)
 	var postMsg PostMessage
 	if err := decoder.Decode(&postMsg); err != nil {
-		httpErr(rw, fmt.Sprintf("ERROR JSON DECODE: %s", err), http.StatusInternalServerError)
+		s.httpErr(rw, fmt.Sprintf("ERROR JSON DECODE: %s", err), http.StatusInternalServerError)
 	}
 	req.Body.Close()
 
@@ -80,16 +99,16 @@ func (s *Service) PostMessage(rw http.ResponseWriter, req *http.Request) {
 		Content: postMsg.Content,
 	})
 	if err != nil {
-		httpErr(rw, fmt.Sprintf("ERROR JSON MARSHAL: %s", err), http.StatusInternalServerError)
+		s.httpErr(rw, fmt.Sprintf("ERROR JSON MARSHAL: %s", err), http.StatusInternalServerError)
 		return
 	}
 	if err := s.SentFrom(postMsg.From, msg); err != nil {
-		httpErr(rw, fmt.Sprintf("SEND ERROR: %s", err), http.StatusInternalServerError)
+		s.httpErr(rw, fmt.Sprintf("SEND ERROR: %s", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func httpErr(rw http.ResponseWriter, msg string, code int) {
-	log.Print(msg)
+func (s *Service) httpErr(rw http.ResponseWriter, msg string, code int) {
+	s.log.Warn(msg, "status", code)
 	http.Error(rw, msg, code)
 }
@@ -3,7 +3,8 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"logging"
+	"time"
 )
 
 type PostMessage struct {
@@ -29,6 +30,34 @@ type UsersListMessage struct {
 	} `json:"content"`
 }
 
+type ServerShutdownMessage struct {
+	Content struct {
+		Type           string `json:"type"`
+		ReconnectAfter int    `json:"reconnectAfter"`
+	} `json:"content"`
+}
+
+// Shutdown rejects new users and asks connected ones to reconnect after reconnectAfter.
+func (s *Service) Shutdown(reconnectAfter time.Duration) {
+	msg := &ServerShutdownMessage{}
+	msg.Content.Type = "serverShutdown"
+	msg.Content.ReconnectAfter = int(reconnectAfter / time.Second)
+	m, err := json.Marshal(msg)
+	if err != nil {
+		s.log.Error("marshal error", logging.Err(err))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.shutdown = true
+	for user, ws := range s.clients {
+		if err = ws.Send(m); err != nil {
+			s.log.Warn("websocket send error", logging.User, user, logging.Err(err))
+		}
+	}
+}
+
 func (s *Service) SentFrom(userFrom string, m []byte) error {
 	var err error
 	inMsg := &InMessage{}
@@ -71,13 +100,13 @@ func (s *Service) UsersListSend() {
 
 	m, err := json.Marshal(msg)
 	if err != nil {
-		log.Printf("MARSHAL ERROR: %s", err)
+		s.log.Error("marshal error", logging.Err(err))
 		return
 	}
 
 	for _, ws := range s.clients {
 		if err = ws.Send(m); err != nil {
-			log.Printf("WEBSOCKET SENT ERROR: %s", err)
+			s.log.Warn("websocket send error", logging.Err(err))
 		}
 	}
 }
@@ -0,0 +1,118 @@
+// Package health serves liveness (/healthz) and readiness (/readyz) of the process.
+// Readiness is a set of named checks of dependencies, the instance is not ready
+// when one of them fails or when it is shutting down.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrShuttingDown is the state of the shutdown check during shutdown.
+var ErrShuttingDown = errors.New(`server is shutting down`)
+
+// checkTimeout limits every check of a readiness request.
+const checkTimeout = 2 * time.Second
+
+// Check returns nil when the dependency is ready.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker keeps readiness checks, it is a http.Handler of /readyz.
+type Checker struct {
+	lock   sync.RWMutex
+	checks []namedCheck
+
+	shutdown atomic.Bool
+}
+
+func NewChecker() *Checker {
+	c := &Checker{}
+	c.Register(`shutdown`, func(context.Context) error {
+		if c.shutdown.Load() {
+			return ErrShuttingDown
+		}
+		return nil
+	})
+	return c
+}
+
+// Register adds the check of the dependency with the name, checks are reported in order of registration.
+func (c *Checker) Register(name string, check Check) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Shutdown makes the instance not ready for good.
+func (c *Checker) Shutdown() {
+	c.shutdown.Store(true)
+}
+
+// Status of a dependency in the readiness report.
+type Status struct {
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the body of /readyz.
+type Report struct {
+	Ready  bool               `json:"ready"`
+	Checks map[string]*Status `json:"checks"`
+}
+
+// Check runs all checks concurrently.
+func (c *Checker) Check(ctx context.Context) *Report {
+	c.lock.RLock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	statuses := make([]*Status, len(checks))
+	wg := sync.WaitGroup{}
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = &Status{Ready: true}
+			if err := checks[i].check(ctx); err != nil {
+				statuses[i] = &Status{Error: err.Error()}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report := &Report{Ready: true, Checks: make(map[string]*Status, len(checks))}
+	for i, check := range checks {
+		report.Checks[check.name] = statuses[i]
+		report.Ready = report.Ready && statuses[i].Ready
+	}
+	return report
+}
+
+// ServeHTTP answers 200 when the instance is ready and 503 otherwise, the body is the Report.
+func (c *Checker) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	report := c.Check(req.Context())
+	rw.Header().Set(`Content-Type`, `application/json`)
+	if !report.Ready {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(report)
+}
+
+// Healthz answers 200 while the process is able to serve http.
+func Healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set(`Content-Type`, `application/json`)
+	rw.Write([]byte(`{"alive":true}` + "\n"))
+}
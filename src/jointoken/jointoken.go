@@ -0,0 +1,121 @@
+// Package jointoken mints and verifies tokens of joinRoom. The backend of the application mints
+// a token for the user and the browser passes it to madsquid, which trusts the claims of the token
+// instead of room and user names sent by the browser.
+//
+// A token is base64url(JSON claims) "." base64url(HMAC-SHA256 of the first part by the shared secret).
+package jointoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New(`malformed join token`)
+	ErrSignature = errors.New(`bad signature of join token`)
+	ErrExpired   = errors.New(`join token has expired`)
+	ErrNoSecret  = errors.New(`secret of join tokens is empty`)
+)
+
+// Capabilities of users, rooms give them by roles when the token has none.
+const (
+	PublishAudio  = `publish_audio`
+	PublishVideo  = `publish_video`
+	PublishScreen = `publish_screen`
+	Subscribe     = `subscribe`
+	Record        = `record`
+	Chat          = `chat`
+	// Moderate: kick, mute others, lock the room, end the meeting, players
+	Moderate = `moderate`
+)
+
+// Capabilities is the list of known capabilities.
+var Capabilities = []string{PublishAudio, PublishVideo, PublishScreen, Subscribe, Record, Chat, Moderate}
+
+// KnownCapability tells if the capability is in Capabilities.
+func KnownCapability(capability string) bool {
+	for _, c := range Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims of the token.
+type Claims struct {
+	Room string `json:"room"`
+	// User: id of the user, it is the user name in the room
+	User string `json:"user"`
+	// Name: display name of the user
+	Name string `json:"name,omitempty"`
+	// Role: owner, moderator, participant or viewer, empty means the role given by the room
+	Role string `json:"role,omitempty"`
+	// Expires: unix time in seconds
+	Expires int64 `json:"exp"`
+	// Capabilities of the user, they replace capabilities of its role in the room.
+	// Nil (null or absent) means capabilities of the role, an empty list gives none, so it is never omitted.
+	Capabilities []string `json:"caps"`
+}
+
+// ExpiresAt returns Expires as time.
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+var encoding = base64.RawURLEncoding
+
+// Mint returns the token of claims signed by secret.
+func Mint(secret []byte, c *Claims) (string, error) {
+	if len(secret) == 0 {
+		return "", ErrNoSecret
+	}
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := encoding.EncodeToString(raw)
+	return payload + `.` + encoding.EncodeToString(sign(secret, payload)), nil
+}
+
+// Verify returns claims of the token signed by secret which has not expired at now.
+func Verify(secret []byte, token string, now time.Time) (*Claims, error) {
+	if len(secret) == 0 {
+		return nil, ErrNoSecret
+	}
+	payload, signature, ok := strings.Cut(token, `.`)
+	if !ok {
+		return nil, ErrMalformed
+	}
+	mac, err := encoding.DecodeString(signature)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	// the signature is checked before claims are parsed
+	if !hmac.Equal(mac, sign(secret, payload)) {
+		return nil, ErrSignature
+	}
+	raw, err := encoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	c := &Claims{}
+	if err = json.Unmarshal(raw, c); err != nil || c.Room == "" || c.User == "" {
+		return nil, ErrMalformed
+	}
+	if !now.Before(c.ExpiresAt()) {
+		return nil, ErrExpired
+	}
+	return c, nil
+}
+
+func sign(secret []byte, payload string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,63 @@
+package jointoken
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	secret := []byte(`secret`)
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name string
+		caps []string
+	}{
+		{`role capabilities`, nil},
+		{`no capabilities`, []string{}},
+		{`some capabilities`, []string{Subscribe, Chat}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := Mint(secret, &Claims{Room: `room`, User: `user`, Expires: now.Add(time.Minute).Unix(), Capabilities: tc.caps})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := Verify(secret, token, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// nil gives capabilities of the role, so it must not be confused with the empty list
+			if (c.Capabilities == nil) != (tc.caps == nil) || !reflect.DeepEqual(c.Capabilities, tc.caps) {
+				t.Errorf(`capabilities are %#v, want %#v`, c.Capabilities, tc.caps)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte(`secret`)
+	now := time.Unix(1700000000, 0)
+	token, err := Mint(secret, &Claims{Room: `room`, User: `user`, Expires: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		secret []byte
+		token  string
+		now    time.Time
+		err    error
+	}{
+		{`valid`, secret, token, now, nil},
+		{`other secret`, []byte(`other`), token, now, ErrSignature},
+		{`no secret`, nil, token, now, ErrNoSecret},
+		{`expired`, secret, token, now.Add(time.Minute), ErrExpired},
+		{`malformed`, secret, `token`, now, ErrMalformed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Verify(tc.secret, tc.token, tc.now); err != tc.err {
+				t.Errorf(`error is %v, want %v`, err, tc.err)
+			}
+		})
+	}
+}
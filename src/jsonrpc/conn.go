@@ -0,0 +1,362 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"logging"
+	"sync"
+	"sync/atomic"
+)
+
+// Transport delivers whole messages, kurento/websocket.WsListener is one of them.
+type Transport interface {
+	// Read returns channel of incoming messages, it is closed with the transport.
+	Read() <-chan []byte
+	// Write sends one message.
+	Write(msg []byte)
+}
+
+// ContextWriter is implemented by transports which trace writes,
+// Conn passes them the context of the call.
+type ContextWriter interface {
+	WriteContext(ctx context.Context, msg []byte)
+}
+
+// Call is one element of a batch. Result (if not nil) is filled by the answer,
+// Error is the error answered for the call. Notifications get no answer.
+type Call struct {
+	Method       string
+	Params       interface{}
+	Result       interface{}
+	Notification bool
+
+	Error error
+}
+
+// Conn is a JSON-RPC 2.0 peer working over a Transport.
+type Conn struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	transport Transport
+	handler   Handler
+	log       *slog.Logger
+
+	seq int64
+
+	lock    sync.Mutex
+	pending map[string]chan *message
+	// notifications are served one by one in order of arrival (e.g. events of one KMS object)
+	notifications []*message
+	notified      chan struct{}
+}
+
+// NewConn starts reading the transport. Requests and notifications from the other side
+// are served by handler (nil handler answers "method not found" to every request).
+// Requests are served concurrently, notifications are served sequentially in order of arrival.
+func NewConn(ctx context.Context, t Transport, handler Handler, logger *slog.Logger) *Conn {
+	if handler == nil {
+		handler = NewMux()
+	}
+	c := &Conn{
+		transport: t,
+		handler:   handler,
+		log:       logging.OrDefault(logger).With(logging.Component, `jsonrpc`),
+		pending:   make(map[string]chan *message, 0),
+		notified:  make(chan struct{}, 1),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(ctx, connKey{}, c))
+	go c.loop()
+	go c.notifyLoop()
+	return c
+}
+
+type connKey struct{}
+
+// FromContext returns the connection of the request served by a handler,
+// handlers call the other side by it.
+func FromContext(ctx context.Context) (*Conn, bool) {
+	c, ok := ctx.Value(connKey{}).(*Conn)
+	return c, ok
+}
+
+// Done is closed when the connection is closed or its transport is gone.
+func (c *Conn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Close stops the connection, waiting calls get ErrClosed. Transport is not closed.
+func (c *Conn) Close() error {
+	c.cancel()
+	return nil
+}
+
+// Call sends request and waits for the answer. Result is decoded into result if it is not nil,
+// answered error is returned as *Error.
+func (c *Conn) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	calls := []*Call{{Method: method, Params: params, Result: result}}
+	if err := c.send(ctx, calls, false); err != nil {
+		return err
+	}
+	return calls[0].Error
+}
+
+// Notify sends notification, there is no answer for it.
+func (c *Conn) Notify(method string, params interface{}) error {
+	return c.send(c.ctx, []*Call{{Method: method, Params: params, Notification: true}}, false)
+}
+
+// Batch sends all calls as one batch and waits for all answers.
+// Returned error is about the batch itself, errors of calls are in Call.Error.
+func (c *Conn) Batch(ctx context.Context, calls ...*Call) error {
+	return c.send(ctx, calls, true)
+}
+
+func (c *Conn) send(ctx context.Context, calls []*Call, batch bool) error {
+	select {
+	case <-c.ctx.Done():
+		return ErrClosed
+	default:
+	}
+
+	msgs := make([]*message, len(calls))
+	waits := make(map[int]chan *message, len(calls))
+	for i, call := range calls {
+		msg := &message{Jsonrpc: Version, Method: call.Method}
+		if call.Params != nil {
+			raw, err := json.Marshal(call.Params)
+			if err != nil {
+				return err
+			}
+			msg.Params = raw
+		}
+		if !call.Notification {
+			id := NumberID(atomic.AddInt64(&c.seq, 1))
+			msg.ID = &id
+			waits[i] = c.register(id)
+			defer c.unregister(id)
+		}
+		msgs[i] = msg
+	}
+
+	var (
+		raw []byte
+		err error
+	)
+	if batch {
+		raw, err = json.Marshal(msgs)
+	} else {
+		raw, err = json.Marshal(msgs[0])
+	}
+	if err != nil {
+		return err
+	}
+	if cw, ok := c.transport.(ContextWriter); ok {
+		cw.WriteContext(ctx, raw)
+	} else {
+		c.transport.Write(raw)
+	}
+
+	for i, out := range waits {
+		select {
+		case <-c.ctx.Done():
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		case resp := <-out:
+			calls[i].Error = resp.decode(calls[i].Result)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) register(id ID) chan *message {
+	out := make(chan *message, 1)
+	c.lock.Lock()
+	c.pending[id.String()] = out
+	c.lock.Unlock()
+	return out
+}
+
+func (c *Conn) unregister(id ID) {
+	c.lock.Lock()
+	delete(c.pending, id.String())
+	c.lock.Unlock()
+}
+
+func (m *message) decode(result interface{}) error {
+	if m.Error != nil {
+		return m.Error
+	}
+	if result == nil || len(m.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Result, result)
+}
+
+func (c *Conn) loop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case data, ok := <-c.transport.Read():
+			if !ok {
+				c.cancel()
+				return
+			}
+			c.receive(data)
+		}
+	}
+}
+
+func (c *Conn) receive(data []byte) {
+	msgs, batch, err := decode(data)
+	if err != nil {
+		c.write(&errorResponse{Jsonrpc: Version, Error: NewError(ParseErrorCode, err.Error())})
+		return
+	}
+	if batch && len(msgs) == 0 {
+		c.write(&errorResponse{Jsonrpc: Version, Error: NewError(InvalidRequestCode, `empty batch`)})
+		return
+	}
+
+	requests := make([]*message, 0, len(msgs))
+	answers := make([]interface{}, 0)
+	for _, msg := range msgs {
+		switch {
+		case msg == nil || !msg.isRequest() && !msg.isResponse():
+			answers = append(answers, invalidRequest(msg))
+		case msg.isRequest() && msg.ID == nil:
+			c.enqueue(msg)
+		case msg.isRequest():
+			requests = append(requests, msg)
+		default:
+			c.deliver(msg)
+		}
+	}
+	if len(requests) == 0 {
+		c.answer(answers, batch)
+		return
+	}
+
+	// handlers may call the other side, so they never run in the read loop
+	go func() {
+		for _, req := range requests {
+			answers = append(answers, c.serve(req))
+		}
+		c.answer(answers, batch)
+	}()
+}
+
+// invalidRequest is the answer to a message which is neither a request nor a response.
+func invalidRequest(msg *message) *errorResponse {
+	answer := &errorResponse{Jsonrpc: Version, Error: NewError(InvalidRequestCode, `neither a request nor a response`)}
+	if msg != nil {
+		answer.ID = msg.ID
+	}
+	return answer
+}
+
+// answer writes answers of one message, a batch is answered by an array.
+func (c *Conn) answer(answers []interface{}, batch bool) {
+	if len(answers) == 0 {
+		return
+	}
+	if batch {
+		c.write(answers)
+	} else {
+		c.write(answers[0])
+	}
+}
+
+// enqueue passes the notification to notifyLoop.
+func (c *Conn) enqueue(msg *message) {
+	c.lock.Lock()
+	c.notifications = append(c.notifications, msg)
+	c.lock.Unlock()
+	select {
+	case c.notified <- struct{}{}:
+	default:
+	}
+}
+
+// notifyLoop serves notifications in order of arrival. It is not the read loop,
+// so notification handlers may call the other side too.
+func (c *Conn) notifyLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.notified:
+		}
+		for {
+			c.lock.Lock()
+			if len(c.notifications) == 0 {
+				c.lock.Unlock()
+				break
+			}
+			msg := c.notifications[0]
+			c.notifications[0] = nil
+			c.notifications = c.notifications[1:]
+			c.lock.Unlock()
+			c.serve(msg)
+		}
+	}
+}
+
+// deliver passes the answer to the waiting call.
+func (c *Conn) deliver(msg *message) {
+	if msg.ID == nil {
+		c.log.Warn(`answer without id`, slog.Any(logging.Error, msg.Error))
+		return
+	}
+	c.lock.Lock()
+	out, ok := c.pending[msg.ID.String()]
+	c.lock.Unlock()
+	if !ok {
+		c.log.Warn(`not found call for answer`, logging.RequestID, msg.ID.String())
+		return
+	}
+	select {
+	case out <- msg:
+	default:
+	}
+}
+
+// serve runs handler for the request, answer is nil for notifications.
+func (c *Conn) serve(msg *message) *message {
+	req := &Request{ID: msg.ID, Method: msg.Method, Params: msg.Params}
+	result, err := c.handler.ServeRPC(c.ctx, req)
+	if req.IsNotification() {
+		if err != nil {
+			c.log.Warn(`notification failed`, logging.Method, req.Method, logging.Err(err))
+		}
+		return nil
+	}
+
+	answer := &message{Jsonrpc: Version, ID: msg.ID}
+	if err != nil {
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = NewError(InternalErrorCode, err.Error())
+		}
+		answer.Error = rpcErr
+		return answer
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		answer.Error = NewError(InternalErrorCode, err.Error())
+		return answer
+	}
+	answer.Result = raw
+	return answer
+}
+
+func (c *Conn) write(v interface{}) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		c.log.Error(`can't marshal answer`, logging.Err(err))
+		return
+	}
+	c.transport.Write(raw)
+}
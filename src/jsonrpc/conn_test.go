@@ -0,0 +1,315 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	kurentows "kurento/websocket"
+
+	"github.com/gorilla/websocket"
+)
+
+// pipe is the transport of one end of an in-memory connection.
+type pipe struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newPipe() (*pipe, *pipe) {
+	a, b := make(chan []byte, 100), make(chan []byte, 100)
+	return &pipe{in: a, out: b}, &pipe{in: b, out: a}
+}
+
+func (p *pipe) Read() <-chan []byte { return p.in }
+func (p *pipe) Write(msg []byte)    { p.out <- msg }
+
+// next returns the next message written to the other end.
+func (p *pipe) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case msg := <-p.in:
+		return string(msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no message`)
+		return ""
+	}
+}
+
+func sumHandler(ctx context.Context, req *Request) (interface{}, error) {
+	var args []int
+	if err := req.UnmarshalParams(&args); err != nil {
+		return nil, err
+	}
+	sum := 0
+	for _, a := range args {
+		sum += a
+	}
+	return sum, nil
+}
+
+func testMux() *Mux {
+	mux := NewMux()
+	mux.HandleFunc(`sum`, sumHandler)
+	mux.HandleFunc(`fail`, func(ctx context.Context, req *Request) (interface{}, error) {
+		return nil, errors.New(`failed`)
+	})
+	return mux
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	end, peer := newPipe()
+	NewConn(ctx, end, testMux(), nil)
+
+	for _, tc := range []struct {
+		name, in, out string
+	}{
+		{`number id`, `{"jsonrpc":"2.0","id":7,"method":"sum","params":[1,2]}`,
+			`{"jsonrpc":"2.0","id":7,"result":3}`},
+		{`string id`, `{"jsonrpc":"2.0","id":"a-7","method":"sum","params":[3,4]}`,
+			`{"jsonrpc":"2.0","id":"a-7","result":7}`},
+		{`unknown method`, `{"jsonrpc":"2.0","id":1,"method":"mul","params":[1]}`,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"method not found: mul"}}`},
+		{`invalid params`, `{"jsonrpc":"2.0","id":2,"method":"sum"}`,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32602,"message":"params are required"}}`},
+		{`internal error`, `{"jsonrpc":"2.0","id":3,"method":"fail"}`,
+			`{"jsonrpc":"2.0","id":3,"error":{"code":-32603,"message":"failed"}}`},
+		{`parse error`, `{"jsonrpc":`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"unexpected end of JSON input"}}`},
+		{`neither request nor response`, `{"jsonrpc":"2.0","id":4}`,
+			`{"jsonrpc":"2.0","id":4,"error":{"code":-32600,"message":"neither a request nor a response"}}`},
+		{`empty batch`, `[]`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty batch"}}`},
+		{`batch`, `[{"jsonrpc":"2.0","id":1,"method":"sum","params":[1]},` +
+			`{"jsonrpc":"2.0","method":"sum","params":[2]},` +
+			`{"jsonrpc":"2.0"},` +
+			`{"jsonrpc":"2.0","id":"b","method":"sum","params":[2,2]}]`,
+			`[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"neither a request nor a response"}},` +
+				`{"jsonrpc":"2.0","id":1,"result":1},{"jsonrpc":"2.0","id":"b","result":4}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			peer.Write([]byte(tc.in))
+			if out := peer.next(t); out != tc.out {
+				t.Errorf("answer is %s\nwant %s", out, tc.out)
+			}
+		})
+	}
+
+	// notifications have no answer, the next message is the answer of the request
+	peer.Write([]byte(`{"jsonrpc":"2.0","method":"sum","params":[1]}`))
+	peer.Write([]byte(`{"jsonrpc":"2.0","id":5,"method":"sum","params":[5]}`))
+	if out := peer.next(t); out != `{"jsonrpc":"2.0","id":5,"result":5}` {
+		t.Errorf(`answer is %s`, out)
+	}
+}
+
+func TestCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	end, peer := newPipe()
+	conn := NewConn(ctx, end, nil, nil)
+
+	// the peer answers requests by hand, ids are matched whatever their order is
+	go func() {
+		for data := range peer.in {
+			msgs, batch, err := decode(data)
+			if err != nil {
+				return
+			}
+			answers := []interface{}{}
+			for i := len(msgs) - 1; i >= 0; i-- {
+				msg := msgs[i]
+				switch {
+				case msg.ID == nil:
+				case msg.Method == `echo`:
+					answers = append(answers, &message{Jsonrpc: Version, ID: msg.ID, Result: msg.Params})
+				default:
+					answers = append(answers, &message{Jsonrpc: Version, ID: msg.ID, Error: NewError(MethodNotFoundCode, msg.Method)})
+				}
+			}
+			if !batch && len(answers) > 0 {
+				raw, _ := json.Marshal(answers[0])
+				peer.Write(raw)
+			} else if batch {
+				raw, _ := json.Marshal(answers)
+				peer.Write(raw)
+			}
+		}
+	}()
+
+	var s string
+	if err := conn.Call(ctx, `echo`, `hi`, &s); err != nil || s != `hi` {
+		t.Errorf(`echo: %q, %v`, s, err)
+	}
+	err := conn.Call(ctx, `mul`, nil, nil)
+	if rpcErr, ok := err.(*Error); !ok || rpcErr.Code != MethodNotFoundCode {
+		t.Errorf(`mul: %v`, err)
+	}
+	if err = conn.Notify(`echo`, 1); err != nil {
+		t.Error(err)
+	}
+
+	var a, b []int
+	calls := []*Call{
+		{Method: `echo`, Params: []int{1}, Result: &a},
+		{Method: `log`, Params: `x`, Notification: true},
+		{Method: `mul`, Params: []int{2}},
+		{Method: `echo`, Params: []int{2, 3}, Result: &b},
+	}
+	if err = conn.Batch(ctx, calls...); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, []int{1}) || !reflect.DeepEqual(b, []int{2, 3}) {
+		t.Errorf(`batch results: %v %v`, a, b)
+	}
+	if calls[0].Error != nil || calls[1].Error != nil || calls[3].Error != nil {
+		t.Errorf(`batch errors: %v %v %v`, calls[0].Error, calls[1].Error, calls[3].Error)
+	}
+	if rpcErr, ok := calls[2].Error.(*Error); !ok || rpcErr.Code != MethodNotFoundCode {
+		t.Errorf(`batch mul: %v`, calls[2].Error)
+	}
+
+	conn.Close()
+	if err = conn.Call(ctx, `echo`, 1, nil); err != ErrClosed {
+		t.Errorf(`call of closed connection: %v`, err)
+	}
+}
+
+func TestNotificationOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	end, peer := newPipe()
+
+	const count = 50
+	got := make(chan int, count)
+	mux := NewMux()
+	mux.HandleFunc(`onEvent`, func(ctx context.Context, req *Request) (interface{}, error) {
+		var n int
+		if err := req.UnmarshalParams(&n); err != nil {
+			return nil, err
+		}
+		// earlier events are slower, they would be overtaken if handlers ran concurrently
+		time.Sleep(time.Duration(count-n) * 100 * time.Microsecond)
+		got <- n
+		return nil, nil
+	})
+	NewConn(ctx, end, mux, nil)
+
+	for i := 0; i < count; i++ {
+		raw, _ := json.Marshal(&message{Jsonrpc: Version, Method: `onEvent`, Params: json.RawMessage(strconv.Itoa(i))})
+		peer.Write(raw)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case n := <-got:
+			if n != i {
+				t.Fatalf(`notification %d is served as %d`, n, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf(`%d notifications are served`, i)
+		}
+	}
+}
+
+// TestServer connects a client Conn to the Server over websockets, both sides call each other.
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mux := testMux()
+	// sumBack asks the client to sum, the client is called while its own request is served
+	mux.HandleFunc(`sumBack`, func(ctx context.Context, req *Request) (interface{}, error) {
+		conn, ok := FromContext(ctx)
+		if !ok {
+			return nil, errors.New(`no connection in context`)
+		}
+		var sum int
+		err := conn.Call(ctx, `clientSum`, req.Params, &sum)
+		return sum, err
+	})
+	greeted := make(chan string, 1)
+	accepted := make(chan *Conn, 1)
+	server := &Server{
+		Handler: mux,
+		OnConnect: func(c *Conn) {
+			accepted <- c
+			var name string
+			if err := c.Call(ctx, `hello`, nil, &name); err != nil {
+				name = err.Error()
+			}
+			greeted <- name
+		},
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	dial := func() (kurentows.WebSocketer, *http.Response, error) {
+		ws, resp, err := websocket.DefaultDialer.Dial(`ws`+strings.TrimPrefix(httpServer.URL, `http`), nil)
+		return ws, resp, err
+	}
+	listener, err := kurentows.NewWsListener(ctx, kurentows.NewReconn(nil, dial), kurentows.Timeouts{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// the status channel must be read
+		for {
+			select {
+			case <-listener.Status():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	clientMux := NewMux()
+	clientMux.HandleFunc(`hello`, func(ctx context.Context, req *Request) (interface{}, error) {
+		return `client`, nil
+	})
+	clientMux.HandleFunc(`clientSum`, sumHandler)
+	client := NewConn(ctx, listener, clientMux, nil)
+
+	select {
+	case name := <-greeted:
+		if name != `client` {
+			t.Errorf(`server is greeted by %s`, name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`server didn't call the client`)
+	}
+
+	callCtx, callCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer callCancel()
+	var sum int
+	if err = client.Call(callCtx, `sum`, []int{1, 2, 3}, &sum); err != nil || sum != 6 {
+		t.Errorf(`sum: %d, %v`, sum, err)
+	}
+	if err = client.Call(callCtx, `sumBack`, []int{4, 5}, &sum); err != nil || sum != 9 {
+		t.Errorf(`sumBack: %d, %v`, sum, err)
+	}
+	var x, y int
+	calls := []*Call{{Method: `sum`, Params: []int{1}, Result: &x}, {Method: `sumBack`, Params: []int{2}, Result: &y}}
+	if err = client.Batch(callCtx, calls...); err != nil || x != 1 || y != 2 || calls[0].Error != nil || calls[1].Error != nil {
+		t.Errorf(`batch: %d %d, %v %v %v`, x, y, err, calls[0].Error, calls[1].Error)
+	}
+
+	// the server closes the connection when the client is gone
+	client.Close()
+	if err = listener.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-(<-accepted).Done():
+	case <-time.After(5 * time.Second):
+		t.Error(`server connection is not closed`)
+	}
+}
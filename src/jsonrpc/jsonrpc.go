@@ -0,0 +1,151 @@
+// Package jsonrpc is a JSON-RPC 2.0 peer over a message transport (e.g. kurento/websocket listener).
+// One Conn is a client and a server at the same time: it sends requests, notifications and batches
+// to the other side and serves requests coming from it. Server accepts such peers over websockets.
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const Version = `2.0`
+
+// Error codes defined by the specification.
+const (
+	ParseErrorCode     = -32700
+	InvalidRequestCode = -32600
+	MethodNotFoundCode = -32601
+	InvalidParamsCode  = -32602
+	InternalErrorCode  = -32603
+)
+
+var ErrClosed = errors.New(`jsonrpc: connection is closed`)
+
+// ID of a request, a string or a number.
+type ID struct {
+	Num   int64
+	Str   string
+	IsStr bool
+}
+
+func NumberID(n int64) ID {
+	return ID{Num: n}
+}
+
+func StringID(s string) ID {
+	return ID{Str: s, IsStr: true}
+}
+
+func (id ID) String() string {
+	if id.IsStr {
+		return strconv.Quote(id.Str)
+	}
+	return strconv.FormatInt(id.Num, 10)
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if id.IsStr {
+		return json.Marshal(id.Str)
+	}
+	return []byte(strconv.FormatInt(id.Num, 10)), nil
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		id.IsStr = true
+		id.Num = 0
+		return json.Unmarshal(data, &id.Str)
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf(`jsonrpc: id must be a string or an integer: %s`, data)
+	}
+	id.Num, id.Str, id.IsStr = n, "", false
+	return nil
+}
+
+// Error object of a response. It is also returned by calls as an error.
+type Error struct {
+	Code    int              `json:"code"`
+	Message string           `json:"message"`
+	Data    *json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Data == nil {
+		return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("[%d] %s : %s", e.Code, e.Message, *e.Data)
+}
+
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Request coming from the other side. ID is nil for notifications.
+type Request struct {
+	ID     *ID
+	Method string
+	Params json.RawMessage
+}
+
+func (r *Request) IsNotification() bool {
+	return r.ID == nil
+}
+
+// UnmarshalParams decodes params, decode errors are reported as invalid params.
+func (r *Request) UnmarshalParams(v interface{}) error {
+	if len(r.Params) == 0 {
+		return NewError(InvalidParamsCode, `params are required`)
+	}
+	if err := json.Unmarshal(r.Params, v); err != nil {
+		return NewError(InvalidParamsCode, err.Error())
+	}
+	return nil
+}
+
+// message is a wire form of any JSON-RPC object.
+type message struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	ID      *ID             `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (m *message) isRequest() bool {
+	return m.Method != ""
+}
+
+func (m *message) isResponse() bool {
+	return len(m.Result) != 0 || m.Error != nil
+}
+
+// errorResponse is sent when the request can't be parsed, id must be null there.
+type errorResponse struct {
+	Jsonrpc string `json:"jsonrpc"`
+	ID      *ID    `json:"id"`
+	Error   *Error `json:"error"`
+}
+
+// decode parses a single message or a batch.
+func decode(data []byte) ([]*message, bool, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []*message
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, true, err
+		}
+		return batch, true, nil
+	}
+	msg := &message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, false, err
+	}
+	return []*message{msg}, false, nil
+}
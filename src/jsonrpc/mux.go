@@ -0,0 +1,48 @@
+package jsonrpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Handler serves requests and notifications from the other side.
+// Result of a notification is dropped.
+type Handler interface {
+	ServeRPC(ctx context.Context, req *Request) (interface{}, error)
+}
+
+type HandlerFunc func(ctx context.Context, req *Request) (interface{}, error)
+
+func (f HandlerFunc) ServeRPC(ctx context.Context, req *Request) (interface{}, error) {
+	return f(ctx, req)
+}
+
+// Mux routes requests to handlers by method name.
+type Mux struct {
+	lock     sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]Handler, 0)}
+}
+
+func (m *Mux) Handle(method string, h Handler) {
+	m.lock.Lock()
+	m.handlers[method] = h
+	m.lock.Unlock()
+}
+
+func (m *Mux) HandleFunc(method string, f func(ctx context.Context, req *Request) (interface{}, error)) {
+	m.Handle(method, HandlerFunc(f))
+}
+
+func (m *Mux) ServeRPC(ctx context.Context, req *Request) (interface{}, error) {
+	m.lock.RLock()
+	h, ok := m.handlers[req.Method]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, NewError(MethodNotFoundCode, `method not found: `+req.Method)
+	}
+	return h.ServeRPC(ctx, req)
+}
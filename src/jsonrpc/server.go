@@ -0,0 +1,64 @@
+package jsonrpc
+
+import (
+	"context"
+	"log/slog"
+	"logging"
+	"net/http"
+
+	kurentows "kurento/websocket"
+
+	"github.com/gorilla/websocket"
+)
+
+// Server accepts JSON-RPC connections over websockets, every connection works over
+// its own kurento/websocket listener. Requests of all connections are served by Handler,
+// handlers get the connection of the request by FromContext.
+type Server struct {
+	Handler  Handler
+	Upgrader websocket.Upgrader
+	// Timeouts: write, pong and ping timing of websockets, zero ones are defaults of the listener.
+	Timeouts kurentows.Timeouts
+	// Logger: nil means slog.Default().
+	Logger *slog.Logger
+	// OnConnect (if set) is called in its own goroutine for every accepted connection,
+	// e.g. to call or notify the client.
+	OnConnect func(c *Conn)
+}
+
+// ServeHTTP upgrades the request and serves the connection until the client is gone.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logging.OrDefault(s.Logger).With(logging.Component, `jsonrpc`)
+	ws, err := s.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug(`websocket upgrade failed`, logging.Err(err))
+		return
+	}
+
+	// an accepted connection can't be dialed again, so the listener has no dialer
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	listener, err := kurentows.NewWsListener(ctx, kurentows.NewReconn(ws, nil), s.Timeouts, s.Logger)
+	if err != nil {
+		log.Warn(`can't listen websocket`, logging.Err(err))
+		ws.Close()
+		return
+	}
+	conn := NewConn(ctx, listener, s.Handler, s.Logger)
+	if s.OnConnect != nil {
+		go s.OnConnect(conn)
+	}
+
+	for done := false; !done; {
+		select {
+		case online := <-listener.Status():
+			done = !online
+		case <-conn.Done():
+			done = true
+		}
+	}
+	conn.Close()
+	if err = listener.Close(); err != nil {
+		log.Debug(`websocket is closed by the client`, logging.Err(err))
+	}
+}
@@ -0,0 +1,167 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"logging"
+)
+
+const (
+	// TakePresenterWsCmd: the user becomes the presenter of the broadcast room.
+	TakePresenterWsCmd WsCmd = `takePresenter`
+	// HandOverPresenterWsCmd: the presenter gives the role to the user of the request.
+	HandOverPresenterWsCmd WsCmd = `handOverPresenter`
+	PresenterChangedWsCmd  WsCmd = `presenterChanged`
+)
+
+// PresenterChangedForm tells participants the new presenter, Name is empty when the presenter has left.
+// The new presenter publishes its In, viewers keep their PresenterSender streams.
+type PresenterChangedForm struct {
+	Cmd  WsCmd  `json:"cmd"`
+	Name string `json:"name"`
+}
+
+func (s *service) takePresenter(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.broadcastRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	return s.setPresenter(ctx, currentRoom, currentUser)
+}
+
+func (s *service) handOverPresenter(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.broadcastRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+
+	currentRoom.lock.RLock()
+	presenter := currentRoom.Presenter
+	user, ok := currentRoom.Users[req.User]
+	currentRoom.lock.RUnlock()
+	if presenter != currentUser.name {
+		return fmt.Errorf(`user %s is not the presenter of room %s`, s.redact.User(currentUser.name), currentUser.roomName)
+	}
+	if !ok {
+		return fmt.Errorf(`can't find user %s in room %s`, s.redact.User(req.User), currentUser.roomName)
+	}
+	return s.setPresenter(ctx, currentRoom, user)
+}
+
+// broadcastRoom returns the room of the user when it is a broadcast room.
+func (s *service) broadcastRoom(currentUser *User, cmd WsCmd) (*Room, error) {
+	currentRoom, err := s.userRoom(currentUser, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if currentRoom.Mode != BroadcastRoomMode {
+		return nil, fmt.Errorf(`room %s is %s, not %s`, currentUser.roomName, currentRoom.Mode, BroadcastRoomMode)
+	}
+	return currentRoom, nil
+}
+
+// setPresenter gives the role to the user. The stream of the previous presenter is sent to viewers
+// until the new one publishes its In, so viewers don't see a gap.
+func (s *service) setPresenter(ctx context.Context, room *Room, user *User) error {
+	room.lock.Lock()
+	room.Presenter = user.name
+	room.lock.Unlock()
+
+	s.userLog(user).Info(`presenter changed`)
+	s.broadcast(room, &PresenterChangedForm{
+		Cmd:  PresenterChangedWsCmd,
+		Name: user.name,
+	})
+
+	if user.IsEmptyIn() {
+		return nil
+	}
+	return s.present(ctx, room, user)
+}
+
+// present makes In of the presenter the source of the dispatcher, In of the previous source is released.
+func (s *service) present(ctx context.Context, room *Room, user *User) error {
+	port, err := s.hubPort(ctx, room, user)
+	if err != nil {
+		return err
+	}
+	in, ok := user.stream(DefaultStream)
+	if !ok {
+		return fmt.Errorf(`stream %s of user %s is not published`, DefaultStream, s.redact.User(user.name))
+	}
+	if err = connect(ctx, room.session, in, port); err != nil {
+		return err
+	}
+	if err = s.keepMuted(ctx, room, user, DefaultStream, port); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(map[string]string{"source": port.ID})
+	if err != nil {
+		return err
+	}
+	payload := &json.RawMessage{}
+	_ = payload.UnmarshalJSON(raw)
+	// viewers are connected to the dispatcher, they get the new source without renegotiation
+	err = room.session.Invoke(ctx, room.Hub, SetSourceInvokeOperation, payload)
+	if err != nil {
+		return err
+	}
+
+	room.lock.Lock()
+	previous, ok := room.Users[room.source]
+	room.source = user.name
+	var recorders []*MediaObject
+	if ok && previous != user {
+		recorders = detachRecorders(room, previous, "")
+	}
+	room.lock.Unlock()
+	if !ok || previous == user {
+		return nil
+	}
+	// the file of the previous presenter is finished before its In is released
+	s.stopRecorders(ctx, room, previous, recorders)
+
+	// the previous presenter becomes a viewer
+	previous.lock.Lock()
+	streams := previous.In
+	previous.In = make(map[string]*MediaObject, 0)
+	previous.lock.Unlock()
+	for _, in := range streams {
+		err = room.session.Release(ctx, in)
+		if err != nil {
+			s.userLog(previous).Warn(`can't release object`, logging.KMSObject, in.ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+// sendRoomState gives the state of the broadcast room to the joined user, viewers
+// don't publish, so they don't get it from receiveVideoFrom.
+func (s *service) sendRoomState(room *Room, user *User) error {
+	users := []string{}
+	streams := map[string][]string{}
+	names := map[string]string{}
+	for _, u := range room.ListUsers() {
+		if !u.IsEmptyIn() {
+			users = append(users, u.name)
+			streams[u.name] = u.streams()
+		}
+		if u.DisplayName != "" {
+			names[u.name] = u.DisplayName
+		}
+	}
+	room.lock.RLock()
+	presenter := room.Presenter
+	room.lock.RUnlock()
+
+	return s.send(user, &ExistingParticipantsForm{
+		Cmd:       ExistingParticipantsWsCmd,
+		Data:      users,
+		Mode:      room.Mode,
+		Presenter: presenter,
+		Streams:   streams,
+		Names:     names,
+	})
+}
@@ -0,0 +1,170 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jsonrpc"
+	"logging"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"tracing"
+)
+
+// CallTimeoutError is returned when a call is not answered within its deadline.
+type CallTimeoutError struct {
+	Call    string
+	Timeout time.Duration
+}
+
+func (e *CallTimeoutError) Error() string {
+	return fmt.Sprintf(`kurento call %s was not answered in %s`, e.Call, e.Timeout)
+}
+
+// CallStats are counters of one call name.
+type CallStats struct {
+	Calls    uint64 `json:"calls"`
+	Errors   uint64 `json:"errors"`
+	Timeouts uint64 `json:"timeouts"`
+	Retries  uint64 `json:"retries"`
+}
+
+type callStats struct {
+	lock  sync.RWMutex
+	calls map[string]*CallStats
+}
+
+func (s *callStats) get(name string) *CallStats {
+	s.lock.RLock()
+	stats, ok := s.calls[name]
+	s.lock.RUnlock()
+	if ok {
+		return stats
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stats, ok = s.calls[name]; !ok {
+		stats = &CallStats{}
+		s.calls[name] = stats
+	}
+	return stats
+}
+
+func (s *callStats) snapshot() map[string]CallStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	out := make(map[string]CallStats, len(s.calls))
+	for name, stats := range s.calls {
+		out[name] = CallStats{
+			Calls:    atomic.LoadUint64(&stats.Calls),
+			Errors:   atomic.LoadUint64(&stats.Errors),
+			Timeouts: atomic.LoadUint64(&stats.Timeouts),
+			Retries:  atomic.LoadUint64(&stats.Retries),
+		}
+	}
+	return out
+}
+
+// callName is a name of the call for timeouts, retries and stats: method or invoke.<operation>.
+func callName(method string, operation InvokeOperation) string {
+	if operation == "" {
+		return method
+	}
+	return method + `.` + string(operation)
+}
+
+// call sends request and waits for its result. Every attempt is limited by the deadline of the call,
+// idempotent calls are repeated on transient errors.
+func (k *kurentoClient) call(ctx context.Context, method string, operation InvokeOperation, params interface{}) (result json.RawMessage, err error) {
+	name := callName(method, operation)
+	ctx, span := tracing.Start(ctx, `kms.`+name)
+	defer func() {
+		if err != nil {
+			span.SetError(errors.New(k.config.Redact.Error(err)))
+		}
+		span.End()
+	}()
+	stats := k.stats.get(name)
+	attempts := k.config.attempts(name)
+
+	var backoff time.Duration
+	if k.config.Retry != nil {
+		backoff = k.config.Retry.Backoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		span.SetAttr(`attempts`, strconv.Itoa(attempt))
+		k.log.Debug(`started call`, logging.Method, name, `attempt`, attempt, `params`, k.config.Redact.JSON(params))
+		started := time.Now()
+		result, err := k.attempt(ctx, name, method, params)
+		k.m.duration.Observe(time.Since(started).Seconds(), name)
+		atomic.AddUint64(&stats.Calls, 1)
+		if err == nil {
+			k.m.requests.Inc(name, `ok`)
+			k.log.Debug(`ended call`, logging.Method, name, `result`, k.config.Redact.Text(string(result)))
+			return result, nil
+		}
+
+		atomic.AddUint64(&stats.Errors, 1)
+		if _, ok := err.(*CallTimeoutError); ok {
+			atomic.AddUint64(&stats.Timeouts, 1)
+			k.m.requests.Inc(name, `timeout`)
+		} else {
+			k.m.requests.Inc(name, `error`)
+		}
+		k.log.Warn(`call failed`, logging.Method, name, `attempt`, attempt, logging.Error, k.config.Redact.Error(err))
+		if attempt >= attempts || !k.transient(err) {
+			return nil, err
+		}
+
+		atomic.AddUint64(&stats.Retries, 1)
+		k.m.retries.Inc(name)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (k *kurentoClient) attempt(ctx context.Context, name, method string, params interface{}) (json.RawMessage, error) {
+	timeout := k.config.timeout(name)
+	callCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var result json.RawMessage
+	err := k.rpc.Call(callCtx, method, params, &result)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		// deadline of the call, not of the caller
+		return nil, &CallTimeoutError{Call: name, Timeout: timeout}
+	}
+	return result, err
+}
+
+// transient tells if the error may go away on the next attempt.
+func (k *kurentoClient) transient(err error) bool {
+	switch e := err.(type) {
+	case *CallTimeoutError:
+		return true
+	case *jsonrpc.Error:
+		for _, code := range k.config.Retry.Codes {
+			if e.Code == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (k *kurentoClient) Stats() map[string]CallStats {
+	return k.stats.snapshot()
+}
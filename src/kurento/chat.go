@@ -0,0 +1,45 @@
+package kurento
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// SendMessageWsCmd sends Text to the chat of the room.
+	SendMessageWsCmd WsCmd = `sendMessage`
+	ChatMessageWsCmd WsCmd = `chatMessage`
+)
+
+// maxChatMessage limits Text of messages in bytes.
+const maxChatMessage = 2048
+
+// ChatMessageForm is the message of Name sent to everyone in the room.
+type ChatMessageForm struct {
+	Cmd  WsCmd     `json:"cmd"`
+	Name string    `json:"name"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+func (s *service) sendMessage(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	if req.Text == "" {
+		return errors.New(`text of the message is empty`)
+	}
+	if len(req.Text) > maxChatMessage {
+		return fmt.Errorf(`message is longer than %d bytes`, maxChatMessage)
+	}
+	s.broadcast(currentRoom, &ChatMessageForm{
+		Cmd:  ChatMessageWsCmd,
+		Name: currentUser.name,
+		Text: req.Text,
+		Time: time.Now().UTC(),
+	})
+	return nil
+}
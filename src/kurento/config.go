@@ -0,0 +1,179 @@
+package kurento
+
+import (
+	"health"
+	kurentows "kurento/websocket"
+	"log/slog"
+	"metrics"
+	"redact"
+	"time"
+	"tracing"
+)
+
+// ServiceConfig configures the room service.
+type ServiceConfig struct {
+	Client *ClientConfig
+	// Redact: privacy mode of logs and errors, it is shared with the client when the client has none.
+	Redact *redact.Redactor
+	// Logger: logger of the service, it is shared with the client when the client has none.
+	Logger *slog.Logger
+	// Metrics: registry of the service metrics, it is shared with the client when the client has none.
+	Metrics *metrics.Registry
+	// Tracer: root spans of websocket commands, KMS calls are traced as their children. Nil disables tracing.
+	Tracer *tracing.Tracer
+	// Health: readiness checks of media servers are registered there when it is set.
+	Health *health.Checker
+	// WebSocket: settings of client websockets, nil means DefaultWebSocketConfig().
+	WebSocket *WebSocketConfig
+	Runtime   RuntimeConfig
+}
+
+// RuntimeConfig is settings of the service which may be changed without restart by Service.Reload.
+type RuntimeConfig struct {
+	Limits Limits
+	// ICEServers are sent to clients for their peer connections.
+	ICEServers []ICEServer
+	// RecordingURI: file:// template of recordings with {room}, {user} and {timestamp},
+	// empty means DefaultRecordingURI. New recorders use the current one.
+	RecordingURI string
+	// PlayerURIs: prefixes of URIs allowed to players, see allowedPlayerURI. Empty disables players.
+	PlayerURIs []string
+	// TokenSecret: HMAC secret of join tokens, joinRoom requires a token when it is set.
+	TokenSecret string
+	// TokenTTL: lifetime of tokens minted by ServeToken.
+	TokenTTL time.Duration
+	// Policy: capabilities of users by roles when their join tokens have none, nil means DefaultPolicy().
+	Policy map[Role][]string
+}
+
+// ICEServer is RTCIceServer of browsers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// WebSocketConfig configures websockets of clients.
+type WebSocketConfig struct {
+	// WriteWait: time allowed to write a message to the peer.
+	WriteWait time.Duration
+	// PongWait: time allowed to read the next pong message from the peer.
+	PongWait time.Duration
+	// MaxMessageSize: max size of a message from the peer.
+	// (If you want send many tracks in one stream SDP may be very big)
+	MaxMessageSize int64
+	// PingPeriod: pings are sent with this period, zero means 9/10 of PongWait.
+	PingPeriod time.Duration
+}
+
+func DefaultWebSocketConfig() *WebSocketConfig {
+	return &WebSocketConfig{
+		WriteWait:      10 * time.Second,
+		PongWait:       40 * time.Second,
+		MaxMessageSize: 8 * 1024,
+	}
+}
+
+// pingPeriod: pings are sent with this period. Must be less than PongWait.
+func (c WebSocketConfig) pingPeriod() time.Duration {
+	if c.PingPeriod > 0 {
+		return c.PingPeriod
+	}
+	return (c.PongWait * 9) / 10
+}
+
+// Limits of rooms, zero means no limit.
+type Limits struct {
+	MaxRooms int
+	// MaxParticipants: participants of a room.
+	MaxParticipants int
+}
+
+// ClientConfig configures connection to the media server.
+type ClientConfig struct {
+	// Addr: WS endpoint of the media server.
+	Addr string
+	// Timeout: default deadline of every call, zero means the caller's ctx only.
+	Timeout time.Duration
+	// Timeouts: deadlines per call name (see callName), e.g. `create` or `invoke.processOffer`.
+	Timeouts map[string]time.Duration
+	// Retry: policy of retries for idempotent calls, nil disables retries.
+	Retry *RetryPolicy
+	// Redact: privacy mode of logs, nil logs everything as is.
+	Redact *redact.Redactor
+	// Logger: nil means slog.Default().
+	Logger *slog.Logger
+	// Metrics: registry of the client metrics, nil disables them.
+	Metrics *metrics.Registry
+	// PingInterval: period of pings keeping the session on the media server.
+	PingInterval time.Duration
+	// WebSocket: timing of the websocket to the media server, nil means the one of DefaultClientConfig().
+	// MaxMessageSize is not limited there.
+	WebSocket *WebSocketConfig
+}
+
+// DefaultAddr is WS endpoint of a local media server.
+const DefaultAddr = `ws://localhost:8888/kurento`
+
+// RetryPolicy repeats idempotent calls failed by a transient error.
+// Transient errors are call timeouts and errors of KMS with one of Codes.
+type RetryPolicy struct {
+	// Attempts: max number of attempts including the first one.
+	Attempts int
+	// Backoff: pause before the second attempt, it is doubled for every next one.
+	Backoff time.Duration
+	// Calls: names of idempotent calls which may be repeated.
+	Calls []string
+	// Codes: error codes of KMS treated as transient.
+	Codes []int
+}
+
+func DefaultClientConfig() *ClientConfig {
+	return &ClientConfig{
+		Addr:         DefaultAddr,
+		Timeout:      10 * time.Second,
+		PingInterval: 40 * time.Second,
+		Timeouts: map[string]time.Duration{
+			`connect`:                 5 * time.Second,
+			`create`:                  5 * time.Second,
+			`release`:                 5 * time.Second,
+			`subscribe`:               5 * time.Second,
+			`unsubscribe`:             5 * time.Second,
+			`invoke.connect`:          5 * time.Second,
+			`invoke.addIceCandidate`:  5 * time.Second,
+			`invoke.gatherCandidates`: 5 * time.Second,
+		},
+		Retry: &RetryPolicy{
+			Attempts: 3,
+			Backoff:  200 * time.Millisecond,
+			Calls:    []string{`release`, `subscribe`, callName(`invoke`, GetStatsInvokeOperation)},
+		},
+		// the media server is near, so its loss is noticed in seconds
+		WebSocket: &WebSocketConfig{
+			WriteWait:  kurentows.WRITE_TIMEOUT,
+			PongWait:   kurentows.PONG_TIMEOUT,
+			PingPeriod: kurentows.PING_RATE,
+		},
+	}
+}
+
+// timeout returns deadline for the call.
+func (c *ClientConfig) timeout(name string) time.Duration {
+	if timeout, ok := c.Timeouts[name]; ok {
+		return timeout
+	}
+	return c.Timeout
+}
+
+// attempts returns number of attempts allowed for the call.
+func (c *ClientConfig) attempts(name string) int {
+	if c.Retry == nil || c.Retry.Attempts < 1 {
+		return 1
+	}
+	for _, call := range c.Retry.Calls {
+		if call == name {
+			return c.Retry.Attempts
+		}
+	}
+	return 1
+}
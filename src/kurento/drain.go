@@ -0,0 +1,31 @@
+package kurento
+
+import (
+	"errors"
+)
+
+// ErrDraining is returned on creation of a room on a draining instance.
+var ErrDraining = errors.New(`server is draining, new rooms are not accepted`)
+
+// DrainStatus is progress of drain, the instance may be replaced when Rooms is zero.
+type DrainStatus struct {
+	Draining     bool `json:"draining"`
+	Rooms        int  `json:"rooms"`
+	Participants int  `json:"participants"`
+}
+
+func (s *service) Drain(draining bool) {
+	s.lock.Lock()
+	s.draining = draining
+	s.lock.Unlock()
+	c := s.count()
+	s.log.Info(`drain mode changed`, `draining`, draining, `rooms`, c.rooms, `participants`, c.participants)
+}
+
+func (s *service) DrainStatus() DrainStatus {
+	s.lock.RLock()
+	draining := s.draining
+	s.lock.RUnlock()
+	c := s.count()
+	return DrainStatus{Draining: draining, Rooms: c.rooms, Participants: c.participants}
+}
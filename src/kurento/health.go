@@ -0,0 +1,71 @@
+package kurento
+
+import (
+	"context"
+	"errors"
+	"health"
+)
+
+// ServerHealth is the state of a media server connection.
+type ServerHealth struct {
+	Addr string `json:"addr"`
+	// Connected: websocket to the server is open
+	Connected bool `json:"connected"`
+	// Healthy: the server is connected and answered the last ping
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (k *kurentoClient) setPingErr(err error) {
+	k.pingLock.Lock()
+	k.pingErr = err
+	k.pingLock.Unlock()
+}
+
+func (k *kurentoClient) Health() []ServerHealth {
+	h := ServerHealth{Addr: k.config.Addr, Connected: k.ws.Stats().Connected}
+	k.pingLock.RLock()
+	pingErr := k.pingErr
+	k.pingLock.RUnlock()
+	switch {
+	case !h.Connected:
+		h.Error = `media server is disconnected`
+	case pingErr != nil:
+		h.Error = `media server does not answer ping: ` + k.config.Redact.Error(pingErr)
+	default:
+		h.Healthy = true
+	}
+	return []ServerHealth{h}
+}
+
+// registerServiceChecks makes the instance not ready while rooms can't be created:
+// the media server is disconnected (kms_connection) or does not answer ping (kms), or because of drain.
+// The client has one media server, there is no failover to others.
+func registerServiceChecks(c *health.Checker, s *service) {
+	if c == nil {
+		return
+	}
+	cli := s.cli
+	c.Register(`kms_connection`, func(context.Context) error {
+		for _, h := range cli.Health() {
+			if !h.Connected {
+				return errors.New(h.Error)
+			}
+		}
+		return nil
+	})
+	c.Register(`kms`, func(context.Context) error {
+		for _, h := range cli.Health() {
+			if !h.Healthy {
+				return errors.New(h.Error)
+			}
+		}
+		return nil
+	})
+	c.Register(`drain`, func(context.Context) error {
+		if s.DrainStatus().Draining {
+			return ErrDraining
+		}
+		return nil
+	})
+}
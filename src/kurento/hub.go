@@ -0,0 +1,125 @@
+package kurento
+
+import (
+	"context"
+	"fmt"
+)
+
+// RoomMode is the way streams of a room are delivered, it is chosen by the first joinRoom.
+type RoomMode string
+
+const (
+	// SFURoomMode: every participant receives a stream of every publisher, it is the default.
+	SFURoomMode RoomMode = `sfu`
+	// MCURoomMode: streams of publishers are mixed by a Composite hub into one grid stream,
+	// every participant receives the mix only.
+	MCURoomMode RoomMode = `mcu`
+	// BroadcastRoomMode: the presenter publishes to a DispatcherOneToMany hub, viewers receive
+	// the presenter only and don't publish.
+	BroadcastRoomMode RoomMode = `broadcast`
+)
+
+const (
+	// MixSender is the sender of the mixed stream of MCU rooms in receiveVideoFrom.
+	MixSender = `mix`
+	// PresenterSender is the sender of the presenter stream of broadcast rooms in receiveVideoFrom,
+	// it is kept when the presenter changes.
+	PresenterSender = `presenter`
+)
+
+// roomMode returns the mode of a new room requested by joinRoom.
+func roomMode(mode string) (RoomMode, error) {
+	switch RoomMode(mode) {
+	case "", SFURoomMode:
+		return SFURoomMode, nil
+	case MCURoomMode, BroadcastRoomMode:
+		return RoomMode(mode), nil
+	}
+	return "", fmt.Errorf(`unknown room mode %s`, mode)
+}
+
+// hubPort returns the port of the user in the hub of the room, it is created on the first call.
+// Concurrent calls wait for the first one, so the user gets one port.
+func (s *service) hubPort(ctx context.Context, room *Room, user *User) (*MediaObject, error) {
+	user.portLock.Lock()
+	defer user.portLock.Unlock()
+	user.lock.RLock()
+	port := user.Port
+	user.lock.RUnlock()
+	if port != nil {
+		return port, nil
+	}
+
+	port = &MediaObject{
+		Parent: room.MediaPipeline,
+		Type:   HubPort,
+		Params: map[string]interface{}{`hub`: room.Hub.ID},
+	}
+	if err := room.session.Create(ctx, port); err != nil {
+		return nil, err
+	}
+	user.lock.Lock()
+	user.Port = port
+	user.lock.Unlock()
+	return port, nil
+}
+
+// mixIn sends In of the user to the mix.
+func (s *service) mixIn(ctx context.Context, room *Room, user *User) error {
+	port, err := s.hubPort(ctx, room, user)
+	if err != nil {
+		return err
+	}
+	in, ok := user.stream(DefaultStream)
+	if !ok {
+		return fmt.Errorf(`stream %s of user %s is not published`, DefaultStream, s.redact.User(user.name))
+	}
+	if err = connect(ctx, room.session, in, port); err != nil {
+		return err
+	}
+	return s.keepMuted(ctx, room, user, DefaultStream, port)
+}
+
+// hubType returns the type of the hub of rooms of the mode, it is empty when rooms have no hub.
+func hubType(mode RoomMode) MediaType {
+	switch mode {
+	case MCURoomMode:
+		return Composite
+	case BroadcastRoomMode:
+		return DispatcherOneToMany
+	}
+	return ""
+}
+
+// hubSender returns the sender of the stream of the hub of the room.
+func (r *Room) hubSender() string {
+	if r.Mode == BroadcastRoomMode {
+		return PresenterSender
+	}
+	return MixSender
+}
+
+// hubOut creates the outbound endpoint (WebRtcEndpoint or RtpEndpoint) of the stream of the hub for the user.
+func (s *service) hubOut(ctx context.Context, room *Room, user *User, pointType MediaType) (*MediaObject, error) {
+	port, err := s.hubPort(ctx, room, user)
+	if err != nil {
+		return nil, err
+	}
+	point := &MediaObject{
+		Parent: room.MediaPipeline,
+		Type:   pointType,
+	}
+	if err = room.session.Create(ctx, point); err != nil {
+		return nil, err
+	}
+	if err = connect(ctx, room.session, port, point); err != nil {
+		_ = room.session.Release(ctx, point)
+		return nil, err
+	}
+
+	user.setOut(room.hubSender(), DefaultStream, &MediaConnector{
+		Point:  point,
+		Source: port,
+	})
+	return point, nil
+}
@@ -4,27 +4,34 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"flag"
-	"fmt"
-	"log"
+	"log/slog"
+	"logging"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/pborman/uuid"
+	"jsonrpc"
 	kurentows "kurento/websocket"
 	"net/http"
 )
 
-var addr = flag.String(`kurento.addr`, `ws://localhost:8888/kurento`, `set your kurento media server WS endpoint`)
-
-func New(ctx context.Context) (Kurento, error) {
+func New(ctx context.Context, config *ClientConfig) (Kurento, error) {
+	if config == nil {
+		config = DefaultClientConfig()
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = DefaultClientConfig().PingInterval
+	}
+	if config.WebSocket == nil {
+		config.WebSocket = DefaultClientConfig().WebSocket
+	}
+	logger := logging.OrDefault(config.Logger).With(logging.Component, `kurento_client`)
 
 	dial := func() (kurentows.WebSocketer, *http.Response, error) {
-		log.Printf(`dialing to %s`, *addr)
-		ws, resp, err := websocket.DefaultDialer.Dial(*addr, nil)
+		logger.Info(`dialing to media server`, `addr`, config.Addr)
+		ws, resp, err := websocket.DefaultDialer.Dial(config.Addr, nil)
 		if err != nil {
-			log.Printf(`dialing to %s ended with error => %s`, *addr, err)
+			logger.Warn(`dialing to media server failed`, `addr`, config.Addr, logging.Error, config.Redact.Error(err))
 		}
 		return ws, resp, err
 	}
@@ -32,21 +39,36 @@ func New(ctx context.Context) (Kurento, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	// инициализируем ws-слушателя со стороны бэка
-	c, err := kurentows.NewWsListener(ctx, kurentows.NewReconn(nil, dial))
+	timeouts := kurentows.Timeouts{
+		Write: config.WebSocket.WriteWait,
+		Pong:  config.WebSocket.PongWait,
+		Ping:  config.WebSocket.pingPeriod(),
+	}
+	c, err := kurentows.NewWsListener(ctx, kurentows.NewReconn(nil, dial), timeouts, logger)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	//configure connection here
 	cli := &kurentoClient{
-		cctx:      ctx,
-		ws:        c,
-		queueLock: sync.RWMutex{},
-		queue:     make(map[string]chan *response, 0),
-		cancel:    cancel,
+		cctx:   ctx,
+		ws:     c,
+		log:    logger,
+		config: config,
+		stats:  &callStats{calls: make(map[string]*CallStats, 0)},
+		m:      newClientMetrics(config.Metrics, c),
+		types:  DefaultRegistry,
+		topics: make(map[string]*topicSubscription, 0),
+		cancel: cancel,
 	}
 
-	go cli.loop()
+	// KMS sends to clients only onEvent requests
+	mux := jsonrpc.NewMux()
+	mux.HandleFunc(`onEvent`, cli.onEvent)
+	cli.rpc = jsonrpc.NewConn(ctx, c, mux, logger)
+
+	go cli.watch()
 	go cli.pinger(ctx)
 
 	return cli, nil
@@ -83,6 +105,8 @@ const (
 	Dispatcher MediaType = `Dispatcher`
 	// DispatcherOneToMany: A Hub that sends a given source to all the connected sinks.
 	DispatcherOneToMany MediaType = `DispatcherOneToMany`
+	// HubPort: This MediaElement specifies a connection with a Hub.
+	HubPort MediaType = `HubPort`
 )
 
 type InvokeOperation string
@@ -90,14 +114,34 @@ type InvokeOperation string
 const (
 	// connect. Connect two media elements.
 	ConnectInvokeOperation InvokeOperation = `connect`
+	// disconnect. Disconnect two media elements.
+	DisconnectInvokeOperation InvokeOperation = `disconnect`
+	// getStats. Get statistics of the media element.
+	GetStatsInvokeOperation InvokeOperation = `getStats`
 	// play. Start the play of a media (PlayerEndpoint).
 	PlayInvokeOperation InvokeOperation = `play`
+	// pause. Pause the play or the record of a media (PlayerEndpoint, RecorderEndpoint).
+	PauseInvokeOperation InvokeOperation = `pause`
+	// stop. Stop the play or the record of a media (PlayerEndpoint, RecorderEndpoint).
+	StopInvokeOperation InvokeOperation = `stop`
+	// setPosition. Seek the media to the position in milliseconds (PlayerEndpoint).
+	SetPositionInvokeOperation InvokeOperation = `setPosition`
 	// record. Start the record of a media (RecorderEndpoint).
 	RecordInvokeOperation InvokeOperation = `record`
+	// stopAndWait. Stop the record and wait the media is written (RecorderEndpoint).
+	StopAndWaitInvokeOperation InvokeOperation = `stopAndWait`
+	// setSource. Set the source of the hub (DispatcherOneToMany).
+	SetSourceInvokeOperation InvokeOperation = `setSource`
+	// removeSource. Remove the source of the hub (DispatcherOneToMany).
+	RemoveSourceInvokeOperation InvokeOperation = `removeSource`
 	// setOverlayedImage. Set the image that is going to be overlaid on the detected faces in a media stream (FaceOverlayFilter).
 	SetOverlayedImageInvokeOperation InvokeOperation = `setOverlayedImage`
-	// processOffer. Process the offer in the SDP negotiation (WebRtcEndpoint).
+	// processOffer. Process the offer in the SDP negotiation (WebRtcEndpoint, RtpEndpoint).
 	ProcessOfferInvokeOperation InvokeOperation = `processOffer`
+	// processAnswer. Process the answer in the SDP negotiation (WebRtcEndpoint, RtpEndpoint).
+	ProcessAnswerInvokeOperation InvokeOperation = `processAnswer`
+	// generateOffer. Generate the offer for the SDP negotiation (WebRtcEndpoint, RtpEndpoint).
+	GenerateOfferInvokeOperation InvokeOperation = `generateOffer`
 	//gatherCandidates. Start the ICE candidates gathering to establish a WebRTC media session (WebRtcEndpoint).
 	GatherCandidatesInvokeOperation InvokeOperation = `gatherCandidates`
 	//addIceCandidate. Add ICE candidate (WebRtcEndpoint).
@@ -137,21 +181,21 @@ const (
 	OnIceGatheringDone SubscribeTopic = `OnIceGatheringDone`
 
 	IceCandidateFound SubscribeTopic = `IceCandidateFound`
+	// IceGatheringDone: Notify that all candidates have been gathered.
+	IceGatheringDone SubscribeTopic = `IceGatheringDone`
+	// Recording: The recorder starts to store the media.
+	RecordingEvent SubscribeTopic = `Recording`
+	// Stopped: The recorder stopped to store the media.
+	StoppedEvent SubscribeTopic = `Stopped`
 )
 
-type ConstructorParams struct {
-	//  (optional, string): This parameter is only mandatory for Media Elements.
-	// In that case, the value of this parameter is the identifier of the media pipeline which is going to contain the Media Element to be created.
-	MediaPipeline *string `json:"mediaPipeline,omitempty"`
-	// (optional, string): This parameter is only required for Media Elements such as PlayerEndpoint or RecorderEndpoint.
-	// It is an URI used in the Media Element, i.e. the media to be played (for PlayerEndpoint) or the location of the recording (for RecorderEndpoint).
-	Uri *string `json:"uri,omitempty"`
-}
-
 type MediaObject struct {
 	Parent *MediaObject
 	ID     string    `json:"id"`
 	Type   MediaType `json:"type"`
+	// Params: constructor params of the type (see ModuleType.Params).
+	// mediaPipeline is filled from Parent when the type needs it.
+	Params map[string]interface{} `json:"params,omitempty"`
 }
 
 func (m *MediaObject) String() string {
@@ -163,96 +207,98 @@ func (m *MediaObject) String() string {
 	return str + `/` + m.ID
 }
 
+// Kurento is a connection to the media server. Every media object lives in
+// a Session, so problems of one session (and its cleanup) do not affect others.
 type Kurento interface {
+	// connect: Opens a new independent session on the media server.
+	NewSession(ctx context.Context) (Session, error)
+	// Stats returns counters of calls by call name (method or invoke.<operation>).
+	Stats() map[string]CallStats
+	// Health returns the state of the media server of the client.
+	Health() []ServerHealth
+	//The Kurento Protocol allows to Kurento Media Server send requests to clients:
+	//onEvent: This request is sent from Kurento Media server to clients when an event occurs.
+	Close() error
+}
+
+// Session is a KMS session with its own id, subscriptions and media objects.
+// Close releases every object created in the session which is still alive.
+type Session interface {
+	ID() string
 	//create: Instantiates a new media object, that is, a pipeline or media element.
 	Create(ctx context.Context, obj *MediaObject) error
 	// invoke: Calls a method of an existing media object.
 	Invoke(ctx context.Context, obj *MediaObject, operation InvokeOperation, payload *json.RawMessage) error
 	// subscribe: Creates a subscription to an event in a object.
+	// unsubscribe: Removes an existing subscription to an event (when ctx or session is done).
 	Subscribe(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan []byte, error)
-	// unsubscribe: Removes an existing subscription to an event.
+	// SubscribeEvents is Subscribe with event data decoded by the EventType of the topic.
+	SubscribeEvents(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan interface{}, error)
 	// release: Deletes the object and release resources used by it.
 	Release(ctx context.Context, obj *MediaObject) error
-	//The Kurento Protocol allows to Kurento Media Server send requests to clients:
-	//onEvent: This request is sent from Kurento Media server to clients when an event occurs.
 	Close() error
 }
 
-type errorKurento struct {
-	Code    int              `json:"code"`
-	Message string           `json:"message"`
-	Data    *json.RawMessage `json:"data"`
+// event is params of onEvent request sent by KMS to subscribers.
+type event struct {
+	Value struct {
+		Data   *json.RawMessage `json:"data"`
+		Object string           `json:"object"`
+		Type   SubscribeTopic   `json:"type"`
+	} `json:"value"`
 }
 
-func (e *errorKurento) Error() string {
-	return fmt.Sprintf("[%d] %s : %s", e.Code, e.Message, e.Data)
+func (e *event) TopicName() string {
+	return e.Value.Object + `/` + string(e.Value.Type)
 }
 
-type response struct {
-	Jsonrpc string `json:"jsonrpc"`
-	// Result/Error
-	ID string `json:"id"`
-
-	// Result
-	Result *json.RawMessage `json:"result,omitempty"`
-
-	//Error
-	Error *errorKurento `json:"error,omitempty"`
-
-	// OnEvent
-	Method string `json:"method"`
-
-	Params *struct {
-		Value struct {
-			Data   *json.RawMessage `json:"data"`
-			Object string           `json:"object"`
-			Type   SubscribeTopic   `json:"type"`
-		} `json:"value"`
-	} `json:params,omitempty`
+// topicSubscription is the KMS subscription to a topic shared by its subscribers, it is guarded by topicsLock.
+type topicSubscription struct {
+	// channels of subscribers, every event is given to all of them
+	channels []chan *event
+	// subscribed is closed when KMS has answered the subscribe of the first subscriber with id or err
+	subscribed chan struct{}
+	id         string
+	err        error
 }
 
-func (r *response) QueueName() string {
-	if r.IsEvent() {
-		return r.Params.Value.Object + `/` + string(r.Params.Value.Type)
-	}
-
-	return r.ID
-}
-
-func (a *response) IsEvent() bool {
-	return a.Method == `onEvent`
-}
+type kurentoClient struct {
+	cctx context.Context
+	ws   *kurentows.WsListener
+	rpc  *jsonrpc.Conn
+	log  *slog.Logger
 
-func (a *response) Err() error {
-	return a.Error
-}
+	config *ClientConfig
+	stats  *callStats
+	m      *clientMetrics
+	// known media types, built-in and custom modules
+	types *Registry
 
-type kurentoClient struct {
-	cctx      context.Context
-	ws        *kurentows.WsListener
-	sessionID string
+	topicsLock sync.RWMutex
+	topics     map[string]*topicSubscription
 
-	queueLock sync.RWMutex
-	queue     map[string]chan *response
+	// pingErr: result of the last ping, it is reset by reconnect
+	pingLock sync.RWMutex
+	pingErr  error
 
 	cancel context.CancelFunc
 }
 
 func (k *kurentoClient) pinger(ctx context.Context) {
+	// KMS keeps the session for the interval (in milliseconds) after the last ping
 	val := &struct {
-		Interval int `json:"interval"`
-	}{Interval: 240000}
-	tiker := time.NewTicker(40 * time.Second)
+		Interval int64 `json:"interval"`
+	}{Interval: int64(6 * k.config.PingInterval / time.Millisecond)}
+	tiker := time.NewTicker(k.config.PingInterval)
 	defer tiker.Stop()
 	for {
 		select {
 		case <-tiker.C:
-			out, done, err := k.send(newRequest(`ping`, val))
+			_, err := k.call(ctx, `ping`, "", val)
 			if err != nil {
-				log.Printf(`ping-pong err: %s`, err)
+				k.log.Warn(`ping-pong failed`, logging.Err(err))
 			}
-			<-out
-			done()
+			k.setPingErr(err)
 
 		case <-ctx.Done():
 			return
@@ -260,346 +306,82 @@ func (k *kurentoClient) pinger(ctx context.Context) {
 	}
 }
 
-func (k *kurentoClient) loop() error {
-	var msg []byte
-	var online bool
+// watch reconnects to the media server when the connection is lost.
+func (k *kurentoClient) watch() {
 	for {
-
 		select {
 		case <-k.cctx.Done():
-			log.Print("kurentoClient: loop was done: %s", k.cctx.Err())
-			return k.cctx.Err()
-		case online = <-k.ws.Status():
+			k.log.Info(`watch was done`, logging.Err(k.cctx.Err()))
+			return
+		case online := <-k.ws.Status():
+			if online {
+				k.setPingErr(nil)
+			}
 			if !online {
-				//log.Printf(`server listened on %s was disconnected`, *addr)
-				//log.Printf(`reconnect after %s`, kurentows.RECONNECT_TIMEOUT)
+				k.log.Warn(`media server connection lost`)
 				time.Sleep(kurentows.RECONNECT_TIMEOUT)
 				k.ws.Reconnect() // единичная попытка реконнекта
 				// если попытка закончилась неуспешно
 				// backListener.Status() вернет false из канала
 				// если все хорошо
 				// backListener.Status() вернет true из канала
-			} else {
-				//log.Printf(`reconnect to %s succeeded`, *addr)
 			}
-			continue
-		case msg = <-k.ws.Read():
-		}
-
-		resp := &response{}
-
-		log.Print("kurentoClient: started read")
-		err := json.Unmarshal(msg, resp)
-		if err != nil {
-			log.Printf("kurentoClient: read error: %s", err)
-		}
-
-		log.Printf("kurentoClient: [%s] ended read %s, %s", resp.QueueName(), resp, err)
-
-		k.queueLock.RLock()
-		out, ok := k.queue[resp.QueueName()]
-		k.queueLock.RUnlock()
-		if !ok {
-			log.Print(`not found listener for response %v`, resp)
-		}
-		select {
-		case out <- resp:
-			log.Printf("kurentoClient: [%s] ended read PUT_ANSWER", resp.QueueName())
-		default:
-			desc, _ := json.MarshalIndent(resp, "", "\t")
-			log.Printf("REJECT___________REJECT___________kurentoClient: [%s] ended read NOT_HAVE_LISTENERS: \n%s", resp.QueueName(), string(desc))
 		}
-
 	}
-	return nil
-}
-
-type request struct {
-	Jsonrpc string      `json:"jsonrpc"`
-	ID      string      `json:"id"`
-	Method  string      `json:"method"`
-	Params  interface{} `json:"params"`
 }
 
-func newRequest(method string, p interface{}) *request {
-	return &request{
-		Jsonrpc: `2.0`,
-		ID:      uuid.New(),
-		Method:  method,
-		Params:  p,
-	}
-}
-
-func (k *kurentoClient) send(req *request) (chan *response, func(), error) {
-	queueName := req.ID
-
-	log.Printf("kurentoClient: [%s] started send %v", req.ID, req)
-	msg, err := json.Marshal(req)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	k.ws.Write(msg)
-
-	if err != nil {
-		log.Printf("kurentoClient: [%s] started send err %s", req.ID, err)
-		return nil, nil, err
-	}
-
-	out := make(chan *response, 0)
-	k.queueLock.Lock()
-	k.queue[queueName] = out
-	k.queueLock.Unlock()
-
-	log.Printf("kurentoClient: [%s] ended send %s", req.ID, err)
-	return out, func() {
-		close(out)
-		k.queueLock.Lock()
-		delete(k.queue, queueName)
-		k.queueLock.Unlock()
-	}, nil
-}
-
-func (k *kurentoClient) Create(ctx context.Context, obj *MediaObject) error {
-	params := &struct {
-		Type              MediaType          `json:"type"`
-		SessionID         *string            `json:"sessionId,omitempty"`
-		Properties        map[string]string  `json:"properties"`
-		ConstructorParams *ConstructorParams `json:"constructorParams"`
-	}{
-		Type:              obj.Type,
-		Properties:        make(map[string]string, 0),
-		ConstructorParams: &ConstructorParams{},
-	}
-
-	if obj.Type != MediaPipeline {
-		if &obj.Parent == nil {
-			return errors.New(`not found media pipeline`)
-		}
-		params.ConstructorParams.MediaPipeline = &obj.Parent.ID
-	}
-	if k.sessionID != "" {
-		params.SessionID = &k.sessionID
-	}
-
-	out, done, err := k.send(newRequest(`create`, params))
-	if err != nil {
-		return err
-	}
-	defer done()
-	select {
-	case <-k.cctx.Done():
-		return k.cctx.Err()
-	case <-ctx.Done():
-		return ctx.Err()
-	case resp := <-out:
-		if resp.Error != nil {
-			return resp.Err()
-		}
-		result := &struct {
-			Value     string `json:"value"`
-			SessionID string `json:"sessionId"`
-		}{}
-		err = json.Unmarshal(*resp.Result, result)
-		if err != nil {
-			return err
-		}
-		obj.ID = result.Value
-		k.sessionID = result.SessionID
+// onEvent routes events from KMS to subscribers.
+func (k *kurentoClient) onEvent(ctx context.Context, req *jsonrpc.Request) (interface{}, error) {
+	e := &event{}
+	if err := req.UnmarshalParams(e); err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-func (k *kurentoClient) Invoke(ctx context.Context, obj *MediaObject, operation InvokeOperation, buffer *json.RawMessage) error {
-	params := &struct {
-		Object          string           `json:"object"`
-		Operation       string           `json:"operation"`
-		OperationParams *json.RawMessage `json:"operationParams,omitempty"`
-		SessionID       string           `json:"sessionId"`
-	}{
-		Object:          obj.ID,
-		Operation:       string(operation),
-		OperationParams: buffer,
-		SessionID:       k.sessionID,
+	var subscribers []chan *event
+	k.topicsLock.RLock()
+	if topicSubs, ok := k.topics[e.TopicName()]; ok {
+		subscribers = topicSubs.channels
 	}
-
-	out, done, err := k.send(newRequest(`invoke`, params))
-	if err != nil {
-		return err
+	k.topicsLock.RUnlock()
+	if len(subscribers) == 0 {
+		k.m.droppedEvents.Inc(`no_subscriber`)
+		k.log.Debug(`not found subscriber for event`, `topic`, e.TopicName())
+		return nil, nil
 	}
-	defer done()
-	select {
-	case <-k.cctx.Done():
-		return k.cctx.Err()
-	case <-ctx.Done():
-		return ctx.Err()
-	case resp := <-out:
-		if resp.Error != nil {
-			return resp.Err()
-		}
-		result := &struct {
-			Value     *json.RawMessage `json:"value"`
-			SessionID string           `json:"sessionId"`
-		}{}
-		err = json.Unmarshal(*resp.Result, result)
-		if err != nil {
-			return err
-		}
-		k.sessionID = result.SessionID
-		if result.Value != nil && buffer != nil {
-			*buffer = *result.Value
+	for _, out := range subscribers {
+		select {
+		case out <- e:
+		default:
+			k.m.droppedEvents.Inc(`full`)
+			k.log.Warn(`subscriber is full, event was rejected`, `topic`, e.TopicName())
 		}
 	}
-	return nil
+	return nil, nil
 }
 
-func (k *kurentoClient) Subscribe(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan []byte, error) {
-	params := &struct {
-		Type      SubscribeTopic `json:"type"`
-		Object    string         `json:"object"`
-		SessionID string         `json:"sessionId"`
-	}{
-		Type:      topic,
-		Object:    obj.ID,
-		SessionID: k.sessionID,
-	}
-
-	out, done, err := k.send(newRequest(`subscribe`, params))
+// NewSession opens a new KMS session by the connect method.
+func (k *kurentoClient) NewSession(ctx context.Context) (Session, error) {
+	raw, err := k.call(ctx, `connect`, "", &struct{}{})
 	if err != nil {
 		return nil, err
 	}
-	defer done()
-
 	result := &struct {
-		Value     string `json:"value"`
 		SessionID string `json:"sessionId"`
 	}{}
-
-	// got answer for subscribe
-	select {
-	case <-k.cctx.Done():
-		return nil, k.cctx.Err()
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case resp := <-out:
-		if resp.Error != nil {
-			return nil, resp.Err()
-		}
-		err = json.Unmarshal(*resp.Result, result)
-		if err != nil {
+	if len(raw) != 0 {
+		if err = json.Unmarshal(raw, result); err != nil {
 			return nil, err
 		}
-		k.sessionID = result.SessionID
-	}
-
-	//registry subscribe path to route queue
-	outBuffer := make(chan []byte, 100)
-	topicUrl := obj.ID + `/` + string(topic)
-	topicChannel := make(chan *response, 100)
-	go func() {
-		defer close(topicChannel)
-		defer close(outBuffer)
-		defer k.unsubscribe(ctx, obj, result.Value)
-		count := 0
-
-		for {
-			count++
-			select {
-			case <-k.cctx.Done():
-				return
-			case <-ctx.Done():
-				return
-			case event, ok := <-topicChannel:
-				if !ok {
-					log.Printf("kurentoClient: [%s] channel was closed", topicUrl)
-					return
-				}
-
-				select {
-				case outBuffer <- *event.Params.Value.Data:
-					log.Printf("kurentoClient: [%s] subsriber PUT_BUFFER_%d", topicUrl, count)
-				default:
-					desc, _ := json.MarshalIndent(event, "", "\t")
-					log.Printf("REJECT___________REJECT___________kurentoClient: [%s] subsriber WAS_REJECTED_%d : \n %s", topicUrl, count, desc)
-				}
-			}
-		}
-	}()
-
-	k.queueLock.Lock()
-	k.queue[topicUrl] = topicChannel
-	k.queueLock.Unlock()
-
-	return outBuffer, nil
-}
-
-func (k *kurentoClient) unsubscribe(ctx context.Context, obj *MediaObject, subscriptionID string) error {
-	params := &struct {
-		Subscription string `json:"subscription"`
-		Object       string `json:"object"`
-		SessionID    string `json:"sessionId"`
-	}{
-		Subscription: subscriptionID,
-		Object:       obj.ID,
-		SessionID:    k.sessionID,
-	}
-
-	out, done, err := k.send(newRequest(`unsubscribe`, params))
-	if err != nil {
-		return err
-	}
-	defer done()
-
-	select {
-	case <-k.cctx.Done():
-		return k.cctx.Err()
-	case <-ctx.Done():
-		return ctx.Err()
-	case resp := <-out:
-		if resp.Error != nil {
-			return resp.Err()
-		}
 	}
-
-	return nil
-}
-
-func (k *kurentoClient) Release(ctx context.Context, obj *MediaObject) error {
-	params := &struct {
-		Object    string `json:"object"`
-		SessionID string `json:"sessionId"`
-	}{
-		Object:    obj.ID,
-		SessionID: k.sessionID,
+	if result.SessionID == "" {
+		return nil, errors.New(`media server did not return session id`)
 	}
 
-	out, done, err := k.send(newRequest(`release`, params))
-	if err != nil {
-		return err
-	}
-	defer done()
-	select {
-	case <-k.cctx.Done():
-		return k.cctx.Err()
-	case <-ctx.Done():
-		return ctx.Err()
-	case resp := <-out:
-		if resp.Error != nil {
-			return resp.Err()
-		}
-		result := &struct {
-			SessionID string `json:"sessionId"`
-		}{}
-		err = json.Unmarshal(*resp.Result, result)
-		if err != nil {
-			return err
-		}
-		k.sessionID = result.SessionID
-	}
-	return nil
+	return newSession(k, result.SessionID), nil
 }
 
 func (k *kurentoClient) Close() error {
 	k.cancel()
+	k.rpc.Close()
 	return k.ws.Close()
 }
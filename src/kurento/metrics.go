@@ -0,0 +1,92 @@
+package kurento
+
+import (
+	kurentows "kurento/websocket"
+	"metrics"
+)
+
+// clientMetrics are metrics of calls to KMS and of the connection.
+type clientMetrics struct {
+	requests      *metrics.Counter
+	duration      *metrics.Histogram
+	retries       *metrics.Counter
+	droppedEvents *metrics.Counter
+}
+
+func newClientMetrics(r *metrics.Registry, ws *kurentows.WsListener) *clientMetrics {
+	m := &clientMetrics{
+		requests: r.Counter(`madsquid_kms_requests_total`,
+			`Requests to the media server by call name and result (ok, error, timeout).`, `method`, `result`),
+		duration: r.Histogram(`madsquid_kms_request_duration_seconds`,
+			`Latency of requests to the media server by call name.`, nil, `method`),
+		retries: r.Counter(`madsquid_kms_retries_total`,
+			`Repeated requests to the media server by call name.`, `method`),
+		droppedEvents: r.Counter(`madsquid_kms_events_dropped_total`,
+			`Events of the media server dropped by reason (no_subscriber, full, decode).`, `reason`),
+	}
+
+	r.GaugeFunc(`madsquid_kms_connected`, `1 if the connection to the media server is active.`, func() float64 {
+		if ws.Stats().Connected {
+			return 1
+		}
+		return 0
+	})
+	r.CounterFunc(`madsquid_kms_reconnects_total`, `Successful reconnects to the media server.`, func() float64 {
+		return float64(ws.Stats().Reconnects)
+	})
+	r.CounterFunc(`madsquid_kms_reconnect_failures_total`, `Failed reconnects to the media server.`, func() float64 {
+		return float64(ws.Stats().ReconnectFailures)
+	})
+	r.CounterFunc(`madsquid_kms_messages_dropped_total`, `Messages which were not written to the media server.`, func() float64 {
+		return float64(ws.Stats().DroppedWrites)
+	})
+	return m
+}
+
+// registerServiceMetrics registers gauges of rooms, they are counted on every scrape.
+func registerServiceMetrics(r *metrics.Registry, s *service) {
+	r.GaugeFunc(`madsquid_rooms`, `Rooms on the instance.`, func() float64 {
+		return float64(s.count().rooms)
+	})
+	r.GaugeFunc(`madsquid_participants`, `Participants joined to rooms.`, func() float64 {
+		return float64(s.count().participants)
+	})
+	r.GaugeFunc(`madsquid_publishing_endpoints`, `Endpoints receiving media from participants.`, func() float64 {
+		return float64(s.count().publishing)
+	})
+	r.GaugeFunc(`madsquid_subscribing_endpoints`, `Endpoints sending media to participants.`, func() float64 {
+		return float64(s.count().subscribing)
+	})
+}
+
+type serviceCount struct {
+	rooms        int
+	participants int
+	publishing   int
+	subscribing  int
+}
+
+func (s *service) count() serviceCount {
+	s.lock.RLock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.lock.RUnlock()
+
+	c := serviceCount{rooms: len(rooms)}
+	for _, room := range rooms {
+		for _, user := range room.ListUsers() {
+			c.participants++
+			user.lock.RLock()
+			if len(user.In) != 0 {
+				c.publishing++
+			}
+			for _, streams := range user.Out {
+				c.subscribing += len(streams)
+			}
+			user.lock.RUnlock()
+		}
+	}
+	return c
+}
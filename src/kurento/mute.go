@@ -0,0 +1,221 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"logging"
+	"sort"
+	"strings"
+)
+
+const (
+	// MuteWsCmd stops the Media (audio or video) of the stream for everyone, UnmuteWsCmd restores it.
+	MuteWsCmd                  WsCmd = `mute`
+	UnmuteWsCmd                WsCmd = `unmute`
+	ParticipantMediaStateWsCmd WsCmd = `participantMediaState`
+)
+
+// MediaKind is the media type of connections between media elements.
+type MediaKind string
+
+const (
+	AudioMedia MediaKind = `AUDIO`
+	VideoMedia MediaKind = `VIDEO`
+)
+
+// mediaKind returns the media type of the request, `audio` or `video`.
+func mediaKind(media string) (MediaKind, error) {
+	switch kind := MediaKind(strings.ToUpper(media)); kind {
+	case AudioMedia, VideoMedia:
+		return kind, nil
+	}
+	return "", fmt.Errorf(`unknown media %q, audio or video expected`, media)
+}
+
+// ParticipantMediaStateForm tells participants that Media of the stream is muted or unmuted.
+type ParticipantMediaStateForm struct {
+	Cmd    WsCmd  `json:"cmd"`
+	Name   string `json:"name"`
+	Stream string `json:"stream"`
+	Media  string `json:"media"`
+	Muted  bool   `json:"muted"`
+}
+
+// muted returns muted media types of the stream of the user.
+func (u *User) muted(stream string) []MediaKind {
+	u.lock.RLock()
+	kinds := make([]MediaKind, 0, len(u.Muted[stream]))
+	for kind := range u.Muted[stream] {
+		kinds = append(kinds, kind)
+	}
+	u.lock.RUnlock()
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+	return kinds
+}
+
+// setMuted changes the state of the media type of the stream, it returns false when the state is the same.
+func (u *User) setMuted(stream string, kind MediaKind, muted bool) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.Muted[stream][kind] == muted {
+		return false
+	}
+	if !muted {
+		delete(u.Muted[stream], kind)
+		if len(u.Muted[stream]) == 0 {
+			delete(u.Muted, stream)
+		}
+		return true
+	}
+	if u.Muted == nil {
+		u.Muted = make(map[string]map[MediaKind]bool, 0)
+	}
+	if u.Muted[stream] == nil {
+		u.Muted[stream] = make(map[MediaKind]bool, 0)
+	}
+	u.Muted[stream][kind] = true
+	return true
+}
+
+func (s *service) mute(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	kind, err := mediaKind(req.Media)
+	if err != nil {
+		return err
+	}
+	user := currentUser
+	if req.User != "" && req.User != currentUser.name {
+		// moderators mute others
+		if user, err = s.moderated(currentRoom, currentUser, req); err != nil {
+			return err
+		}
+	}
+	stream := streamName(req.Stream)
+	if req.Cmd == UnmuteWsCmd && !s.can(user, mediaCapability(stream, kind)) {
+		// media which the user can't publish stays disconnected
+		return &PermissionError{
+			Cmd:          req.Cmd,
+			Capabilities: []string{mediaCapability(stream, kind)},
+			Role:         user.role(),
+			Reason:       fmt.Sprintf(`%s can't publish %s`, s.redact.User(user.name), mediaCapability(stream, kind)),
+		}
+	}
+	return s.setMediaState(ctx, currentRoom, user, stream, kind, req.Cmd == MuteWsCmd)
+}
+
+// setMediaState mutes or unmutes the media type of the stream: it is disconnected from every sink
+// of the stream on the media server, so clients can't bypass it. The state is kept when the stream
+// is not published, it applies on publishing.
+func (s *service) setMediaState(ctx context.Context, room *Room, user *User, stream string, kind MediaKind, muted bool) error {
+	if !user.setMuted(stream, kind, muted) {
+		return nil
+	}
+
+	if in, ok := user.stream(stream); ok {
+		operation := ConnectInvokeOperation
+		if muted {
+			operation = DisconnectInvokeOperation
+		}
+		for _, sink := range s.streamSinks(room, user, stream) {
+			if err := connectMedia(ctx, room.session, operation, in, sink, kind); err != nil {
+				s.userLog(user).Warn(`can't change media state`, `stream`, stream, `media`, kind,
+					logging.KMSObject, sink.ID, logging.Err(err))
+			}
+		}
+	}
+
+	s.userLog(user).Info(`media state changed`, `stream`, stream, `media`, kind, `muted`, muted)
+	s.broadcast(room, &ParticipantMediaStateForm{
+		Cmd:    ParticipantMediaStateWsCmd,
+		Name:   user.name,
+		Stream: stream,
+		Media:  strings.ToLower(string(kind)),
+		Muted:  muted,
+	})
+	return nil
+}
+
+// streamSinks returns elements connected to the stream of the user: its hub port,
+// outbound endpoints of subscribers and the recorder.
+func (s *service) streamSinks(room *Room, user *User, stream string) []*MediaObject {
+	var sinks []*MediaObject
+	user.lock.RLock()
+	if user.Port != nil && stream == DefaultStream {
+		sinks = append(sinks, user.Port)
+	}
+	user.lock.RUnlock()
+	for _, u := range room.ListUsers() {
+		if connector, ok := u.out(user.name, stream); ok {
+			sinks = append(sinks, connector.Point)
+		}
+	}
+	room.lock.RLock()
+	if room.Recording != nil {
+		if recorder, ok := room.Recording.Recorders[user.name][stream]; ok {
+			sinks = append(sinks, recorder)
+		}
+	}
+	room.lock.RUnlock()
+	return sinks
+}
+
+// keepMuted disconnects muted media types of the stream and those which the user can't publish
+// from its new sink.
+func (s *service) keepMuted(ctx context.Context, room *Room, user *User, stream string, sink *MediaObject) error {
+	in, ok := user.stream(stream)
+	if !ok {
+		return nil
+	}
+	kinds := map[MediaKind]bool{}
+	for _, kind := range append(user.muted(stream), s.deniedMedia(user, stream)...) {
+		kinds[kind] = true
+	}
+	for kind := range kinds {
+		if err := connectMedia(ctx, room.session, DisconnectInvokeOperation, in, sink, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendMediaStates gives muted streams of the room to the joined user.
+func (s *service) sendMediaStates(room *Room, currentUser *User) {
+	for _, user := range room.ListUsers() {
+		user.lock.RLock()
+		var forms []*ParticipantMediaStateForm
+		for stream, kinds := range user.Muted {
+			for kind := range kinds {
+				forms = append(forms, &ParticipantMediaStateForm{
+					Cmd:    ParticipantMediaStateWsCmd,
+					Name:   user.name,
+					Stream: stream,
+					Media:  strings.ToLower(string(kind)),
+					Muted:  true,
+				})
+			}
+		}
+		user.lock.RUnlock()
+		for _, form := range forms {
+			if err := s.send(currentUser, form); err != nil {
+				s.userLog(currentUser).Debug(`can't write to web socket`, logging.Err(err))
+				return
+			}
+		}
+	}
+}
+
+// connectMedia connects (ConnectInvokeOperation) or disconnects (DisconnectInvokeOperation)
+// one media type of source and sink.
+func connectMedia(ctx context.Context, session Session, operation InvokeOperation, source, sink *MediaObject, kind MediaKind) error {
+	raw, err := json.Marshal(map[string]string{"sink": sink.ID, "mediaType": string(kind)})
+	if err != nil {
+		return err
+	}
+	payload := &json.RawMessage{}
+	_ = payload.UnmarshalJSON(raw)
+	return session.Invoke(ctx, source, operation, payload)
+}
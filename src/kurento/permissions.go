@@ -0,0 +1,214 @@
+package kurento
+
+import (
+	"context"
+	"fmt"
+	"jointoken"
+	"logging"
+	"strings"
+)
+
+// ScreenStream is the stream of the screen share, it is published by jointoken.PublishScreen.
+// Other streams publish audio and video by jointoken.PublishAudio and jointoken.PublishVideo.
+const ScreenStream = `screen`
+
+// PermissionDeniedCode is the code of answers of denied commands.
+const PermissionDeniedCode = `permission_denied`
+
+// DefaultPolicy gives capabilities to users by their roles when join tokens have none.
+func DefaultPolicy() map[Role][]string {
+	return map[Role][]string{
+		OwnerRole:       jointoken.Capabilities,
+		ModeratorRole:   jointoken.Capabilities,
+		ParticipantRole: {jointoken.PublishAudio, jointoken.PublishVideo, jointoken.PublishScreen, jointoken.Subscribe, jointoken.Chat},
+		ViewerRole:      {jointoken.Subscribe, jointoken.Chat},
+	}
+}
+
+// cmdCapabilities: the capability running the command, commands which are not listed need none.
+// Publishing and muting depend on the stream, see authorize.
+var cmdCapabilities = map[WsCmd]string{
+	StartRecordingWsCmd: jointoken.Record,
+	StopRecordingWsCmd:  jointoken.Record,
+	SendMessageWsCmd:    jointoken.Chat,
+	TakePresenterWsCmd:  jointoken.Moderate,
+	AddPlayerWsCmd:      jointoken.Moderate,
+	RemovePlayerWsCmd:   jointoken.Moderate,
+	PlayPlayerWsCmd:     jointoken.Moderate,
+	PausePlayerWsCmd:    jointoken.Moderate,
+	SeekPlayerWsCmd:     jointoken.Moderate,
+	KickWsCmd:           jointoken.Moderate,
+	LockRoomWsCmd:       jointoken.Moderate,
+	UnlockRoomWsCmd:     jointoken.Moderate,
+	EndMeetingWsCmd:     jointoken.Moderate,
+}
+
+// PermissionError: the command is denied to the user. It is answered by WsPermissionErrAnswer.
+type PermissionError struct {
+	Cmd WsCmd
+	// Capabilities: one of them is required
+	Capabilities []string
+	// Role: the role of the user
+	Role   Role
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf(`%s is denied to %s: %s`, e.Cmd, e.Role, e.Reason)
+	}
+	return fmt.Sprintf(`%s is denied to %s: %s is required`, e.Cmd, e.Role, strings.Join(e.Capabilities, ` or `))
+}
+
+// WsPermissionErrAnswer is the answer of a denied command, the command has changed nothing.
+type WsPermissionErrAnswer struct {
+	Request *WsRequest `json:"request"`
+	Error   string     `json:"error"`
+	// Code is PermissionDeniedCode
+	Code         string   `json:"code"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Role         Role     `json:"role"`
+}
+
+func (e *PermissionError) answer(req *WsRequest) *WsPermissionErrAnswer {
+	return &WsPermissionErrAnswer{
+		Request:      req,
+		Error:        e.Error(),
+		Code:         PermissionDeniedCode,
+		Capabilities: e.Capabilities,
+		Role:         e.Role,
+	}
+}
+
+// capabilities returns capabilities of the token of the user or of its role by the policy,
+// virtual users are added by moderators and have all of them.
+func (s *service) capabilities(user *User) []string {
+	if user.Virtual {
+		return jointoken.Capabilities
+	}
+	user.lock.RLock()
+	capabilities, role := user.Capabilities, user.Role
+	user.lock.RUnlock()
+	if capabilities != nil {
+		return capabilities
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.runtime.Policy[role]
+}
+
+// can tells if the user has one of the capabilities.
+func (s *service) can(user *User, capabilities ...string) bool {
+	for _, c := range s.capabilities(user) {
+		for _, required := range capabilities {
+			if c == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// demand returns PermissionError when the user has none of the capabilities.
+func (s *service) demand(user *User, cmd WsCmd, capabilities ...string) error {
+	if s.can(user, capabilities...) {
+		return nil
+	}
+	return &PermissionError{Cmd: cmd, Capabilities: capabilities, Role: user.role()}
+}
+
+// publishCapabilities returns capabilities publishing the stream, one of them is enough.
+func publishCapabilities(stream string) []string {
+	if stream == ScreenStream {
+		return []string{jointoken.PublishScreen}
+	}
+	return []string{jointoken.PublishAudio, jointoken.PublishVideo}
+}
+
+// mediaCapability returns the capability publishing the media type of the stream,
+// the screen share is published as a whole.
+func mediaCapability(stream string, kind MediaKind) string {
+	switch {
+	case stream == ScreenStream:
+		return jointoken.PublishScreen
+	case kind == AudioMedia:
+		return jointoken.PublishAudio
+	}
+	return jointoken.PublishVideo
+}
+
+// deniedMedia returns media types of the stream which the user can't publish,
+// they are disconnected from every sink as muted ones.
+func (s *service) deniedMedia(user *User, stream string) []MediaKind {
+	var kinds []MediaKind
+	for _, kind := range []MediaKind{AudioMedia, VideoMedia} {
+		if !s.can(user, mediaCapability(stream, kind)) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds
+}
+
+// enforceMedia applies capabilities of the user to its published streams when they have changed:
+// streams which it can't publish are released, denied media types are disconnected from their sinks.
+func (s *service) enforceMedia(ctx context.Context, room *Room, user *User) error {
+	for _, stream := range user.streams() {
+		if !s.can(user, publishCapabilities(stream)...) {
+			if err := s.unpublishStream(ctx, room, user, stream); err != nil {
+				return err
+			}
+			continue
+		}
+		in, ok := user.stream(stream)
+		if !ok {
+			continue
+		}
+		for _, kind := range s.deniedMedia(user, stream) {
+			for _, sink := range s.streamSinks(room, user, stream) {
+				// the media type may be disconnected already by mute
+				if err := connectMedia(ctx, room.session, DisconnectInvokeOperation, in, sink, kind); err != nil {
+					s.userLog(user).Debug(`can't disconnect media`, `stream`, stream, `media`, kind,
+						logging.KMSObject, sink.ID, logging.Err(err))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// authorize checks capabilities and the role of the user for the command before it runs,
+// kicked users keep their room name, so their membership is checked too.
+func (s *service) authorize(currentUser *User, req *WsRequest) error {
+	if currentUser.roomName == "" || req.Cmd == JoinRoomWsCmd || req.Cmd == leaveWsCmd {
+		return nil
+	}
+	if room, err := s.userRoom(currentUser, req.Cmd); err == nil {
+		room.lock.RLock()
+		member := room.Users[currentUser.name] == currentUser
+		room.lock.RUnlock()
+		if !member {
+			return fmt.Errorf(`user %s is not in room %s`, s.redact.User(currentUser.name), currentUser.roomName)
+		}
+	}
+
+	if ownerCmds[req.Cmd] && currentUser.role() != OwnerRole {
+		return &PermissionError{Cmd: req.Cmd, Role: currentUser.role(), Reason: fmt.Sprintf(`%s is required`, OwnerRole)}
+	}
+	switch req.Cmd {
+	case ReceiveVideoFromWsCmd:
+		if req.Sender == currentUser.name {
+			return s.demand(currentUser, req.Cmd, publishCapabilities(streamName(req.Stream))...)
+		}
+		return s.demand(currentUser, req.Cmd, jointoken.Subscribe)
+	case MuteWsCmd, UnmuteWsCmd:
+		if req.User != "" && req.User != currentUser.name {
+			return s.demand(currentUser, req.Cmd, jointoken.Moderate)
+		}
+		// unmuting of media which the user can't publish is checked by mute
+		return nil
+	}
+	if capability, ok := cmdCapabilities[req.Cmd]; ok {
+		return s.demand(currentUser, req.Cmd, capability)
+	}
+	return nil
+}
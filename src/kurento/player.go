@@ -0,0 +1,218 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"logging"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// AddPlayerWsCmd adds the virtual participant User playing Uri (a file, HTTP or RTSP) to the room.
+	AddPlayerWsCmd    WsCmd = `addPlayer`
+	RemovePlayerWsCmd WsCmd = `removePlayer`
+	PlayPlayerWsCmd   WsCmd = `playPlayer`
+	PausePlayerWsCmd  WsCmd = `pausePlayer`
+	// SeekPlayerWsCmd seeks the player to Position in milliseconds.
+	SeekPlayerWsCmd WsCmd = `seekPlayer`
+)
+
+// playerCmd runs the player command of the request in the room, it is shared by websockets and the admin route.
+func (s *service) playerCmd(ctx context.Context, roomName string, req *WsRequest) error {
+	if req.Cmd == AddPlayerWsCmd {
+		return s.addPlayer(ctx, roomName, req)
+	}
+
+	room, player, err := s.virtualUser(roomName, req.User)
+	if err != nil {
+		return err
+	}
+	in, ok := player.stream(DefaultStream)
+	if !ok || in.Type != PlayerEndpoint {
+		return fmt.Errorf(`user %s of room %s is not a player`, s.redact.User(req.User), roomName)
+	}
+
+	switch req.Cmd {
+	case RemovePlayerWsCmd:
+		player.stop()
+		return s.leave(ctx, player)
+	case PlayPlayerWsCmd:
+		return room.session.Invoke(ctx, in, PlayInvokeOperation, nil)
+	case PausePlayerWsCmd:
+		return room.session.Invoke(ctx, in, PauseInvokeOperation, nil)
+	case SeekPlayerWsCmd:
+		raw, err := json.Marshal(map[string]int64{"position": req.Position})
+		if err != nil {
+			return err
+		}
+		payload := &json.RawMessage{}
+		_ = payload.UnmarshalJSON(raw)
+		return room.session.Invoke(ctx, in, SetPositionInvokeOperation, payload)
+	}
+	return fmt.Errorf(`unknown cmd %s`, req.Cmd)
+}
+
+// addPlayer joins a virtual participant which DefaultStream is a PlayerEndpoint, clients receive it as any publisher.
+func (s *service) addPlayer(ctx context.Context, roomName string, req *WsRequest) error {
+	room, err := s.virtualRoom(roomName, req.User)
+	if err != nil {
+		return err
+	}
+	if room.Mode == BroadcastRoomMode {
+		return fmt.Errorf(`players are not supported in %s rooms`, room.Mode)
+	}
+	if req.Uri == "" {
+		return errors.New(`uri of the player is required`)
+	}
+	s.lock.RLock()
+	allowed := s.runtime.PlayerURIs
+	s.lock.RUnlock()
+	// the media server opens the uri, so it must not read local files or internal addresses of anyone's choice
+	if err = allowedPlayerURI(allowed, req.Uri); err != nil {
+		return err
+	}
+
+	in := &MediaObject{
+		Parent: room.MediaPipeline,
+		Type:   PlayerEndpoint,
+		Params: map[string]interface{}{`uri`: req.Uri},
+	}
+	player := NewUser(req.User, nil)
+	player.roomName = roomName
+	player.Virtual = true
+	player.Loop = req.Loop
+	err = room.session.Create(ctx, in)
+	if err != nil {
+		return err
+	}
+	player.In[DefaultStream] = in
+	if room.Mode == MCURoomMode {
+		if err = s.mixIn(ctx, room, player); err != nil {
+			s.releaseVirtual(room, player)
+			return err
+		}
+	}
+
+	// events are listened until the player is removed or its room is released
+	playerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	player.stop = cancel
+	ended, err := room.session.Subscribe(playerCtx, in, EndOfStream)
+	if err != nil {
+		s.releaseVirtual(room, player)
+		return err
+	}
+	failed, err := room.session.Subscribe(playerCtx, in, ErrorEvent)
+	if err != nil {
+		s.releaseVirtual(room, player)
+		return err
+	}
+	go s.watchPlayer(playerCtx, room, player, in, ended, failed)
+
+	err = room.session.Invoke(ctx, in, PlayInvokeOperation, nil)
+	if err != nil {
+		s.releaseVirtual(room, player)
+		return err
+	}
+
+	room.AddUser(player)
+	s.userLog(player).Info(`player added`, logging.KMSObject, in.ID, `loop`, player.Loop)
+
+	room.lock.RLock()
+	recording := room.Recording
+	room.lock.RUnlock()
+	if recording != nil {
+		if err := s.record(ctx, room, recording, player, DefaultStream); err != nil {
+			s.userLog(player).Warn(`can't record user`, logging.Error, s.redact.Error(err))
+		}
+	}
+
+	s.broadcast(room, &NewParticipantArrivedForm{
+		Cmd:    NewParticipantArrivedWsCmd,
+		Name:   player.name,
+		Stream: DefaultStream,
+	})
+	return nil
+}
+
+// allowedPlayerURI checks that the uri is under one of allowed prefixes: the scheme and the host
+// are the same and the path is the prefix path or below it. Paths with dot segments are rejected.
+func allowedPlayerURI(allowed []string, uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || u.Opaque != "" {
+		return fmt.Errorf(`uri of the player is not an absolute uri`)
+	}
+	for _, segment := range strings.Split(u.Path, `/`) {
+		if segment == `.` || segment == `..` {
+			return fmt.Errorf(`uri of the player has dot segments`)
+		}
+	}
+	for _, prefix := range allowed {
+		a, err := url.Parse(prefix)
+		if err != nil || !strings.EqualFold(a.Scheme, u.Scheme) || !strings.EqualFold(a.Host, u.Host) {
+			continue
+		}
+		dir := strings.TrimSuffix(a.Path, `/`)
+		if dir == "" || u.Path == dir || strings.HasPrefix(u.Path, dir+`/`) {
+			return nil
+		}
+	}
+	return fmt.Errorf(`uri of the player is not allowed by player.uris`)
+}
+
+// watchPlayer restarts looping players on EndOfStream and logs their errors.
+func (s *service) watchPlayer(ctx context.Context, room *Room, player *User, in *MediaObject, ended, failed <-chan []byte) {
+	for {
+		select {
+		case _, ok := <-ended:
+			if !ok {
+				return
+			}
+			if !player.Loop {
+				s.userLog(player).Info(`player has ended`)
+				continue
+			}
+			s.userLog(player).Debug(`player restarted`)
+			if err := room.session.Invoke(ctx, in, PlayInvokeOperation, nil); err != nil {
+				s.userLog(player).Warn(`can't restart player`, logging.Err(err))
+			}
+		case event, ok := <-failed:
+			if !ok {
+				return
+			}
+			s.userLog(player).Warn(`player failed`, logging.KMSObject, in.ID, logging.Error, s.redact.Error(errors.New(string(event))))
+		}
+	}
+}
+
+func (s *service) ServePlayers(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := &WsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Cmd {
+	case AddPlayerWsCmd, RemovePlayerWsCmd, PlayPlayerWsCmd, PausePlayerWsCmd, SeekPlayerWsCmd:
+	default:
+		http.Error(rw, fmt.Sprintf(`unknown cmd %s`, req.Cmd), http.StatusBadRequest)
+		return
+	}
+
+	log := s.log.With(logging.Cmd, req.Cmd, logging.Room, req.Room, logging.User, s.redact.User(req.User))
+	if err := s.playerCmd(r.Context(), req.Room, req); err != nil {
+		log.Warn(`admin cmd failed`, logging.Error, s.redact.Error(err))
+		rw.Header().Set(`Content-Type`, `application/json`)
+		rw.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(rw).Encode(&WsErrAnswer{Request: req, Error: err.Error()})
+		return
+	}
+	log.Info(`admin cmd done`)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,304 @@
+package kurento
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"logging"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	StartRecordingWsCmd   WsCmd = `startRecording`
+	StopRecordingWsCmd    WsCmd = `stopRecording`
+	RecordingStartedWsCmd WsCmd = `recordingStarted`
+	RecordingStoppedWsCmd WsCmd = `recordingStopped`
+)
+
+// DefaultRecordingURI is the template of recording files, see recordingURI.
+const DefaultRecordingURI = `file:///tmp/madsquid/{room}/{user}-{timestamp}.webm`
+
+// recordingTimeFormat is the {timestamp} of recording files, it sorts as the time.
+const recordingTimeFormat = `20060102T150405Z`
+
+// RecordingForm tells participants that the recording of the room is started or stopped by Name.
+type RecordingForm struct {
+	Cmd  WsCmd  `json:"cmd"`
+	Name string `json:"name"`
+}
+
+// Recording is the recording of a room: every published stream has its recorder connected to it.
+type Recording struct {
+	Started time.Time `json:"started"`
+	// Recorders: recorders by user name, then by stream
+	Recorders map[string]map[string]*MediaObject `json:"recorders"`
+
+	// uri: template of files, it is fixed when the recording starts
+	uri string
+	// ctx: events of recorders are listened until the recording is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// recordingURI fills {room}, {user}, {stream} and {timestamp} of the template.
+// Streams other than DefaultStream are written next to it when the template has no {stream}.
+func recordingURI(template, room, user, stream string, t time.Time) string {
+	if stream != DefaultStream && !strings.Contains(template, `{stream}`) {
+		template = strings.Replace(template, `{user}`, `{user}-{stream}`, 1)
+	}
+	return strings.NewReplacer(
+		`{room}`, pathSegment(room),
+		`{user}`, pathSegment(user),
+		`{stream}`, pathSegment(stream),
+		`{timestamp}`, t.UTC().Format(recordingTimeFormat),
+	).Replace(template)
+}
+
+// pathSegment escapes the name for a path of the template. Empty and dot-only names (`.`, `..`)
+// are replaced by underscores, otherwise files would be written outside the recording directory.
+func pathSegment(name string) string {
+	if strings.Trim(name, `.`) == "" {
+		return strings.Repeat(`_`, len(name)+1)
+	}
+	return url.PathEscape(name)
+}
+
+func (s *service) startRecording(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+
+	s.lock.RLock()
+	uri := s.runtime.RecordingURI
+	s.lock.RUnlock()
+
+	// recording outlives the command, it is stopped by stopRecording or with the room
+	recordingCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	recording := &Recording{
+		Started:   time.Now(),
+		Recorders: make(map[string]map[string]*MediaObject, 0),
+		uri:       uri,
+		ctx:       recordingCtx,
+		cancel:    cancel,
+	}
+	currentRoom.lock.Lock()
+	if currentRoom.Recording != nil {
+		currentRoom.lock.Unlock()
+		cancel()
+		return fmt.Errorf(`room %s is already recorded`, currentUser.roomName)
+	}
+	currentRoom.Recording = recording
+	currentRoom.lock.Unlock()
+
+	s.userLog(currentUser).Info(`recording started`)
+	for _, user := range currentRoom.ListUsers() {
+		for _, stream := range user.streams() {
+			// a broken publisher does not stop the recording of others
+			if err := s.record(ctx, currentRoom, recording, user, stream); err != nil {
+				s.userLog(user).Warn(`can't record user`, `stream`, stream, logging.Error, s.redact.Error(err))
+			}
+		}
+	}
+
+	s.broadcast(currentRoom, &RecordingForm{
+		Cmd:  RecordingStartedWsCmd,
+		Name: currentUser.name,
+	})
+	return nil
+}
+
+func (s *service) stopRecording(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+
+	recording := s.finishRecording(ctx, currentRoom, s.userLog(currentUser))
+	if recording == nil {
+		return fmt.Errorf(`room %s is not recorded`, currentUser.roomName)
+	}
+	s.userLog(currentUser).Info(`recording stopped`, `duration`, time.Since(recording.Started))
+
+	s.broadcast(currentRoom, &RecordingForm{
+		Cmd:  RecordingStoppedWsCmd,
+		Name: currentUser.name,
+	})
+	return nil
+}
+
+// finishRecording detaches the recording of the room under room.lock, then stops and releases
+// all its recorders. It returns when their files are written, nil means the room is not recorded.
+func (s *service) finishRecording(ctx context.Context, room *Room, log *slog.Logger) *Recording {
+	room.lock.Lock()
+	recording := room.Recording
+	room.Recording = nil
+	var recorders map[string]map[string]*MediaObject
+	if recording != nil {
+		recorders = recording.Recorders
+		recording.Recorders = make(map[string]map[string]*MediaObject, 0)
+	}
+	room.lock.Unlock()
+	if recording == nil {
+		return nil
+	}
+
+	for name, streams := range recorders {
+		for _, recorder := range streams {
+			// stopAndWait returns when the file is written completely
+			err := room.session.Invoke(ctx, recorder, StopAndWaitInvokeOperation, nil)
+			if err != nil {
+				log.Warn(`can't stop recorder`, logging.KMSObject, recorder.ID,
+					logging.User, s.redact.User(name), logging.Err(err))
+			}
+			if err = room.session.Release(ctx, recorder); err != nil {
+				log.Warn(`can't release object`, logging.KMSObject, recorder.ID, logging.Err(err))
+			}
+		}
+	}
+	recording.cancel()
+	return recording
+}
+
+// record connects a new recorder to the stream of the user, the recorder is finalized
+// when the stream ends or on its error.
+func (s *service) record(ctx context.Context, room *Room, recording *Recording, user *User, stream string) error {
+	in, ok := user.stream(stream)
+	if !ok {
+		return fmt.Errorf(`stream %s of user %s is not published`, stream, s.redact.User(user.name))
+	}
+	recorder := &MediaObject{
+		Parent: room.MediaPipeline,
+		Type:   RecorderEndpoint,
+		Params: map[string]interface{}{
+			`uri`:          recordingURI(recording.uri, user.roomName, user.name, stream, time.Now()),
+			`mediaProfile`: `WEBM`,
+			// KMS stops the recorder on EndOfStream of the user, it raises Stopped
+			`stopOnEndOfStream`: true,
+		},
+	}
+	err := room.session.Create(ctx, recorder)
+	if err != nil {
+		return err
+	}
+
+	err = connect(ctx, room.session, in, recorder)
+	if err == nil {
+		// muted media are not recorded
+		err = s.keepMuted(ctx, room, user, stream, recorder)
+	}
+	if err != nil {
+		_ = room.session.Release(ctx, recorder)
+		return err
+	}
+
+	stopped, err := room.session.Subscribe(recording.ctx, recorder, StoppedEvent)
+	if err != nil {
+		_ = room.session.Release(ctx, recorder)
+		return err
+	}
+	failed, err := room.session.Subscribe(recording.ctx, recorder, ErrorEvent)
+	if err != nil {
+		_ = room.session.Release(ctx, recorder)
+		return err
+	}
+
+	err = room.session.Invoke(ctx, recorder, RecordInvokeOperation, nil)
+	if err != nil {
+		_ = room.session.Release(ctx, recorder)
+		return err
+	}
+
+	room.lock.Lock()
+	current := room.Recording == recording
+	if current {
+		if recording.Recorders[user.name] == nil {
+			recording.Recorders[user.name] = make(map[string]*MediaObject, 0)
+		}
+		recording.Recorders[user.name][stream] = recorder
+	}
+	room.lock.Unlock()
+	if !current {
+		// the recording is stopped while the recorder was created
+		return room.session.Release(ctx, recorder)
+	}
+	s.userLog(user).Debug(`user is recorded`, `stream`, stream, logging.KMSObject, recorder.ID)
+
+	// closed, when the recording is stopped
+	go func() {
+		select {
+		case _, ok := <-stopped:
+			if ok {
+				s.finalizeRecorder(room, recording, user, stream, `stopped`)
+			}
+		case event, ok := <-failed:
+			if ok {
+				s.userLog(user).Warn(`recorder failed`, logging.KMSObject, recorder.ID, logging.Error, s.redact.Error(errors.New(string(event))))
+				s.finalizeRecorder(room, recording, user, stream, `error`)
+			}
+		}
+	}()
+	return nil
+}
+
+// finalizeRecorder stops and releases the recorder of the stream, the file is kept as written.
+func (s *service) finalizeRecorder(room *Room, recording *Recording, user *User, stream, reason string) {
+	room.lock.Lock()
+	recorder, ok := recording.Recorders[user.name][stream]
+	delete(recording.Recorders[user.name], stream)
+	if len(recording.Recorders[user.name]) == 0 {
+		delete(recording.Recorders, user.name)
+	}
+	room.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	s.userLog(user).Info(`recorder finalized`, `stream`, stream, logging.KMSObject, recorder.ID, `reason`, reason)
+	if err := room.session.Invoke(ctx, recorder, StopInvokeOperation, nil); err != nil {
+		s.userLog(user).Debug(`can't stop recorder`, logging.KMSObject, recorder.ID, logging.Err(err))
+	}
+	if err := room.session.Release(ctx, recorder); err != nil {
+		s.userLog(user).Warn(`can't release object`, logging.KMSObject, recorder.ID, logging.Err(err))
+	}
+}
+
+// detachRecorders removes recorders of the stream, of all streams when stream is empty, of the user
+// leaving the room or unpublishing from the recording and returns them, room.lock must be held.
+// They are stopped by stopRecorders after the lock is released, so slow KMS calls don't block the room.
+func detachRecorders(room *Room, user *User, stream string) []*MediaObject {
+	if room.Recording == nil {
+		return nil
+	}
+	var detached []*MediaObject
+	recorders := room.Recording.Recorders[user.name]
+	for name, recorder := range recorders {
+		if stream != "" && stream != name {
+			continue
+		}
+		delete(recorders, name)
+		detached = append(detached, recorder)
+	}
+	if len(recorders) == 0 {
+		delete(room.Recording.Recorders, user.name)
+	}
+	return detached
+}
+
+// stopRecorders stops and releases recorders of the user detached by detachRecorders,
+// it returns when their files are written.
+func (s *service) stopRecorders(ctx context.Context, room *Room, user *User, recorders []*MediaObject) {
+	for _, recorder := range recorders {
+		if err := room.session.Invoke(ctx, recorder, StopAndWaitInvokeOperation, nil); err != nil {
+			s.userLog(user).Debug(`can't stop recorder`, logging.KMSObject, recorder.ID, logging.Err(err))
+		}
+		if err := room.session.Release(ctx, recorder); err != nil {
+			s.userLog(user).Warn(`can't release object`, logging.KMSObject, recorder.ID, logging.Err(err))
+		}
+	}
+}
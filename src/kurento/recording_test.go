@@ -0,0 +1,30 @@
+package kurento
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordingURI(t *testing.T) {
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	const template = `file:///var/rec/{room}/{user}-{timestamp}.webm`
+	for _, tc := range []struct {
+		name, template, room, user, stream, uri string
+	}{
+		{`camera`, template, `room1`, `alice`, DefaultStream, `file:///var/rec/room1/alice-20260102T030405Z.webm`},
+		{`screen`, template, `room1`, `alice`, `screen`, `file:///var/rec/room1/alice-screen-20260102T030405Z.webm`},
+		{`stream placeholder`, `file:///var/rec/{room}/{stream}/{user}.webm`, `room1`, `alice`, `screen`, `file:///var/rec/room1/screen/alice.webm`},
+		{`escaped`, template, `a b`, `x/../y`, DefaultStream, `file:///var/rec/a%20b/x%2F..%2Fy-20260102T030405Z.webm`},
+		{`dot room`, template, `..`, `alice`, DefaultStream, `file:///var/rec/___/alice-20260102T030405Z.webm`},
+		{`dot user`, `file:///var/rec/{room}/{user}/{timestamp}.webm`, `room1`, `..`, DefaultStream, `file:///var/rec/room1/___/20260102T030405Z.webm`},
+		{`single dot`, template, `.`, `alice`, DefaultStream, `file:///var/rec/__/alice-20260102T030405Z.webm`},
+		{`empty`, `file:///var/rec/{room}/{user}.webm`, ``, `alice`, DefaultStream, `file:///var/rec/_/alice.webm`},
+		{`dots in name`, template, `..a`, `alice`, DefaultStream, `file:///var/rec/..a/alice-20260102T030405Z.webm`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if uri := recordingURI(tc.template, tc.room, tc.user, tc.stream, started); uri != tc.uri {
+				t.Errorf("uri is %s\nwant  %s", uri, tc.uri)
+			}
+		})
+	}
+}
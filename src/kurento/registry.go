@@ -0,0 +1,405 @@
+package kurento
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Abstract types of the Kurento class hierarchy, objects of them can't be created.
+const (
+	MediaObjectType  MediaType = `MediaObject`
+	MediaElementType MediaType = `MediaElement`
+	EndpointType     MediaType = `Endpoint`
+	FilterType       MediaType = `Filter`
+	HubType          MediaType = `Hub`
+)
+
+// ParamType is a JSON kind of a constructor param.
+type ParamType string
+
+const (
+	StringParam  ParamType = `string`
+	NumberParam  ParamType = `number`
+	BooleanParam ParamType = `boolean`
+	ObjectParam  ParamType = `object`
+	ArrayParam   ParamType = `array`
+	AnyParam     ParamType = `any`
+)
+
+// mediaPipelineParam is filled by the client from MediaObject.Parent.
+const mediaPipelineParam = `mediaPipeline`
+
+// Param describes one constructor param of a module type.
+type Param struct {
+	Name     string    `json:"name"`
+	Type     ParamType `json:"type"`
+	Required bool      `json:"required"`
+}
+
+// EventType describes an event raised by a module type.
+type EventType struct {
+	Topic SubscribeTopic `json:"topic"`
+	// New returns a value to decode event data into (pointer), nil keeps raw data as json.RawMessage.
+	New func() interface{} `json:"-"`
+}
+
+// ModuleType describes a media object type, built-in or implemented by a custom KMS module.
+// Operations, events and params of the Extends type are inherited.
+// Declared params are checked, others are passed to KMS as they are unless the type is Strict.
+type ModuleType struct {
+	Name       MediaType         `json:"name"`
+	Extends    MediaType         `json:"extends,omitempty"`
+	Abstract   bool              `json:"abstract,omitempty"`
+	Params     []Param           `json:"params"`
+	Strict     bool              `json:"strict,omitempty"`
+	Operations []InvokeOperation `json:"operations"`
+	Events     []EventType       `json:"events"`
+}
+
+// Registry of module types known to the client.
+type Registry struct {
+	lock  sync.RWMutex
+	types map[MediaType]*ModuleType
+}
+
+// NewRegistry returns registry with the built-in Kurento types.
+func NewRegistry() *Registry {
+	r := &Registry{types: make(map[MediaType]*ModuleType, 0)}
+	for _, t := range builtinTypes {
+		if err := r.Register(t); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// DefaultRegistry is used by clients created by New.
+var DefaultRegistry = NewRegistry()
+
+// Register adds module type to DefaultRegistry.
+func Register(t *ModuleType) error {
+	return DefaultRegistry.Register(t)
+}
+
+func (r *Registry) Register(t *ModuleType) error {
+	if t == nil || t.Name == "" {
+		return fmt.Errorf(`module type without name`)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.types[t.Name]; ok {
+		return fmt.Errorf(`module type %s is registered already`, t.Name)
+	}
+	if t.Extends != "" {
+		if _, ok := r.types[t.Extends]; !ok {
+			return fmt.Errorf(`module type %s extends unknown type %s`, t.Name, t.Extends)
+		}
+	}
+	r.types[t.Name] = t
+	return nil
+}
+
+func (r *Registry) Lookup(name MediaType) (*ModuleType, bool) {
+	r.lock.RLock()
+	t, ok := r.types[name]
+	r.lock.RUnlock()
+	return t, ok
+}
+
+// List returns all registered types.
+func (r *Registry) List() []*ModuleType {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	types := make([]*ModuleType, 0, len(r.types))
+	for _, t := range r.types {
+		types = append(types, t)
+	}
+	return types
+}
+
+// chain returns the type and all its ancestors.
+func (r *Registry) chain(name MediaType) ([]*ModuleType, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	chain := []*ModuleType{}
+	for name != "" {
+		t, ok := r.types[name]
+		if !ok {
+			return nil, fmt.Errorf(`unknown media type %s`, name)
+		}
+		chain = append(chain, t)
+		name = t.Extends
+	}
+	return chain, nil
+}
+
+// constructorParams validates params of the object and returns them ready to send.
+func (r *Registry) constructorParams(obj *MediaObject) (map[string]interface{}, error) {
+	chain, err := r.chain(obj.Type)
+	if err != nil {
+		return nil, err
+	}
+	if chain[0].Abstract {
+		return nil, fmt.Errorf(`media type %s is abstract`, obj.Type)
+	}
+
+	params := make(map[string]interface{}, len(obj.Params)+1)
+	for k, v := range obj.Params {
+		params[k] = v
+	}
+
+	schema := make(map[string]Param, 0)
+	for _, t := range chain {
+		for _, p := range t.Params {
+			schema[p.Name] = p
+		}
+	}
+	if _, ok := schema[mediaPipelineParam]; ok && obj.Parent != nil {
+		if _, ok := params[mediaPipelineParam]; !ok {
+			params[mediaPipelineParam] = obj.Parent.ID
+		}
+	}
+
+	for name, value := range params {
+		p, ok := schema[name]
+		if !ok && chain[0].Strict {
+			return nil, fmt.Errorf(`unknown param %s of media type %s`, name, obj.Type)
+		}
+		if !ok {
+			continue
+		}
+		if err = checkParamType(p, value); err != nil {
+			return nil, fmt.Errorf(`param %s of media type %s: %s`, name, obj.Type, err)
+		}
+	}
+	for name, p := range schema {
+		if _, ok := params[name]; p.Required && !ok {
+			if name == mediaPipelineParam {
+				return nil, fmt.Errorf(`not found media pipeline`)
+			}
+			return nil, fmt.Errorf(`param %s of media type %s is required`, name, obj.Type)
+		}
+	}
+	return params, nil
+}
+
+func checkParamType(p Param, value interface{}) error {
+	if p.Type == AnyParam || p.Type == "" {
+		return nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var kind ParamType
+	switch raw[0] {
+	case '"':
+		kind = StringParam
+	case '{':
+		kind = ObjectParam
+	case '[':
+		kind = ArrayParam
+	case 't', 'f':
+		kind = BooleanParam
+	case 'n':
+		return nil
+	default:
+		kind = NumberParam
+	}
+	if kind != p.Type {
+		return fmt.Errorf(`must be %s, got %s`, p.Type, kind)
+	}
+	return nil
+}
+
+// checkOperation tells if objects of the type have the operation.
+func (r *Registry) checkOperation(name MediaType, operation InvokeOperation) error {
+	chain, err := r.chain(name)
+	if err != nil {
+		return err
+	}
+	for _, t := range chain {
+		for _, op := range t.Operations {
+			if op == operation {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf(`media type %s has no operation %s`, name, operation)
+}
+
+// eventType returns description of the event raised by objects of the type.
+func (r *Registry) eventType(name MediaType, topic SubscribeTopic) (*EventType, error) {
+	chain, err := r.chain(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range chain {
+		for i := range t.Events {
+			if t.Events[i].Topic == topic {
+				return &t.Events[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf(`media type %s has no event %s`, name, topic)
+}
+
+// decode returns event data as a value of the event type.
+func (e *EventType) decode(data []byte) (interface{}, error) {
+	if e.New == nil {
+		return json.RawMessage(data), nil
+	}
+	v := e.New()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func events(topics ...SubscribeTopic) []EventType {
+	events := make([]EventType, len(topics))
+	for i, topic := range topics {
+		events[i] = EventType{Topic: topic}
+	}
+	return events
+}
+
+var pipelineParam = Param{Name: mediaPipelineParam, Type: StringParam, Required: true}
+
+var builtinTypes = []*ModuleType{
+	{
+		Name:     MediaObjectType,
+		Abstract: true,
+		Events:   events(ErrorEvent),
+	},
+	{
+		Name:    MediaPipeline,
+		Extends: MediaObjectType,
+	},
+	{
+		Name:       MediaElementType,
+		Extends:    MediaObjectType,
+		Abstract:   true,
+		Params:     []Param{pipelineParam},
+		Operations: []InvokeOperation{ConnectInvokeOperation, DisconnectInvokeOperation, GetStatsInvokeOperation},
+		Events:     events(ElementConnected, ElementDisconnected, MediaStateChanged),
+	},
+	{
+		Name:     EndpointType,
+		Extends:  MediaElementType,
+		Abstract: true,
+		Events:   events(MediaSessionStarted, MediaSessionTerminated, ConnectionStateChanged),
+	},
+	{
+		Name:     FilterType,
+		Extends:  MediaElementType,
+		Abstract: true,
+	},
+	{
+		Name:     HubType,
+		Extends:  MediaObjectType,
+		Abstract: true,
+		Params:   []Param{pipelineParam},
+	},
+	{
+		Name:    WebRtcEndpoint,
+		Extends: EndpointType,
+		Params: []Param{
+			{Name: `recvonly`, Type: BooleanParam},
+			{Name: `sendonly`, Type: BooleanParam},
+			{Name: `useDataChannels`, Type: BooleanParam},
+			{Name: `certificateKeyType`, Type: StringParam},
+			{Name: `qosDscp`, Type: StringParam},
+			{Name: `stunServerAddress`, Type: StringParam},
+			{Name: `stunServerPort`, Type: NumberParam},
+			{Name: `turnUrl`, Type: StringParam},
+		},
+		Operations: []InvokeOperation{
+			ProcessOfferInvokeOperation, ProcessAnswerInvokeOperation, GenerateOfferInvokeOperation,
+			GatherCandidatesInvokeOperation, AddIceCandidateInvokeOperation,
+		},
+		Events: events(IceCandidateFound, IceGatheringDone, OnIceCandidate, OnIceGatheringDone, OnIceComponentStateChanged),
+	},
+	{
+		Name:    RtpEndpoint,
+		Extends: EndpointType,
+		Params: []Param{
+			{Name: `crypto`, Type: ObjectParam},
+			{Name: `useIpv6`, Type: BooleanParam},
+			{Name: `qosDscp`, Type: StringParam},
+		},
+		Operations: []InvokeOperation{ProcessOfferInvokeOperation, ProcessAnswerInvokeOperation, GenerateOfferInvokeOperation},
+	},
+	{
+		Name:    HttpPostEndpoint,
+		Extends: EndpointType,
+		Params: []Param{
+			{Name: `disconnectionTimeout`, Type: NumberParam},
+			{Name: `useEncodedMedia`, Type: BooleanParam},
+		},
+		Events: events(EndOfStream),
+	},
+	{
+		Name:    PlayerEndpoint,
+		Extends: EndpointType,
+		Params: []Param{
+			{Name: `uri`, Type: StringParam, Required: true},
+			{Name: `useEncodedMedia`, Type: BooleanParam},
+			{Name: `networkCache`, Type: NumberParam},
+		},
+		Operations: []InvokeOperation{PlayInvokeOperation, PauseInvokeOperation, StopInvokeOperation, SetPositionInvokeOperation},
+		Events:     events(EndOfStream),
+	},
+	{
+		Name:    RecorderEndpoint,
+		Extends: EndpointType,
+		Params: []Param{
+			{Name: `uri`, Type: StringParam, Required: true},
+			{Name: `mediaProfile`, Type: StringParam},
+			{Name: `stopOnEndOfStream`, Type: BooleanParam},
+		},
+		Operations: []InvokeOperation{RecordInvokeOperation, PauseInvokeOperation, StopInvokeOperation, StopAndWaitInvokeOperation},
+		Events:     events(RecordingEvent, StoppedEvent),
+	},
+	{
+		Name:       FaceOverlayFilter,
+		Extends:    FilterType,
+		Operations: []InvokeOperation{SetOverlayedImageInvokeOperation},
+	},
+	{
+		Name:    ZBarFilter,
+		Extends: FilterType,
+		Events:  events(CodeFoundEvent),
+	},
+	{
+		Name:    GStreamerFilter,
+		Extends: FilterType,
+		Params: []Param{
+			{Name: `command`, Type: StringParam, Required: true},
+			{Name: `filterType`, Type: StringParam},
+		},
+	},
+	{
+		Name:    Composite,
+		Extends: HubType,
+	},
+	{
+		Name:    Dispatcher,
+		Extends: HubType,
+	},
+	{
+		Name:       DispatcherOneToMany,
+		Extends:    HubType,
+		Operations: []InvokeOperation{SetSourceInvokeOperation, RemoveSourceInvokeOperation},
+	},
+	{
+		// HubPort is created in the pipeline of its hub, so it needs no mediaPipeline
+		Name:       HubPort,
+		Extends:    MediaObjectType,
+		Params:     []Param{{Name: `hub`, Type: StringParam, Required: true}},
+		Operations: []InvokeOperation{ConnectInvokeOperation, DisconnectInvokeOperation, GetStatsInvokeOperation},
+		Events:     events(ElementConnected, ElementDisconnected, MediaStateChanged),
+	},
+}
@@ -0,0 +1,99 @@
+package kurento
+
+import (
+	"testing"
+)
+
+func TestRegistryInheritance(t *testing.T) {
+	r := NewRegistry()
+	// WebRtcEndpoint <- Endpoint <- MediaElement <- MediaObject
+	for _, op := range []InvokeOperation{ProcessOfferInvokeOperation, ConnectInvokeOperation, GetStatsInvokeOperation} {
+		if err := r.checkOperation(WebRtcEndpoint, op); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := r.checkOperation(WebRtcEndpoint, PlayInvokeOperation); err == nil {
+		t.Errorf(`%s has %s`, WebRtcEndpoint, PlayInvokeOperation)
+	}
+	for _, topic := range []SubscribeTopic{OnIceCandidate, MediaSessionStarted, MediaStateChanged, ErrorEvent} {
+		if _, err := r.eventType(WebRtcEndpoint, topic); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := r.eventType(WebRtcEndpoint, RecordingEvent); err == nil {
+		t.Errorf(`%s has %s`, WebRtcEndpoint, RecordingEvent)
+	}
+
+	custom := &ModuleType{Name: `ChromaFilter`, Extends: FilterType, Operations: []InvokeOperation{`setBackground`}}
+	if err := r.Register(custom); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []InvokeOperation{`setBackground`, ConnectInvokeOperation} {
+		if err := r.checkOperation(custom.Name, op); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := r.Register(custom); err == nil {
+		t.Error(`type is registered twice`)
+	}
+	if err := r.Register(&ModuleType{Name: `Orphan`, Extends: `Unknown`}); err == nil {
+		t.Error(`type extends unknown type`)
+	}
+}
+
+func TestRegistryConstructorParams(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&ModuleType{
+		Name:    `StrictFilter`,
+		Extends: FilterType,
+		Params:  []Param{{Name: `level`, Type: NumberParam}},
+		Strict:  true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pipeline := &MediaObject{ID: `pipeline`, Type: MediaPipeline}
+
+	for _, tc := range []struct {
+		name   string
+		obj    *MediaObject
+		failed bool
+	}{
+		{`pipeline from parent`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline}, false},
+		{`no pipeline`, &MediaObject{Type: WebRtcEndpoint}, true},
+		{`abstract`, &MediaObject{Type: EndpointType, Parent: pipeline}, true},
+		{`abstract hub`, &MediaObject{Type: HubType, Parent: pipeline}, true},
+		{`unknown type`, &MediaObject{Type: `Unknown`, Parent: pipeline}, true},
+		{`declared params`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline,
+			Params: map[string]interface{}{`recvonly`: true, `useDataChannels`: true, `certificateKeyType`: `ECDSA`}}, false},
+		{`wrong boolean`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline, Params: map[string]interface{}{`sendonly`: `yes`}}, true},
+		{`wrong number`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline, Params: map[string]interface{}{`stunServerPort`: `3478`}}, true},
+		{`wrong object`, &MediaObject{Type: RtpEndpoint, Parent: pipeline, Params: map[string]interface{}{`crypto`: []string{}}}, true},
+		{`inherited param type`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline, Params: map[string]interface{}{mediaPipelineParam: 1}}, true},
+		{`unknown param of built-in type`, &MediaObject{Type: WebRtcEndpoint, Parent: pipeline, Params: map[string]interface{}{`newParam`: 1}}, false},
+		{`required param`, &MediaObject{Type: PlayerEndpoint, Parent: pipeline, Params: map[string]interface{}{`uri`: `file:///tmp/a.webm`}}, false},
+		{`no required param`, &MediaObject{Type: PlayerEndpoint, Parent: pipeline}, true},
+		{`strict type`, &MediaObject{Type: `StrictFilter`, Parent: pipeline, Params: map[string]interface{}{`level`: 2}}, false},
+		{`unknown param of strict type`, &MediaObject{Type: `StrictFilter`, Parent: pipeline, Params: map[string]interface{}{`lvl`: 2}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := r.constructorParams(tc.obj)
+			if tc.failed {
+				if err == nil {
+					t.Errorf(`no error, params: %v`, params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params[mediaPipelineParam] != pipeline.ID {
+				t.Errorf(`mediaPipeline is %v`, params[mediaPipelineParam])
+			}
+			for name, value := range tc.obj.Params {
+				if params[name] != value {
+					t.Errorf(`param %s is %v, want %v`, name, params[name], value)
+				}
+			}
+		})
+	}
+}
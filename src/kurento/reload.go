@@ -0,0 +1,47 @@
+package kurento
+
+import (
+	"logging"
+)
+
+// IceServersForm gives ICE servers to the client for its peer connections.
+type IceServersForm struct {
+	Cmd        WsCmd       `json:"cmd"`
+	IceServers []ICEServer `json:"iceServers"`
+}
+
+func (s *service) Reload(config RuntimeConfig) {
+	if config.RecordingURI == "" {
+		config.RecordingURI = DefaultRecordingURI
+	}
+	if config.Policy == nil {
+		config.Policy = DefaultPolicy()
+	}
+	s.lock.Lock()
+	s.runtime = config
+	users := make([]*User, 0, len(s.conns))
+	for user := range s.conns {
+		users = append(users, user)
+	}
+	s.lock.Unlock()
+
+	s.log.Info(`runtime settings reloaded`, `max_rooms`, config.Limits.MaxRooms,
+		`max_participants`, config.Limits.MaxParticipants, `ice_servers`, len(config.ICEServers), `recording_uri`, config.RecordingURI)
+	// new peer connections of clients use new servers
+	for _, user := range users {
+		s.sendIceServers(user, config.ICEServers)
+	}
+}
+
+func (s *service) sendIceServers(user *User, iceServers []ICEServer) {
+	if iceServers == nil {
+		iceServers = []ICEServer{}
+	}
+	err := s.send(user, &IceServersForm{
+		Cmd:        IceServersWsCmd,
+		IceServers: iceServers,
+	})
+	if err != nil {
+		s.userLog(user).Debug(`can't send ice servers`, logging.Err(err))
+	}
+}
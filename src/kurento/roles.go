@@ -0,0 +1,278 @@
+package kurento
+
+import (
+	"context"
+	"fmt"
+	"jointoken"
+	"logging"
+	"sort"
+)
+
+// Role of the user in the room, it is given on joinRoom: the user creating the room is the owner,
+// others are participants or viewers when they ask for it.
+type Role string
+
+const (
+	OwnerRole       Role = `owner`
+	ModeratorRole   Role = `moderator`
+	ParticipantRole Role = `participant`
+	// ViewerRole: the user receives streams only
+	ViewerRole Role = `viewer`
+)
+
+const (
+	// KickWsCmd removes the user of the request from the room.
+	KickWsCmd       WsCmd = `kick`
+	LockRoomWsCmd   WsCmd = `lockRoom`
+	UnlockRoomWsCmd WsCmd = `unlockRoom`
+	// EndMeetingWsCmd removes all users, the room is released.
+	EndMeetingWsCmd WsCmd = `endMeeting`
+	// TransferOwnershipWsCmd makes the user of the request the owner, the owner becomes a moderator.
+	TransferOwnershipWsCmd WsCmd = `transferOwnership`
+	// SetRoleWsCmd gives Role (moderator, participant or viewer) to the user of the request.
+	SetRoleWsCmd WsCmd = `setRole`
+
+	RoleChangedWsCmd  WsCmd = `roleChanged`
+	RoomLockedWsCmd   WsCmd = `roomLocked`
+	KickedWsCmd       WsCmd = `kicked`
+	MeetingEndedWsCmd WsCmd = `meetingEnded`
+)
+
+// ownerCmds are run by the owner only, other commands need capabilities, see cmdCapabilities.
+var ownerCmds = map[WsCmd]bool{
+	TransferOwnershipWsCmd: true,
+	SetRoleWsCmd:           true,
+}
+
+// RoleChangedForm tells participants the new role of the user.
+type RoleChangedForm struct {
+	Cmd  WsCmd  `json:"cmd"`
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type RoomLockedForm struct {
+	Cmd    WsCmd `json:"cmd"`
+	Locked bool  `json:"locked"`
+}
+
+// ModeratedForm tells the user that moderator Name has kicked it or has ended the meeting.
+type ModeratedForm struct {
+	Cmd  WsCmd  `json:"cmd"`
+	Name string `json:"name"`
+}
+
+// rank orders roles, a user moderates users of lower ranks.
+func (r Role) rank() int {
+	switch r {
+	case OwnerRole:
+		return 3
+	case ModeratorRole:
+		return 2
+	case ParticipantRole:
+		return 1
+	}
+	return 0
+}
+
+func (r Role) valid() bool {
+	switch r {
+	case OwnerRole, ModeratorRole, ParticipantRole, ViewerRole:
+		return true
+	}
+	return false
+}
+
+func (u *User) role() Role {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return u.Role
+}
+
+func (u *User) setRole(role Role) {
+	u.lock.Lock()
+	u.Role = role
+	u.lock.Unlock()
+}
+
+// moderated returns the user of the request which the current user moderates.
+func (s *service) moderated(room *Room, currentUser *User, req *WsRequest) (*User, error) {
+	room.lock.RLock()
+	user, ok := room.Users[req.User]
+	room.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf(`can't find user %s in room %s`, s.redact.User(req.User), currentUser.roomName)
+	}
+	if user == currentUser || user.role().rank() >= currentUser.role().rank() {
+		return nil, &PermissionError{
+			Cmd:    req.Cmd,
+			Role:   currentUser.role(),
+			Reason: fmt.Sprintf(`%s %s can't be moderated`, user.role(), s.redact.User(user.name)),
+		}
+	}
+	return user, nil
+}
+
+// joinRole returns the role of the user joining the room, the room is nil when the user creates it.
+// The role of the token goes first, moderators of tokens join locked rooms.
+func joinRole(room *Room, req *WsRequest, claims *jointoken.Claims) (Role, error) {
+	if claims != nil && claims.Role != "" {
+		role := Role(claims.Role)
+		if room != nil && room.isLocked() && role.rank() < ModeratorRole.rank() {
+			return "", fmt.Errorf(`room %s is locked`, req.Room)
+		}
+		return role, nil
+	}
+	if room == nil {
+		return OwnerRole, nil
+	}
+	if room.isLocked() {
+		return "", fmt.Errorf(`room %s is locked`, req.Room)
+	}
+	if Role(req.Role) == ViewerRole {
+		return ViewerRole, nil
+	}
+	return ParticipantRole, nil
+}
+
+// takeOwnership makes other owners of the room moderators, the owner of a token joins an existing room.
+func (s *service) takeOwnership(room *Room, owner *User) {
+	for _, user := range room.ListUsers() {
+		if user != owner && user.role() == OwnerRole {
+			s.changeRole(room, user, ModeratorRole)
+		}
+	}
+}
+
+func (r *Room) isLocked() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.Locked
+}
+
+func (s *service) kick(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	user, err := s.moderated(currentRoom, currentUser, req)
+	if err != nil {
+		return err
+	}
+	s.userLog(user).Info(`user kicked`, `moderator`, s.redact.User(currentUser.name))
+	_ = s.send(user, &ModeratedForm{Cmd: KickedWsCmd, Name: currentUser.name})
+	user.stop()
+	return s.leave(ctx, user)
+}
+
+func (s *service) lockRoom(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	locked := req.Cmd == LockRoomWsCmd
+	currentRoom.lock.Lock()
+	currentRoom.Locked = locked
+	currentRoom.lock.Unlock()
+
+	s.userLog(currentUser).Info(`room lock changed`, `locked`, locked)
+	s.broadcast(currentRoom, &RoomLockedForm{Cmd: RoomLockedWsCmd, Locked: locked})
+	return nil
+}
+
+// endMeeting removes all users of the room, virtual users go first, so the room is released
+// with the last human.
+func (s *service) endMeeting(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	s.userLog(currentUser).Info(`meeting ended`)
+	s.broadcast(currentRoom, &ModeratedForm{Cmd: MeetingEndedWsCmd, Name: currentUser.name})
+
+	users := currentRoom.ListUsers()
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Virtual && !users[j].Virtual })
+	for _, user := range users {
+		user.stop()
+		if err := s.leave(ctx, user); err != nil {
+			s.userLog(user).Warn(`can't leave room`, logging.Error, s.redact.Error(err))
+		}
+	}
+	return nil
+}
+
+func (s *service) transferOwnership(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	user, err := s.moderated(currentRoom, currentUser, req)
+	if err != nil {
+		return err
+	}
+	if user.Virtual {
+		return fmt.Errorf(`virtual participant %s can't own room %s`, s.redact.User(user.name), currentUser.roomName)
+	}
+	s.changeRole(currentRoom, currentUser, ModeratorRole)
+	s.changeRole(currentRoom, user, OwnerRole)
+	return nil
+}
+
+func (s *service) setUserRole(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	role := Role(req.Role)
+	switch role {
+	case ModeratorRole, ParticipantRole, ViewerRole:
+	default:
+		return fmt.Errorf(`role %q can't be set, %s gives %s`, req.Role, TransferOwnershipWsCmd, OwnerRole)
+	}
+	user, err := s.moderated(currentRoom, currentUser, req)
+	if err != nil {
+		return err
+	}
+	s.changeRole(currentRoom, user, role)
+	// capabilities of the new role apply to published streams
+	return s.enforceMedia(ctx, currentRoom, user)
+}
+
+func (s *service) changeRole(room *Room, user *User, role Role) {
+	user.setRole(role)
+	s.userLog(user).Info(`role changed`, `role`, role)
+	s.broadcast(room, &RoleChangedForm{Cmd: RoleChangedWsCmd, Name: user.name, Role: role})
+}
+
+// successor returns the user which owns the room after the owner, moderators go first.
+// room.lock must be held.
+func successor(room *Room) *User {
+	var next *User
+	for _, user := range room.Users {
+		if user.Virtual {
+			continue
+		}
+		if next == nil || user.role().rank() > next.role().rank() ||
+			user.role() == next.role() && user.name < next.name {
+			next = user
+		}
+	}
+	return next
+}
+
+// sendRoles gives roles of moderators and of the user itself to the joined user, and the lock of the room.
+func (s *service) sendRoles(room *Room, currentUser *User) {
+	for _, user := range room.ListUsers() {
+		role := user.role()
+		if user != currentUser && role.rank() < ModeratorRole.rank() {
+			continue
+		}
+		if err := s.send(currentUser, &RoleChangedForm{Cmd: RoleChangedWsCmd, Name: user.name, Role: role}); err != nil {
+			s.userLog(currentUser).Debug(`can't write to web socket`, logging.Err(err))
+			return
+		}
+	}
+	if room.isLocked() {
+		_ = s.send(currentUser, &RoomLockedForm{Cmd: RoomLockedWsCmd, Locked: true})
+	}
+}
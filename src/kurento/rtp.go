@@ -0,0 +1,234 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"logging"
+	"net/http"
+)
+
+// RtpDirection is the way an RtpEndpoint is wired into the room.
+type RtpDirection string
+
+const (
+	// RtpPublish: the external peer publishes into the room as a virtual participant.
+	RtpPublish RtpDirection = `publish`
+	// RtpSubscribe: the external peer receives the stream of a participant.
+	RtpSubscribe RtpDirection = `subscribe`
+)
+
+// maxSdpSize limits SDP posted to the admin route.
+const maxSdpSize = 64 * 1024
+
+// addRtp joins the virtual participant name which media goes through an RtpEndpoint.
+// It returns the SDP answer to offer, or the offer of the endpoint when offer is empty,
+// then the peer gives its answer to answerRtp.
+func (s *service) addRtp(ctx context.Context, roomName, name string, direction RtpDirection, sender, offer string) (string, error) {
+	room, err := s.virtualRoom(roomName, name)
+	if err != nil {
+		return "", err
+	}
+
+	rtp := NewUser(name, nil)
+	rtp.roomName = roomName
+	rtp.Virtual = true
+
+	var point *MediaObject
+	switch direction {
+	case RtpPublish:
+		if room.Mode == BroadcastRoomMode {
+			return "", fmt.Errorf(`rtp publishers are not supported in %s rooms`, room.Mode)
+		}
+		point = &MediaObject{
+			Parent: room.MediaPipeline,
+			Type:   RtpEndpoint,
+		}
+		if err = room.session.Create(ctx, point); err != nil {
+			return "", err
+		}
+		rtp.In[DefaultStream] = point
+		if room.Mode == MCURoomMode {
+			err = s.mixIn(ctx, room, rtp)
+		}
+	case RtpSubscribe:
+		point, err = s.rtpOut(ctx, room, rtp, sender)
+	default:
+		return "", fmt.Errorf(`unknown rtp direction %s`, direction)
+	}
+	if err != nil {
+		s.releaseVirtual(room, rtp)
+		return "", err
+	}
+
+	sdp, err := negotiate(ctx, room.session, point, offer)
+	if err != nil {
+		s.releaseVirtual(room, rtp)
+		return "", err
+	}
+
+	if room.HasUser(name) {
+		s.releaseVirtual(room, rtp)
+		return "", fmt.Errorf(`user %s already exist in room %s`, s.redact.User(name), roomName)
+	}
+	room.AddUser(rtp)
+	s.userLog(rtp).Info(`rtp endpoint added`, `direction`, direction, logging.KMSObject, point.ID)
+	if direction != RtpPublish {
+		return sdp, nil
+	}
+
+	room.lock.RLock()
+	recording := room.Recording
+	room.lock.RUnlock()
+	if recording != nil {
+		if err := s.record(ctx, room, recording, rtp, DefaultStream); err != nil {
+			s.userLog(rtp).Warn(`can't record user`, logging.Error, s.redact.Error(err))
+		}
+	}
+	s.broadcast(room, &NewParticipantArrivedForm{
+		Cmd:    NewParticipantArrivedWsCmd,
+		Name:   rtp.name,
+		Stream: DefaultStream,
+	})
+	return sdp, nil
+}
+
+// rtpOut connects DefaultStream of sender (or the hub) to a new RtpEndpoint of the user.
+func (s *service) rtpOut(ctx context.Context, room *Room, user *User, sender string) (*MediaObject, error) {
+	if room.Hub != nil {
+		if sender != room.hubSender() {
+			return nil, fmt.Errorf(`room %s is %s, receive %s instead of %s`, user.roomName, room.Mode, room.hubSender(), s.redact.User(sender))
+		}
+		return s.hubOut(ctx, room, user, RtpEndpoint)
+	}
+
+	room.lock.RLock()
+	source, ok := room.Users[sender]
+	room.lock.RUnlock()
+	var in *MediaObject
+	if ok {
+		in, ok = source.stream(DefaultStream)
+	}
+	if !ok {
+		return nil, fmt.Errorf(`can't find publisher %s in room %s`, s.redact.User(sender), user.roomName)
+	}
+	point := &MediaObject{
+		Parent: room.MediaPipeline,
+		Type:   RtpEndpoint,
+	}
+	if err := room.session.Create(ctx, point); err != nil {
+		return nil, err
+	}
+	user.setOut(sender, DefaultStream, &MediaConnector{
+		Point:  point,
+		Source: in,
+	})
+	if err := connect(ctx, room.session, in, point); err != nil {
+		return nil, err
+	}
+	if err := s.keepMuted(ctx, room, source, DefaultStream, point); err != nil {
+		return nil, err
+	}
+	return point, nil
+}
+
+// negotiate processes the offer of the peer and returns the answer, an empty offer makes the endpoint offer.
+func negotiate(ctx context.Context, session Session, point *MediaObject, offer string) (string, error) {
+	operation := GenerateOfferInvokeOperation
+	// an empty RawMessage can't be marshaled, generateOffer goes with empty params
+	params := json.RawMessage(`{}`)
+	if offer != "" {
+		operation = ProcessOfferInvokeOperation
+		raw, err := json.Marshal(map[string]string{"offer": offer})
+		if err != nil {
+			return "", err
+		}
+		params = raw
+	}
+	// Invoke replaces the payload by the result, params are kept as they are
+	result := params
+	if err := session.Invoke(ctx, point, operation, &result); err != nil {
+		return "", err
+	}
+	var sdp string
+	if err := json.Unmarshal(result, &sdp); err != nil {
+		return "", fmt.Errorf(`bad sdp of %s: %w`, operation, err)
+	}
+	return sdp, nil
+}
+
+// answerRtp gives the answer of the peer to the endpoint which has offered: the endpoint publishing
+// into the room when sender is empty, or the endpoint receiving the stream of sender.
+func (s *service) answerRtp(ctx context.Context, roomName, name, sender, answer string) error {
+	room, rtp, err := s.virtualUser(roomName, name)
+	if err != nil {
+		return err
+	}
+	var point *MediaObject
+	if sender == "" {
+		point, _ = rtp.stream(DefaultStream)
+	} else if connector, ok := rtp.out(sender, DefaultStream); ok {
+		point = connector.Point
+	}
+	if point == nil || point.Type != RtpEndpoint {
+		if sender == "" {
+			return fmt.Errorf(`user %s of room %s is not an rtp publisher`, s.redact.User(name), roomName)
+		}
+		return fmt.Errorf(`user %s of room %s doesn't receive %s by rtp`, s.redact.User(name), roomName, s.redact.User(sender))
+	}
+
+	raw, err := json.Marshal(map[string]string{"answer": answer})
+	if err != nil {
+		return err
+	}
+	payload := json.RawMessage(raw)
+	return room.session.Invoke(ctx, point, ProcessAnswerInvokeOperation, &payload)
+}
+
+// ServeRTP bridges rooms to external RTP peers by plain SDP (application/sdp):
+//
+//	POST   ?room=&user=&direction=publish                 offer in, answer out (empty offer: offer out)
+//	POST   ?room=&user=&direction=subscribe&sender=name   the same for the stream of sender
+//	PUT    ?room=&user=[&sender=name]                     answer to the offer of the endpoint (of the subscriber to sender)
+//	DELETE ?room=&user=                                   removes the endpoint
+func (s *service) ServeRTP(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	roomName, name := query.Get(`room`), query.Get(`user`)
+	log := s.log.With(logging.Room, roomName, logging.User, s.redact.User(name), `method`, r.Method)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSdpSize))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var sdp string
+	switch r.Method {
+	case http.MethodPost:
+		sdp, err = s.addRtp(r.Context(), roomName, name, RtpDirection(query.Get(`direction`)), query.Get(`sender`), string(body))
+	case http.MethodPut:
+		err = s.answerRtp(r.Context(), roomName, name, query.Get(`sender`), string(body))
+	case http.MethodDelete:
+		var rtp *User
+		if _, rtp, err = s.virtualUser(roomName, name); err == nil {
+			err = s.leave(r.Context(), rtp)
+		}
+	default:
+		http.Error(rw, "Only POST, PUT and DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Warn(`rtp request failed`, logging.Error, s.redact.Error(err))
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Info(`rtp request done`)
+	if sdp == "" {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rw.Header().Set(`Content-Type`, `application/sdp`)
+	rw.WriteHeader(http.StatusCreated)
+	io.WriteString(rw, sdp)
+}
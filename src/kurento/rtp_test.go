@@ -0,0 +1,259 @@
+package kurento
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// invokeCall is an invoke marshaled by fakeSession as the client sends it.
+type invokeCall struct {
+	Object          string           `json:"object"`
+	Operation       string           `json:"operation"`
+	OperationParams *json.RawMessage `json:"operationParams,omitempty"`
+}
+
+// fakeSession records invokes and releases and answers invokes by result.
+type fakeSession struct {
+	calls    []invokeCall
+	released []*MediaObject
+	result   string
+}
+
+func (f *fakeSession) ID() string                                         { return `fake` }
+func (f *fakeSession) Create(ctx context.Context, obj *MediaObject) error { return nil }
+func (f *fakeSession) Close() error                                       { return nil }
+
+func (f *fakeSession) Release(ctx context.Context, obj *MediaObject) error {
+	f.released = append(f.released, obj)
+	return nil
+}
+
+func (f *fakeSession) Subscribe(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan []byte, error) {
+	return nil, errors.New(`not supported`)
+}
+
+func (f *fakeSession) SubscribeEvents(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan interface{}, error) {
+	return nil, errors.New(`not supported`)
+}
+
+func (f *fakeSession) Invoke(ctx context.Context, obj *MediaObject, operation InvokeOperation, payload *json.RawMessage) error {
+	call := invokeCall{Object: obj.ID, Operation: string(operation), OperationParams: payload}
+	// the same marshaling as the client does, empty params fail here
+	raw, err := json.Marshal(&call)
+	if err != nil {
+		return err
+	}
+	call = invokeCall{}
+	if err = json.Unmarshal(raw, &call); err != nil {
+		return err
+	}
+	f.calls = append(f.calls, call)
+	if payload != nil {
+		*payload = json.RawMessage(f.result)
+	}
+	return nil
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		offer     string
+		operation InvokeOperation
+		params    string
+	}{
+		{`endpoint offers`, ``, GenerateOfferInvokeOperation, `{}`},
+		{`peer offers`, "v=0\r\n", ProcessOfferInvokeOperation, `{"offer":"v=0\r\n"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			session := &fakeSession{result: `"v=0 answer"`}
+			sdp, err := negotiate(context.Background(), session, &MediaObject{ID: `rtp`, Type: RtpEndpoint}, tc.offer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sdp != `v=0 answer` {
+				t.Errorf(`sdp is %q`, sdp)
+			}
+			if len(session.calls) != 1 {
+				t.Fatalf(`%d invokes`, len(session.calls))
+			}
+			call := session.calls[0]
+			if call.Operation != string(tc.operation) {
+				t.Errorf(`operation is %s, want %s`, call.Operation, tc.operation)
+			}
+			if call.OperationParams == nil || string(*call.OperationParams) != tc.params {
+				t.Errorf(`params are %s, want %s`, call.OperationParams, tc.params)
+			}
+		})
+	}
+}
+
+func TestAnswerRtp(t *testing.T) {
+	session := &fakeSession{}
+	room := NewRoom(session, SFURoomMode)
+	publisher := NewUser(`peer`, nil)
+	publisher.Virtual = true
+	publisher.In[DefaultStream] = &MediaObject{ID: `peer-in`, Type: RtpEndpoint}
+	subscriber := NewUser(`sub`, nil)
+	subscriber.Virtual = true
+	for _, sender := range []string{`alice`, `bob`, `carol`} {
+		subscriber.setOut(sender, DefaultStream, &MediaConnector{Point: &MediaObject{ID: sender + `-out`, Type: RtpEndpoint}})
+	}
+	room.AddUser(publisher)
+	room.AddUser(subscriber)
+	s := &service{lock: &sync.RWMutex{}, rooms: map[string]*Room{`room`: room}}
+
+	for _, tc := range []struct {
+		user, sender, object string
+	}{
+		{`peer`, ``, `peer-in`},
+		{`sub`, `alice`, `alice-out`},
+		{`sub`, `bob`, `bob-out`},
+		{`sub`, `carol`, `carol-out`},
+	} {
+		session.calls = nil
+		if err := s.answerRtp(context.Background(), `room`, tc.user, tc.sender, `v=0`); err != nil {
+			t.Fatalf(`%s %s: %s`, tc.user, tc.sender, err)
+		}
+		if len(session.calls) != 1 || session.calls[0].Object != tc.object {
+			t.Errorf(`%s %s: invokes %+v, want %s`, tc.user, tc.sender, session.calls, tc.object)
+		}
+	}
+
+	for _, tc := range []struct{ user, sender string }{
+		{`sub`, ``},
+		{`sub`, `dave`},
+		{`peer`, `alice`},
+	} {
+		if err := s.answerRtp(context.Background(), `room`, tc.user, tc.sender, `v=0`); err == nil {
+			t.Errorf(`%s %s: no error`, tc.user, tc.sender)
+		}
+	}
+}
+
+// TestRtpFfmpeg publishes a test pattern of a local ffmpeg into a room: the endpoint offers,
+// ffmpeg sends VP8 to it and the answer is given back by PUT. It needs ffmpeg on PATH and
+// the media server of KMS_TEST_URL (ws://localhost:8888/kurento by default), the variable is
+// outside the MADSQUID_ prefix, since the config rejects unknown MADSQUID_ variables.
+func TestRtpFfmpeg(t *testing.T) {
+	ffmpeg, err := exec.LookPath(`ffmpeg`)
+	if err != nil {
+		t.Skip(`ffmpeg is not on PATH`)
+	}
+	addr := os.Getenv(`KMS_TEST_URL`)
+	if addr == "" {
+		addr = `ws://localhost:8888/kurento`
+	}
+	dialer := &websocket.Dialer{HandshakeTimeout: time.Second}
+	ws, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		t.Skipf(`media server %s is not available: %s`, addr, err)
+	}
+	ws.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	config := DefaultClientConfig()
+	config.Addr = addr
+	svc, err := NewService(ctx, &ServiceConfig{Client: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := svc.(*service)
+	defer s.cli.Close()
+	session, err := s.cli.NewSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	room := NewRoom(session, SFURoomMode)
+	if err = session.Create(ctx, room.MediaPipeline); err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	s.rooms[`rtp-test`] = room
+	s.lock.Unlock()
+
+	serve := func(method, query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeRTP(rec, httptest.NewRequest(method, `/admin/rtp?room=rtp-test&user=ffmpeg`+query, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := serve(http.MethodPost, `&direction=publish`, ``)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf(`POST: %d %s`, rec.Code, rec.Body)
+	}
+	host, port, payloadType := videoTarget(rec.Body.String())
+	if port == "" || payloadType == "" {
+		t.Skipf(`offer of the endpoint has no VP8 video: %s`, rec.Body)
+	}
+
+	// ffmpeg sends from localPort, the answer tells the endpoint where RTP comes from
+	const localPort = 45004
+	answer := fmt.Sprintf("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=ffmpeg\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n"+
+		"m=audio 0 RTP/AVP 0\r\n"+
+		"m=video %d RTP/AVP %s\r\na=rtpmap:%s VP8/90000\r\na=sendonly\r\n", localPort, payloadType, payloadType)
+	if rec = serve(http.MethodPut, ``, answer); rec.Code != http.StatusNoContent {
+		t.Fatalf(`PUT: %d %s`, rec.Code, rec.Body)
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpeg, `-hide_banner`, `-loglevel`, `error`,
+		`-re`, `-f`, `lavfi`, `-i`, `testsrc=size=320x240:rate=15`, `-t`, `3`,
+		`-c:v`, `libvpx`, `-deadline`, `realtime`, `-payload_type`, payloadType,
+		`-f`, `rtp`, fmt.Sprintf(`rtp://%s:%s?localrtpport=%d`, host, port, localPort))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf(`ffmpeg: %s: %s`, err, out)
+	}
+
+	_, rtp, err := s.virtualUser(`rtp-test`, `ffmpeg`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	point, _ := rtp.stream(DefaultStream)
+	stats := json.RawMessage(`{"mediaType":"VIDEO"}`)
+	if err = session.Invoke(ctx, point, GetStatsInvokeOperation, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stats), `inboundrtp`) {
+		t.Errorf(`no inbound rtp in stats: %s`, stats)
+	}
+
+	if rec = serve(http.MethodDelete, ``, ``); rec.Code != http.StatusNoContent {
+		t.Fatalf(`DELETE: %d %s`, rec.Code, rec.Body)
+	}
+}
+
+// videoTarget returns the address, the port and the VP8 payload type of video of the SDP.
+func videoTarget(sdp string) (host, port, payloadType string) {
+	video := false
+	scanner := bufio.NewScanner(strings.NewReader(sdp))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, `c=IN IP4 `) && (host == "" || video):
+			host = strings.TrimPrefix(line, `c=IN IP4 `)
+		case strings.HasPrefix(line, `m=`):
+			fields := strings.Fields(line)
+			video = fields[0] == `m=video`
+			if video && len(fields) > 1 {
+				port = fields[1]
+			}
+		case video && strings.HasPrefix(line, `a=rtpmap:`) && strings.Contains(line, `VP8/90000`):
+			payloadType, _, _ = strings.Cut(strings.TrimPrefix(line, `a=rtpmap:`), ` `)
+		}
+	}
+	return host, port, payloadType
+}
@@ -3,14 +3,18 @@ package kurento
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"logging"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"redact"
+	"tracing"
 )
 
 var (
@@ -21,32 +25,72 @@ var (
 			return true
 		},
 	}
-
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 40 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	// (If you want send many tracks in one stream SDP may be very big)
-	maxMessageSize int64 = 8 * 1024
 )
 
-func NewService(ctx context.Context) (http.Handler, error) {
-	cli, err := New(ctx)
+// Service is the room service, it is a http.Handler of /kurento websockets.
+type Service interface {
+	http.Handler
+	// ServeSchema dumps rooms with their media objects, it is an admin route.
+	ServeSchema(rw http.ResponseWriter, r *http.Request)
+	// ServePlayers runs a player command (addPlayer, playPlayer...) posted as WsRequest
+	// in its room, it is an admin route.
+	ServePlayers(rw http.ResponseWriter, r *http.Request)
+	// ServeRTP connects external RTP peers to rooms by plain SDP, it is an admin route.
+	ServeRTP(rw http.ResponseWriter, r *http.Request)
+	// ServeToken mints join tokens for anyone, it is served in dev mode only.
+	ServeToken(rw http.ResponseWriter, r *http.Request)
+	// Shutdown stops accepting connections, asks clients to reconnect after reconnectAfter,
+	// waits rooms to drain until ctx is done and releases media of rooms left.
+	Shutdown(ctx context.Context, reconnectAfter time.Duration) error
+	// Reload applies settings to new rooms and commands, connections are kept.
+	Reload(config RuntimeConfig)
+	// Drain turns on (or off) drain mode: existing rooms continue, new rooms are rejected.
+	Drain(draining bool)
+	DrainStatus() DrainStatus
+}
+
+func NewService(ctx context.Context, config *ServiceConfig) (Service, error) {
+	if config.Client == nil {
+		config.Client = DefaultClientConfig()
+	}
+	if config.WebSocket == nil {
+		config.WebSocket = DefaultWebSocketConfig()
+	}
+	if config.Runtime.RecordingURI == "" {
+		config.Runtime.RecordingURI = DefaultRecordingURI
+	}
+	if config.Runtime.Policy == nil {
+		config.Runtime.Policy = DefaultPolicy()
+	}
+	if config.Client.Redact == nil {
+		config.Client.Redact = config.Redact
+	}
+	if config.Client.Logger == nil {
+		config.Client.Logger = config.Logger
+	}
+	if config.Client.Metrics == nil {
+		config.Client.Metrics = config.Metrics
+	}
+	cli, err := New(ctx, config.Client)
 	if err != nil {
 		return nil, err
 	}
 
-	return &service{
-		cli:   cli,
-		lock:  &sync.RWMutex{},
-		rooms: make(map[string]*Room, 0),
-	}, nil
+	s := &service{
+		cli:     cli,
+		redact:  config.Redact,
+		log:     logging.OrDefault(config.Logger).With(logging.Component, `rooms`),
+		tracer:  config.Tracer,
+		ws:      *config.WebSocket,
+		runtime: config.Runtime,
+		lock:    &sync.RWMutex{},
+		rooms:   make(map[string]*Room, 0),
+		conns:   make(map[*User]struct{}, 0),
+	}
+	registerServiceMetrics(config.Metrics, s)
+	registerServiceChecks(config.Health, s)
+
+	return s, nil
 }
 
 /*
@@ -89,11 +133,23 @@ func NewService(ctx context.Context) (http.Handler, error) {
 */
 
 type service struct {
-	cli Kurento
+	cli    Kurento
+	redact *redact.Redactor
+	log    *slog.Logger
+	tracer *tracing.Tracer
+	ws     WebSocketConfig
 
 	lock *sync.RWMutex
+	// runtime settings, guarded by lock
+	runtime RuntimeConfig
 	// rooms registry
 	rooms map[string]*Room
+	// conns: users of open websockets, joined to a room or not
+	conns map[*User]struct{}
+	// shutdown: new websockets are rejected
+	shutdown bool
+	// draining: new rooms are rejected
+	draining bool
 }
 
 type WsCmd string
@@ -109,6 +165,8 @@ const (
 	IceCandidateWsCmd          WsCmd = `iceCandidate`
 	leaveWsCmd                 WsCmd = `leave`
 	hangupWsCmd                WsCmd = `hangup`
+	ServerShutdownWsCmd        WsCmd = `serverShutdown`
+	IceServersWsCmd            WsCmd = `iceServers`
 )
 
 type WsRequest struct {
@@ -116,11 +174,30 @@ type WsRequest struct {
 
 	Room string `json:"room,omitempty"`
 	User string `json:"user,omitempty"`
+	// Mode of a new room in joinRoom, see RoomMode
+	Mode string `json:"mode,omitempty"`
+	// Role asked in joinRoom (viewer) or given by setRole
+	Role string `json:"role,omitempty"`
 
 	Sender   string `json:"sender,omitempty"`
 	SdpOffer string `json:"sdpOffer,omitempty"`
+	// Stream of the sender, DefaultStream when it is empty
+	Stream string `json:"stream,omitempty"`
 
 	Candidate *json.RawMessage `json:"candidate,omitempty"`
+
+	// Token: signed join token of joinRoom, see package jointoken
+	Token string `json:"token,omitempty"`
+
+	// Media of mute and unmute: audio or video
+	Media string `json:"media,omitempty"`
+	// Text of sendMessage
+	Text string `json:"text,omitempty"`
+
+	// Uri, Loop and Position are params of player commands
+	Uri      string `json:"uri,omitempty"`
+	Loop     bool   `json:"loop,omitempty"`
+	Position int64  `json:"position,omitempty"`
 }
 
 type WsErrAnswer struct {
@@ -129,19 +206,19 @@ type WsErrAnswer struct {
 }
 
 /*
- мы просто слушаем вебсокет
+	мы просто слушаем вебсокет
 
- потом пользователь присылает нам
+	потом пользователь присылает нам
 
- -> {"cmd":"joinRoom","room":"Room Name","user":"user1"}
+	-> {"cmd":"joinRoom","room":"Room Name","user":"user1"}
 
- мы смотрим существует ли комната (если нет то создаем и медиа пайп в меди сервере)
+	мы смотрим существует ли комната (если нет то создаем и медиа пайп в меди сервере)
 
- <- {"cmd":"existingParticipants","data":["test2","test1"]} // OR <- {"cmd":"existingParticipants","data":[]}
+	<- {"cmd":"existingParticipants","data":["test2","test1"]} // OR <- {"cmd":"existingParticipants","data":[]}
 
- далее пользователь должен отправить нам свой оффео для того чтобы начали получать от него стрим иначе никто его не увидит
+	далее пользователь должен отправить нам свой оффео для того чтобы начали получать от него стрим иначе никто его не увидит
 
- -> {"cmd":"receiveVideoFrom","sender":"user1","sdpOffer":"v=0\r\no=- 8086186447058305456 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE audio video\r\na=msid-semantic: WMS VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\nm=audio 58610 UDP/TLS/RTP/SAVPF 111 103 104 9 0 8 106 105 13 110 112 113 126\r\nc=IN IP4 10.1.10.37\r\na=rtcp:9 IN IP4 0.0.0.0\r\na=candidate:3883225187 1 udp 2122260223 10.1.10.37 58610 typ host generation 0 network-id 1\r\na=ice-ufrag:tIed\r\na=ice-pwd:LJ2l0LfqHstmOEiXI8YvWHsG\r\na=fingerprint:sha-256 9C:A0:CF:54:7D:40:3E:AB:2A:76:33:ED:62:BB:08:78:C1:D5:65:A1:83:7E:19:5C:86:1F:19:3C:FE:5D:08:C3\r\na=setup:actpass\r\na=mid:audio\r\na=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\na=sendonly\r\na=rtcp-mux\r\na=rtpmap:111 opus/48000/2\r\na=rtcp-fb:111 transport-cc\r\na=fmtp:111 minptime=10;useinbandfec=1\r\na=rtpmap:103 ISAC/16000\r\na=rtpmap:104 ISAC/32000\r\na=rtpmap:9 G722/8000\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\na=rtpmap:106 CN/32000\r\na=rtpmap:105 CN/16000\r\na=rtpmap:13 CN/8000\r\na=rtpmap:110 telephone-event/48000\r\na=rtpmap:112 telephone-event/32000\r\na=rtpmap:113 telephone-event/16000\r\na=rtpmap:126 telephone-event/8000\r\na=ssrc:585125553 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:585125553 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s 5233a3e1-e203-4e54-ad23-fae53fbd6274\r\na=ssrc:585125553 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:585125553 label:5233a3e1-e203-4e54-ad23-fae53fbd6274\r\nm=video 55247 UDP/TLS/RTP/SAVPF 96 98 100 102 127 97 99 101 125\r\nc=IN IP4 10.1.10.37\r\na=rtcp:9 IN IP4 0.0.0.0\r\na=candidate:3883225187 1 udp 2122260223 10.1.10.37 55247 typ host generation 0 network-id 1\r\na=ice-ufrag:tIed\r\na=ice-pwd:LJ2l0LfqHstmOEiXI8YvWHsG\r\na=fingerprint:sha-256 9C:A0:CF:54:7D:40:3E:AB:2A:76:33:ED:62:BB:08:78:C1:D5:65:A1:83:7E:19:5C:86:1F:19:3C:FE:5D:08:C3\r\na=setup:actpass\r\na=mid:video\r\na=extmap:2 urn:ietf:params:rtp-hdrext:toffset\r\na=extmap:3 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\r\na=extmap:4 urn:3gpp:video-orientation\r\na=extmap:5 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\na=extmap:6 http://www.webrtc.org/experiments/rtp-hdrext/playout-delay\r\na=sendonly\r\na=rtcp-mux\r\na=rtcp-rsize\r\na=rtpmap:96 VP8/90000\r\na=rtcp-fb:96 ccm fir\r\na=rtcp-fb:96 nack\r\na=rtcp-fb:96 nack pli\r\na=rtcp-fb:96 goog-remb\r\na=rtcp-fb:96 transport-cc\r\na=rtpmap:98 VP9/90000\r\na=rtcp-fb:98 ccm fir\r\na=rtcp-fb:98 nack\r\na=rtcp-fb:98 nack pli\r\na=rtcp-fb:98 goog-remb\r\na=rtcp-fb:98 transport-cc\r\na=rtpmap:100 H264/90000\r\na=rtcp-fb:100 ccm fir\r\na=rtcp-fb:100 nack\r\na=rtcp-fb:100 nack pli\r\na=rtcp-fb:100 goog-remb\r\na=rtcp-fb:100 transport-cc\r\na=fmtp:100 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\na=rtpmap:102 red/90000\r\na=rtpmap:127 ulpfec/90000\r\na=rtpmap:97 rtx/90000\r\na=fmtp:97 apt=96\r\na=rtpmap:99 rtx/90000\r\na=fmtp:99 apt=98\r\na=rtpmap:101 rtx/90000\r\na=fmtp:101 apt=100\r\na=rtpmap:125 rtx/90000\r\na=fmtp:125 apt=102\r\na=ssrc-group:FID 3716766466 3368104928\r\na=ssrc:3716766466 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:3716766466 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3716766466 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:3716766466 label:a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3368104928 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:3368104928 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3368104928 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:3368104928 label:a6358110-8b42-459a-83aa-bca8c8cab150\r\n"}
+	-> {"cmd":"receiveVideoFrom","sender":"user1","sdpOffer":"v=0\r\no=- 8086186447058305456 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\na=group:BUNDLE audio video\r\na=msid-semantic: WMS VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\nm=audio 58610 UDP/TLS/RTP/SAVPF 111 103 104 9 0 8 106 105 13 110 112 113 126\r\nc=IN IP4 10.1.10.37\r\na=rtcp:9 IN IP4 0.0.0.0\r\na=candidate:3883225187 1 udp 2122260223 10.1.10.37 58610 typ host generation 0 network-id 1\r\na=ice-ufrag:tIed\r\na=ice-pwd:LJ2l0LfqHstmOEiXI8YvWHsG\r\na=fingerprint:sha-256 9C:A0:CF:54:7D:40:3E:AB:2A:76:33:ED:62:BB:08:78:C1:D5:65:A1:83:7E:19:5C:86:1F:19:3C:FE:5D:08:C3\r\na=setup:actpass\r\na=mid:audio\r\na=extmap:1 urn:ietf:params:rtp-hdrext:ssrc-audio-level\r\na=sendonly\r\na=rtcp-mux\r\na=rtpmap:111 opus/48000/2\r\na=rtcp-fb:111 transport-cc\r\na=fmtp:111 minptime=10;useinbandfec=1\r\na=rtpmap:103 ISAC/16000\r\na=rtpmap:104 ISAC/32000\r\na=rtpmap:9 G722/8000\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\na=rtpmap:106 CN/32000\r\na=rtpmap:105 CN/16000\r\na=rtpmap:13 CN/8000\r\na=rtpmap:110 telephone-event/48000\r\na=rtpmap:112 telephone-event/32000\r\na=rtpmap:113 telephone-event/16000\r\na=rtpmap:126 telephone-event/8000\r\na=ssrc:585125553 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:585125553 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s 5233a3e1-e203-4e54-ad23-fae53fbd6274\r\na=ssrc:585125553 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:585125553 label:5233a3e1-e203-4e54-ad23-fae53fbd6274\r\nm=video 55247 UDP/TLS/RTP/SAVPF 96 98 100 102 127 97 99 101 125\r\nc=IN IP4 10.1.10.37\r\na=rtcp:9 IN IP4 0.0.0.0\r\na=candidate:3883225187 1 udp 2122260223 10.1.10.37 55247 typ host generation 0 network-id 1\r\na=ice-ufrag:tIed\r\na=ice-pwd:LJ2l0LfqHstmOEiXI8YvWHsG\r\na=fingerprint:sha-256 9C:A0:CF:54:7D:40:3E:AB:2A:76:33:ED:62:BB:08:78:C1:D5:65:A1:83:7E:19:5C:86:1F:19:3C:FE:5D:08:C3\r\na=setup:actpass\r\na=mid:video\r\na=extmap:2 urn:ietf:params:rtp-hdrext:toffset\r\na=extmap:3 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time\r\na=extmap:4 urn:3gpp:video-orientation\r\na=extmap:5 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01\r\na=extmap:6 http://www.webrtc.org/experiments/rtp-hdrext/playout-delay\r\na=sendonly\r\na=rtcp-mux\r\na=rtcp-rsize\r\na=rtpmap:96 VP8/90000\r\na=rtcp-fb:96 ccm fir\r\na=rtcp-fb:96 nack\r\na=rtcp-fb:96 nack pli\r\na=rtcp-fb:96 goog-remb\r\na=rtcp-fb:96 transport-cc\r\na=rtpmap:98 VP9/90000\r\na=rtcp-fb:98 ccm fir\r\na=rtcp-fb:98 nack\r\na=rtcp-fb:98 nack pli\r\na=rtcp-fb:98 goog-remb\r\na=rtcp-fb:98 transport-cc\r\na=rtpmap:100 H264/90000\r\na=rtcp-fb:100 ccm fir\r\na=rtcp-fb:100 nack\r\na=rtcp-fb:100 nack pli\r\na=rtcp-fb:100 goog-remb\r\na=rtcp-fb:100 transport-cc\r\na=fmtp:100 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f\r\na=rtpmap:102 red/90000\r\na=rtpmap:127 ulpfec/90000\r\na=rtpmap:97 rtx/90000\r\na=fmtp:97 apt=96\r\na=rtpmap:99 rtx/90000\r\na=fmtp:99 apt=98\r\na=rtpmap:101 rtx/90000\r\na=fmtp:101 apt=100\r\na=rtpmap:125 rtx/90000\r\na=fmtp:125 apt=102\r\na=ssrc-group:FID 3716766466 3368104928\r\na=ssrc:3716766466 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:3716766466 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3716766466 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:3716766466 label:a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3368104928 cname:dcqNeJ+yAB5VNYWu\r\na=ssrc:3368104928 msid:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s a6358110-8b42-459a-83aa-bca8c8cab150\r\na=ssrc:3368104928 mslabel:VZYx5AI05sUhSjKTISF9VpNJtTzc1ikz6y7s\r\na=ssrc:3368104928 label:a6358110-8b42-459a-83aa-bca8c8cab150\r\n"}
 
 на сервере мы видим что пользователь отправил нам сам от себя, то есть
 
@@ -155,29 +232,45 @@ user1 -> for user2 значит первый пользователь хочет
 1 - проверяем что user2 существует и у его есть точка в медиа пайпе
 2 - создаем новую webrtcX точку и коннектим её к  user2.webrtcIn
 3 - процессим оффер для webrtcX пользователя user1
-
 */
+func (s *service) ServeSchema(rw http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	rooms := make(map[string]*Room, len(s.rooms))
+	for name, room := range s.rooms {
+		rooms[name] = room
+	}
+	s.lock.RUnlock()
+	// commands change rooms and users under their locks, so snapshots are encoded instead
+	for name, room := range rooms {
+		rooms[name] = room.snapshot()
+	}
+	rw.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(rw).Encode(rooms)
+}
+
 func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	if strings.Contains(r.URL.Path, `_schema`) {
-		s.lock.RLock()
-		json.NewEncoder(rw).Encode(s.rooms)
-		s.lock.RUnlock()
+	s.lock.RLock()
+	shutdown := s.shutdown
+	s.lock.RUnlock()
+	if shutdown {
+		http.Error(rw, ErrShutdown.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
 	wsConn, err := upgrader.Upgrade(rw, r, nil)
 	if err != nil {
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		s.log.Warn(`websocket upgrade failed`, logging.Error, s.redact.Error(err))
+		return
 	}
 	defer wsConn.Close()
 
-	wsConn.SetReadLimit(maxMessageSize)
-	wsConn.SetReadDeadline(time.Now().Add(pongWait))
-	wsConn.SetPongHandler(func(string) error { wsConn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	wsConn.SetReadLimit(s.ws.MaxMessageSize)
+	wsConn.SetReadDeadline(time.Now().Add(s.ws.PongWait))
+	wsConn.SetPongHandler(func(string) error { wsConn.SetReadDeadline(time.Now().Add(s.ws.PongWait)); return nil })
 	ctx := r.Context()
 
 	go func() {
-		ticker := time.NewTicker(pingPeriod)
+		ticker := time.NewTicker(s.ws.pingPeriod())
 		defer func() {
 			ticker.Stop()
 			wsConn.Close()
@@ -186,8 +279,8 @@ func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		for {
 			select {
 			case <-ticker.C:
-				if err := wsConn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-					log.Printf("WEBSOCKET PING ERROR: %s", err)
+				if err := wsConn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(s.ws.WriteWait)); err != nil {
+					s.log.Debug(`websocket ping failed`, logging.Error, s.redact.Error(err))
 					return
 				}
 
@@ -204,7 +297,7 @@ func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			// get offer and send to media server
 			err := wsConn.ReadJSON(wsReq)
 			if err != nil {
-				log.Println("read:", err)
+				s.log.Debug(`websocket read failed`, logging.Error, s.redact.Error(err))
 				close(messages)
 				break
 			}
@@ -212,12 +305,21 @@ func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	currentUser := NewUser("", wsConn, nil)
+	currentUser := NewUser("", wsConn)
+	s.lock.Lock()
+	s.conns[currentUser] = struct{}{}
+	iceServers := s.runtime.ICEServers
+	s.lock.Unlock()
+	s.sendIceServers(currentUser, iceServers)
 
 	defer func(user *User) {
+		s.lock.Lock()
+		delete(s.conns, user)
+		s.lock.Unlock()
+
 		err = s.leave(context.Background(), user)
 		if err != nil {
-			log.Printf(`can't correct leave current session of user %s(%s)': %s`, currentUser.name, currentUser.roomName, err)
+			s.userLog(user).Warn(`can't correct leave current session`, logging.Error, s.redact.Error(err))
 		}
 	}(currentUser)
 	for {
@@ -228,68 +330,121 @@ func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			if !ok {
 				return
 			}
-			log.Printf("start processed %s", wsReq.Cmd)
-
-			switch wsReq.Cmd {
-			case JoinRoomWsCmd:
-				log.Print("started call joinRoom")
-				err = s.joinRoom(ctx, currentUser, wsReq)
-				log.Print("ended call joinRoom")
-			case ReceiveVideoFromWsCmd:
-				log.Print("started call receiveVideoFrom")
-				err = s.receiveVideoFrom(ctx, currentUser, wsReq)
-				log.Print("ended call receiveVideoFrom")
-			case OnIceCandidateWsCmd:
-				log.Print("started call onIceCandidate")
-				err = s.onIceCandidate(ctx, currentUser, wsReq)
-				log.Print("ended call onIceCandidate")
-			case leaveWsCmd:
-				log.Print("started call leaveWsCmd")
-				err = s.leave(ctx, currentUser)
-				log.Print("ended call leaveWsCmd")
-			case hangupWsCmd:
-				log.Print("started call hangupWsCmd")
-				err = s.hangUp(ctx, currentUser, wsReq)
-				log.Print("ended call hangupWsCmd")
+			requestID := uuid.New()
+			cmdCtx, span := s.tracer.Start(ctx, `ws.`+string(wsReq.Cmd))
+			span.SetAttr(logging.RequestID, requestID)
+			span.SetAttr(logging.Room, currentUser.roomName)
+			span.SetAttr(logging.User, s.redact.User(currentUser.name))
+
+			cmdLog := s.userLog(currentUser).With(logging.Cmd, wsReq.Cmd, logging.RequestID, requestID)
+			if span != nil {
+				cmdLog = cmdLog.With(`trace_id`, span.TraceID().String())
+			}
+			cmdLog.Debug(`started cmd`)
+			started := time.Now()
+
+			// права пользователя проверяются до выполнения команды
+			err = s.authorize(currentUser, wsReq)
+			if err == nil {
+				switch wsReq.Cmd {
+				case JoinRoomWsCmd:
+					err = s.joinRoom(cmdCtx, currentUser, wsReq)
+				case ReceiveVideoFromWsCmd:
+					err = s.receiveVideoFrom(cmdCtx, currentUser, wsReq)
+				case OnIceCandidateWsCmd:
+					err = s.onIceCandidate(cmdCtx, currentUser, wsReq)
+				case leaveWsCmd:
+					err = s.leave(cmdCtx, currentUser)
+				case hangupWsCmd:
+					err = s.hangUp(cmdCtx, currentUser, wsReq)
+				case UnpublishWsCmd:
+					err = s.unpublish(cmdCtx, currentUser, wsReq)
+				case MuteWsCmd, UnmuteWsCmd:
+					err = s.mute(cmdCtx, currentUser, wsReq)
+				case StartRecordingWsCmd:
+					err = s.startRecording(cmdCtx, currentUser, wsReq)
+				case StopRecordingWsCmd:
+					err = s.stopRecording(cmdCtx, currentUser, wsReq)
+				case AddPlayerWsCmd, RemovePlayerWsCmd, PlayPlayerWsCmd, PausePlayerWsCmd, SeekPlayerWsCmd:
+					err = s.playerCmd(cmdCtx, currentUser.roomName, wsReq)
+				case TakePresenterWsCmd:
+					err = s.takePresenter(cmdCtx, currentUser, wsReq)
+				case HandOverPresenterWsCmd:
+					err = s.handOverPresenter(cmdCtx, currentUser, wsReq)
+				case KickWsCmd:
+					err = s.kick(cmdCtx, currentUser, wsReq)
+				case LockRoomWsCmd, UnlockRoomWsCmd:
+					err = s.lockRoom(cmdCtx, currentUser, wsReq)
+				case EndMeetingWsCmd:
+					err = s.endMeeting(cmdCtx, currentUser, wsReq)
+				case TransferOwnershipWsCmd:
+					err = s.transferOwnership(cmdCtx, currentUser, wsReq)
+				case SetRoleWsCmd:
+					err = s.setUserRole(cmdCtx, currentUser, wsReq)
+				case SendMessageWsCmd:
+					err = s.sendMessage(cmdCtx, currentUser, wsReq)
+				default:
+					err = fmt.Errorf(`unknown cmd %s`, wsReq.Cmd)
+				}
 			}
+			cmdLog.Debug(`ended cmd`, `duration`, time.Since(started))
+			if err != nil {
+				span.SetError(errors.New(s.redact.Error(err)))
+			}
+			span.End()
 
 			// error processing
 			if err != nil {
-				log.Printf(`cmd:%s: err: %s`, wsReq.Cmd, err)
-				wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-				err = wsConn.WriteJSON(&WsErrAnswer{Request: wsReq, Error: err.Error()})
+				cmdLog.Warn(`cmd failed`, logging.Error, s.redact.Error(err))
+				var answer interface{} = &WsErrAnswer{Request: wsReq, Error: err.Error()}
+				var denied *PermissionError
+				if errors.As(err, &denied) {
+					answer = denied.answer(wsReq)
+				}
+				err = s.send(currentUser, answer)
 				if err != nil {
-					log.Printf(`can't write to web socket: %s'`, err)
+					cmdLog.Warn(`can't write to web socket`, logging.Err(err))
 					return
 				}
 			}
 
 		case <-ctx.Done():
-			err := ctx.Err()
-			log.Printf(`context of web socket is done: %s`, err)
+			s.userLog(currentUser).Debug(`context of web socket is done`, logging.Err(ctx.Err()))
 			return
 		}
 	}
 }
 
-func (s *service) hangUp(ctx context.Context, currentUser *User, req *WsRequest) error {
-	currentUser.lock.RLock()
-	connector, ok := currentUser.Out[req.Sender]
-	currentUser.lock.RUnlock()
+// userLog returns logger with fields of the user.
+func (s *service) userLog(u *User) *slog.Logger {
+	return s.log.With(logging.Room, u.roomName, logging.User, s.redact.User(u.name))
+}
+
+// userRoom returns the room where the user has joined.
+func (s *service) userRoom(currentUser *User, cmd WsCmd) (*Room, error) {
+	s.lock.RLock()
+	currentRoom, ok := s.rooms[currentUser.roomName]
+	s.lock.RUnlock()
 
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("currentRoom %s for req %s is nil ", currentUser.roomName, cmd)
 	}
+	return currentRoom, nil
+}
 
-	// удаяем точку выхода этого пользователя для себя
-	err := s.cli.Release(ctx, connector.Point)
+func (s *service) hangUp(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
 	if err != nil {
 		return err
 	}
 
-	currentUser.lock.Lock()
-	delete(currentUser.Out, req.Sender)
-	currentUser.lock.Unlock()
+	// удаяем точку выхода этого пользователя для себя
+	for _, connector := range currentUser.deleteOut(req.Sender, streamName(req.Stream)) {
+		err = currentRoom.session.Release(ctx, connector.Point)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -297,35 +452,53 @@ func (s *service) hangUp(ctx context.Context, currentUser *User, req *WsRequest)
 type ExistingParticipantsForm struct {
 	Cmd  WsCmd    `json:"cmd"`
 	Data []string `json:"data"`
+	// Mode: in MCU rooms the client receives MixSender instead of every participant
+	Mode RoomMode `json:"mode"`
+	// Presenter of broadcast rooms
+	Presenter string `json:"presenter,omitempty"`
+	// Streams: published streams by user
+	Streams map[string][]string `json:"streams"`
+	// Names: display names of users joined by tokens
+	Names map[string]string `json:"names,omitempty"`
 }
 
 type NewParticipantArrivedForm struct {
-	Cmd  WsCmd  `json:"cmd"`
-	Name string `json:"name"`
+	Cmd         WsCmd  `json:"cmd"`
+	Name        string `json:"name"`
+	Stream      string `json:"stream"`
+	DisplayName string `json:"displayName,omitempty"`
 }
 
-//{"id":"receiveVideoAnswer","name":"test1","sdpAnswer":
+// {"id":"receiveVideoAnswer","name":"test1","sdpAnswer":
 type ReceiveVideoAnswerForm struct {
 	Cmd       WsCmd            `json:"cmd"`
 	Name      string           `json:"name"`
+	Stream    string           `json:"stream"`
 	SdpAnswer *json.RawMessage `json:"sdpAnswer"`
 }
 
 func (s *service) onIceCandidate(ctx context.Context, currentUser *User, req *WsRequest) error {
-	var err error
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+
+	stream := streamName(req.Stream)
 	if currentUser.name == req.Sender {
-		err = s.cli.Invoke(ctx, currentUser.In, AddIceCandidateInvokeOperation, req.Candidate)
+		in, ok := currentUser.stream(stream)
+		if !ok {
+			return fmt.Errorf("[%s] stream %s of user %s is not published", req.Cmd, stream, s.redact.User(currentUser.name))
+		}
+		err = currentRoom.session.Invoke(ctx, in, AddIceCandidateInvokeOperation, req.Candidate)
 		if err != nil {
 			return err
 		}
 	} else {
-		currentUser.lock.Lock()
-		connectorMedia, ok := currentUser.Out[req.Sender]
-		currentUser.lock.Unlock()
+		connectorMedia, ok := currentUser.out(req.Sender, stream)
 		if !ok {
-			return fmt.Errorf("[%s] user %s not found in out %s ", req.Cmd, req.Sender, currentUser.name)
+			return fmt.Errorf("[%s] user %s stream %s not found in out %s ", req.Cmd, s.redact.User(req.Sender), stream, s.redact.User(currentUser.name))
 		}
-		err = s.cli.Invoke(ctx, connectorMedia.Point, AddIceCandidateInvokeOperation, req.Candidate)
+		err = currentRoom.session.Invoke(ctx, connectorMedia.Point, AddIceCandidateInvokeOperation, req.Candidate)
 		if err != nil {
 			return err
 		}
@@ -334,82 +507,126 @@ func (s *service) onIceCandidate(ctx context.Context, currentUser *User, req *Ws
 	return nil
 }
 
+// ParticipantLeavedForm: the user has left, or has stopped Stream when it is set.
 type ParticipantLeavedForm struct {
-	Cmd  WsCmd  `json:"cmd"`
-	Name string `json:"name"`
+	Cmd    WsCmd  `json:"cmd"`
+	Name   string `json:"name"`
+	Stream string `json:"stream,omitempty"`
 }
 
 func (s *service) leave(ctx context.Context, currentUser *User) error {
 	if currentUser == nil {
-		return fmt.Errorf("currentUser for req %s is nil for leave ")
+		return fmt.Errorf("currentUser for req %s is nil ", leaveWsCmd)
 	}
 
-	s.lock.Lock()
-	currentRoom, ok := s.rooms[currentUser.roomName]
-	s.lock.Unlock()
+	currentRoom, err := s.userRoom(currentUser, leaveWsCmd)
+	if err != nil {
+		return err
+	}
 
 	var userName = currentUser.name
-	if !ok {
-		return fmt.Errorf("currentRoom %s for req %s is nil ", currentUser.roomName, "leave")
-	}
 	if !currentRoom.HasUser(userName) {
 		return nil
 	}
 
+	// media of the user are detached under the lock and released after it,
+	// so slow calls to KMS don't block other commands of the room
 	var removeRoomNeeded = false
 	currentRoom.lock.Lock()
 	delete(currentRoom.Users, userName)
-	err := s.cli.Release(ctx, currentUser.In)
-	if err != nil {
-		log.Printf("ERR: can't release object %s", currentUser.In.ID)
+	recorders := detachRecorders(currentRoom, currentUser, "")
+	var objects []*MediaObject
+	currentUser.lock.RLock()
+	for _, in := range currentUser.In {
+		objects = append(objects, in)
+	}
+	if currentUser.Port != nil {
+		objects = append(objects, currentUser.Port)
 	}
-
 	// удаляем видео которе стримят к нашему пользователю другие пользователи
-	for _, connector := range currentUser.Out {
-		err := s.cli.Release(ctx, connector.Point)
-		if err != nil {
-			log.Printf("ERR: can't release object %s", connector.Point.ID)
+	for _, streams := range currentUser.Out {
+		for _, connector := range streams {
+			objects = append(objects, connector.Point)
 		}
 	}
+	currentUser.lock.RUnlock()
 	// удалем видео нашего пользователя которое стримется другим пользователям
+	others := make([]*User, 0, len(currentRoom.Users))
 	for _, user := range currentRoom.Users {
-		user.lock.RLock()
-		connectToUser, ok := user.Out[userName]
-		user.lock.RUnlock()
+		for _, connectToUser := range user.deleteOut(userName, "") {
+			objects = append(objects, connectToUser.Point)
+		}
+		others = append(others, user)
+	}
 
-		if ok {
-			err := s.cli.Release(ctx, connectToUser.Point)
-			if err != nil {
-				log.Printf("ERR: can't release object %s", connectToUser.Point.ID)
-			}
+	presenterLeft := currentRoom.Presenter == userName
+	if presenterLeft {
+		currentRoom.Presenter = ""
+	}
+	// the room is not left without an owner
+	var owner *User
+	if currentUser.role() == OwnerRole {
+		owner = successor(currentRoom)
+	}
+	if currentRoom.source == userName {
+		currentRoom.source = ""
+	}
+	// players are not left alone in the room
+	humans := 0
+	for _, user := range currentRoom.Users {
+		if !user.Virtual {
+			humans++
+		}
+	}
+	if humans == 0 {
+		removeRoomNeeded = true
+		for _, user := range currentRoom.Users {
+			user.stop()
+		}
+		if currentRoom.Recording != nil {
+			currentRoom.Recording.cancel()
+			currentRoom.Recording = nil
+		}
+	}
+	currentRoom.lock.Unlock()
 
-			user.lock.Lock()
-			delete(user.Out, userName)
-			user.lock.Unlock()
+	// files are finished before In is released
+	s.stopRecorders(ctx, currentRoom, currentUser, recorders)
+	for _, obj := range objects {
+		if err := currentRoom.session.Release(ctx, obj); err != nil {
+			s.userLog(currentUser).Warn(`can't release object`, logging.KMSObject, obj.ID, logging.Err(err))
 		}
-		// точки нет , но нужно донести на UI
-		user.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-		user.lock.Lock()
-		_ = user.wsConn.WriteJSON(&ParticipantLeavedForm{
+	}
+	// точки нет , но нужно донести на UI
+	for _, user := range others {
+		_ = s.send(user, &ParticipantLeavedForm{
 			Cmd:  ParticipantLeavedWsCmd,
 			Name: userName,
 		})
-		user.lock.Unlock()
 	}
 
-	if len(currentRoom.Users) == 0 {
-		removeRoomNeeded = true
+	if presenterLeft && !removeRoomNeeded {
+		// viewers may take the role
+		s.broadcast(currentRoom, &PresenterChangedForm{Cmd: PresenterChangedWsCmd})
+	}
+	if owner != nil {
+		s.changeRole(currentRoom, owner, OwnerRole)
 	}
-	currentRoom.lock.Unlock()
 
 	if removeRoomNeeded {
-		err := s.cli.Release(ctx, currentRoom.MediaPipeline)
+		err := currentRoom.session.Release(ctx, currentRoom.MediaPipeline)
 		if err != nil {
-			log.Printf("ERR: can't release object %s", currentRoom.MediaPipeline.ID)
+			s.userLog(currentUser).Warn(`can't release object`, logging.KMSObject, currentRoom.MediaPipeline.ID, logging.Err(err))
 		}
 		s.lock.Lock()
 		delete(s.rooms, currentUser.roomName)
 		s.lock.Unlock()
+
+		// releases all objects left in the session of the room
+		err = currentRoom.session.Close()
+		if err != nil {
+			s.userLog(currentUser).Warn(`can't close session of room`, logging.Err(err))
+		}
 	}
 
 	return nil
@@ -418,6 +635,7 @@ func (s *service) leave(ctx context.Context, currentUser *User) error {
 type IceCandidateAnswer struct {
 	Cmd       WsCmd            `json:"cmd"`
 	Name      string           `json:"name"`
+	Stream    string           `json:"stream"`
 	Candidate *json.RawMessage `json:"candidate"`
 }
 
@@ -426,38 +644,93 @@ func (s *service) receiveVideoFrom(ctx context.Context, currentUser *User, req *
 		return fmt.Errorf("currentUser for req %s is nil ", req.Cmd)
 	}
 
-	s.lock.Lock()
-	currentRoom, ok := s.rooms[currentUser.roomName]
-	s.lock.Unlock()
-
-	if !ok {
-		return fmt.Errorf("currentRoom %s for req %s is nil ", currentUser.roomName, req.Cmd)
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
 	}
 
 	var (
-		err               error
 		sinkMediaObject   *MediaObject
 		needNotification  bool
 		AnswerForUserName = req.Sender
+		stream            = streamName(req.Stream)
+		// drop releases the endpoint of the request and forgets it, if the request fails after its creation
+		drop = func() {}
 	)
 
-	log.Printf("currentUser.name %s <=> %s", currentUser.name, req.Sender)
+	s.userLog(currentUser).Debug(`receive video`, `sender`, s.redact.User(req.Sender), `stream`, stream)
 	if currentUser.name == req.Sender {
 		needNotification = true
 
-		err = s.cli.Create(ctx, currentUser.In)
+		currentRoom.lock.RLock()
+		presenter := currentRoom.Presenter
+		currentRoom.lock.RUnlock()
+		if currentRoom.Mode == BroadcastRoomMode && presenter != currentUser.name {
+			return fmt.Errorf(`only the presenter publishes in room %s`, currentUser.roomName)
+		}
+
+		// хаб принимает один поток от пользователя
+		if currentRoom.Hub != nil && stream != DefaultStream {
+			return fmt.Errorf(`room %s is %s, publish %s only`, currentUser.roomName, currentRoom.Mode, DefaultStream)
+		}
+		if _, ok := currentUser.stream(stream); ok {
+			return fmt.Errorf(`stream %s of user %s is already published`, stream, s.redact.User(currentUser.name))
+		}
+
+		sinkMediaObject = &MediaObject{
+			Parent: currentRoom.MediaPipeline,
+			Type:   WebRtcEndpoint,
+		}
+		err = currentRoom.session.Create(ctx, sinkMediaObject)
+		if err != nil {
+			return err
+		}
+		currentUser.lock.Lock()
+		currentUser.In[stream] = sinkMediaObject
+		currentUser.lock.Unlock()
+		drop = func() {
+			currentUser.lock.Lock()
+			delete(currentUser.In, stream)
+			currentUser.lock.Unlock()
+			_ = currentRoom.session.Release(ctx, sinkMediaObject)
+		}
+
+		switch currentRoom.Mode {
+		case MCURoomMode:
+			err = s.mixIn(ctx, currentRoom, currentUser)
+		case BroadcastRoomMode:
+			err = s.present(ctx, currentRoom, currentUser)
+		}
+		if err != nil {
+			drop()
+			return err
+		}
+
+	} else if currentRoom.Hub != nil {
+		// в комнате с хабом пользователь получает только поток хаба
+		if req.Sender != currentRoom.hubSender() {
+			return fmt.Errorf(`room %s is %s, receive %s instead of %s`, currentUser.roomName, currentRoom.Mode, currentRoom.hubSender(), s.redact.User(req.Sender))
+		}
+		sinkMediaObject, err = s.hubOut(ctx, currentRoom, currentUser, WebRtcEndpoint)
 		if err != nil {
 			return err
 		}
-		sinkMediaObject = currentUser.In
+		drop = func() {
+			for _, connector := range currentUser.deleteOut(currentRoom.hubSender(), DefaultStream) {
+				_ = currentRoom.session.Release(ctx, connector.Point)
+			}
+		}
 
 	} else {
 		currentRoom.lock.RLock()
 		sourceUser, ok := currentRoom.Users[req.Sender]
 		currentRoom.lock.RUnlock()
 		if !ok {
-			raw, _ := json.MarshalIndent(currentRoom, "", "\t")
-			return fmt.Errorf("can't find user %s in room : %s", req.Sender, string(raw))
+			return fmt.Errorf("can't find user %s in room : %s", s.redact.User(req.Sender), s.redact.Dump(currentRoom.snapshot()))
+		}
+		sourceIn, ok := sourceUser.stream(stream)
+		if !ok {
+			return fmt.Errorf("stream %s of user %s is not published", stream, s.redact.User(req.Sender))
 		}
 
 		sinkMediaObject = &MediaObject{
@@ -465,7 +738,7 @@ func (s *service) receiveVideoFrom(ctx context.Context, currentUser *User, req *
 			Type:   WebRtcEndpoint,
 		}
 
-		err = s.cli.Create(ctx, sinkMediaObject)
+		err = currentRoom.session.Create(ctx, sinkMediaObject)
 		if err != nil {
 			return err
 		}
@@ -478,26 +751,36 @@ func (s *service) receiveVideoFrom(ctx context.Context, currentUser *User, req *
 
 		raw, err := json.Marshal(sink)
 		if err != nil {
+			_ = currentRoom.session.Release(ctx, sinkMediaObject)
 			return err
 		}
 
 		payload := &json.RawMessage{}
 		_ = payload.UnmarshalJSON(raw)
-		err = s.cli.Invoke(ctx, sourceUser.In, ConnectInvokeOperation, payload)
+		err = currentRoom.session.Invoke(ctx, sourceIn, ConnectInvokeOperation, payload)
 		if err != nil {
+			_ = currentRoom.session.Release(ctx, sinkMediaObject)
+			return err
+		}
+		if err = s.keepMuted(ctx, currentRoom, sourceUser, stream, sinkMediaObject); err != nil {
+			_ = currentRoom.session.Release(ctx, sinkMediaObject)
 			return err
 		}
 
-		currentUser.lock.Lock()
-		currentUser.Out[sourceUser.name] = &MediaConnector{
+		currentUser.setOut(sourceUser.name, stream, &MediaConnector{
 			Point:  sinkMediaObject,
-			Source: sourceUser.In,
+			Source: sourceIn,
+		})
+		drop = func() {
+			for _, connector := range currentUser.deleteOut(sourceUser.name, stream) {
+				_ = currentRoom.session.Release(ctx, connector.Point)
+			}
 		}
-		currentUser.lock.Unlock()
 	}
 
-	eventIceCandidateFound, err := s.cli.Subscribe(ctx, sinkMediaObject, IceCandidateFound)
+	eventIceCandidateFound, err := currentRoom.session.Subscribe(ctx, sinkMediaObject, IceCandidateFound)
 	if err != nil {
+		drop()
 		return err
 	}
 
@@ -508,41 +791,41 @@ func (s *service) receiveVideoFrom(ctx context.Context, currentUser *User, req *
 			_ = json.Unmarshal(event, answer)
 			answer.Cmd = IceCandidateWsCmd
 			answer.Name = AnswerForUserName
-			currentUser.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-			currentUser.lock.Lock()
-			_ = currentUser.wsConn.WriteJSON(answer)
-			currentUser.lock.Unlock()
+			answer.Stream = stream
+			_ = s.send(currentUser, answer)
 		}
 	}()
 
 	raw, err := json.Marshal(map[string]string{"offer": req.SdpOffer})
 	if err != nil {
+		drop()
 		return err
 	}
 
 	payload := &json.RawMessage{}
 	_ = payload.UnmarshalJSON(raw)
 	// process Offer
-	err = s.cli.Invoke(ctx, sinkMediaObject, ProcessOfferInvokeOperation, payload)
+	err = currentRoom.session.Invoke(ctx, sinkMediaObject, ProcessOfferInvokeOperation, payload)
 	if err != nil {
+		drop()
 		return err
 	}
 
-	currentUser.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-	currentUser.lock.Lock()
-	err = currentUser.wsConn.WriteJSON(&ReceiveVideoAnswerForm{
+	err = s.send(currentUser, &ReceiveVideoAnswerForm{
 		Cmd:       ReceiveVideoAnswerWsCmd,
 		Name:      AnswerForUserName,
+		Stream:    stream,
 		SdpAnswer: payload,
 	})
-	currentUser.lock.Unlock()
 	if err != nil {
+		drop()
 		return err
 	}
 
 	// fire event!
-	err = s.cli.Invoke(ctx, sinkMediaObject, GatherCandidatesInvokeOperation, nil)
+	err = currentRoom.session.Invoke(ctx, sinkMediaObject, GatherCandidatesInvokeOperation, nil)
 	if err != nil {
+		drop()
 		return err
 	}
 
@@ -550,81 +833,178 @@ func (s *service) receiveVideoFrom(ctx context.Context, currentUser *User, req *
 		return nil
 	}
 
+	// late publishers of a recorded room are recorded too
+	currentRoom.lock.RLock()
+	recording := currentRoom.Recording
+	currentRoom.lock.RUnlock()
+	if recording != nil {
+		if err := s.record(ctx, currentRoom, recording, currentUser, stream); err != nil {
+			s.userLog(currentUser).Warn(`can't record user`, logging.Error, s.redact.Error(err))
+		}
+	}
+
 	// NOTIFICATION
 	// только после того как пользователь создал webrct создедиение - мы говорим что он есть
 	users := []string{}
+	streams := map[string][]string{}
+	names := map[string]string{}
 	//time.Sleep(100 * time.Millisecond)
 	for _, user := range currentRoom.ListUsers() {
 		if user.name == currentUser.name {
 			continue
 		}
 
-		user.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-		user.lock.Lock()
-		err = user.wsConn.WriteJSON(&NewParticipantArrivedForm{
-			Cmd:  NewParticipantArrivedWsCmd,
-			Name: currentUser.name,
+		err = s.send(user, &NewParticipantArrivedForm{
+			Cmd:         NewParticipantArrivedWsCmd,
+			Name:        currentUser.name,
+			Stream:      stream,
+			DisplayName: currentUser.DisplayName,
 		})
-		user.lock.Unlock()
 		if err != nil {
 			continue
 		}
-		if len(user.In.ID) != 0 {
+		if !user.IsEmptyIn() {
 			users = append(users, user.name)
+			streams[user.name] = user.streams()
+			if user.DisplayName != "" {
+				names[user.name] = user.DisplayName
+			}
 		}
 	}
 
 	// и отправляем ему данные о других практикантах
-	currentUser.wsConn.SetWriteDeadline(time.Now().Add(writeWait))
-	currentUser.lock.Lock()
-	err = currentUser.wsConn.WriteJSON(&ExistingParticipantsForm{
-		Cmd:  ExistingParticipantsWsCmd,
-		Data: users,
+	return s.send(currentUser, &ExistingParticipantsForm{
+		Cmd:       ExistingParticipantsWsCmd,
+		Data:      users,
+		Mode:      currentRoom.Mode,
+		Presenter: currentRoom.Presenter,
+		Streams:   streams,
+		Names:     names,
 	})
-	currentUser.lock.Unlock()
-
-	return err
 }
 
 func (s *service) joinRoom(ctx context.Context, currentUser *User, req *WsRequest) error {
 	var (
-		err  error
 		room *Room
 		ok   bool
 	)
 
+	// room and user of the token are trusted, not those of the client
+	claims, err := s.verifyJoin(req)
+	if err != nil {
+		return err
+	}
+
 	s.lock.Lock()
 	room, ok = s.rooms[req.Room]
+	shutdown, draining, limits, rooms := s.shutdown, s.draining, s.runtime.Limits, len(s.rooms)
 	s.lock.Unlock()
 
+	mode, err := roomMode(req.Mode)
+	if err != nil {
+		return err
+	}
+	if req.Room == "" || req.User == "" {
+		return errors.New(`room and user are required`)
+	}
+	if ok && req.Mode != "" && room.Mode != mode {
+		return fmt.Errorf(`room %s is %s, not %s`, req.Room, room.Mode, mode)
+	}
+	if req.User == MixSender || req.User == PresenterSender {
+		return fmt.Errorf(`user name %s is reserved`, req.User)
+	}
+	if !ok && shutdown {
+		return ErrShutdown
+	}
+	if !ok && draining {
+		return ErrDraining
+	}
+	if !ok && limits.MaxRooms != 0 && rooms >= limits.MaxRooms {
+		return fmt.Errorf(`limit of rooms %d is reached`, limits.MaxRooms)
+	}
+	var joined *Room
+	if ok {
+		joined = room
+	}
+	role, err := joinRole(joined, req, claims)
+	if err != nil {
+		return err
+	}
 	if !ok {
-		room = NewRoom()
-		err = s.cli.Create(ctx, room.MediaPipeline)
+		// every room owns its KMS session, so problems of one room don't touch others
+		session, err := s.cli.NewSession(ctx)
+		if err != nil {
+			return err
+		}
+		room = NewRoom(session, mode)
+		if mode == BroadcastRoomMode {
+			// the user creating the room presents first
+			room.Presenter = req.User
+		}
+		err = session.Create(ctx, room.MediaPipeline)
 		if err != nil {
+			session.Close()
 			return err
 		}
+		if hubType(mode) != "" {
+			room.Hub = &MediaObject{
+				Parent: room.MediaPipeline,
+				Type:   hubType(mode),
+			}
+			err = session.Create(ctx, room.Hub)
+			if err != nil {
+				session.Close()
+				return err
+			}
+		}
 		// устанавливаем рум без пользователя
 		// пользователь появиться после того как там появиться webrtcEndpoint
 		// но таким образом пользоватль может присоеденить туда в любой момент - хоть все сразу(после лока :)))))
 		s.lock.Lock()
-		s.rooms[req.Room] = room
+		_, taken := s.rooms[req.Room]
+		if !taken {
+			s.rooms[req.Room] = room
+		}
 		s.lock.Unlock()
-	} else {
-		if room.HasUser(req.User) {
-			return fmt.Errorf(`user %s already exist in room %s`, req.User, req.Room)
+		if taken {
+			// another user has created the room meanwhile: its media are released
+			// and the user joins that room as others do
+			session.Close()
+			return s.joinRoom(ctx, currentUser, req)
 		}
 	}
 
 	// JOIN, BUT HIDE
+	// the user is not in a room yet, so its fields are restored if the room doesn't take it
+	roomName, name, previousRole := currentUser.roomName, currentUser.name, currentUser.role()
+	displayName, capabilities := currentUser.DisplayName, currentUser.Capabilities
 	currentUser.roomName = req.Room
 	currentUser.name = req.User
-	currentUser.In = &MediaObject{
-		Parent: room.MediaPipeline,
-		Type:   WebRtcEndpoint,
+	currentUser.setRole(role)
+	if claims != nil {
+		currentUser.DisplayName = claims.Name
+		currentUser.Capabilities = claims.Capabilities
 	}
 
-	room.AddUser(currentUser)
+	if err = room.addUser(currentUser, limits.MaxParticipants); err != nil {
+		currentUser.roomName, currentUser.name = roomName, name
+		currentUser.setRole(previousRole)
+		currentUser.DisplayName, currentUser.Capabilities = displayName, capabilities
+		if errors.Is(err, errUserExists) {
+			return fmt.Errorf(`user %s already exist in room %s`, s.redact.User(req.User), req.Room)
+		}
+		return fmt.Errorf(`limit of participants %d of room %s is reached`, limits.MaxParticipants, req.Room)
+	}
+	s.userLog(currentUser).Info(`user joined`, `role`, role, `token`, claims != nil)
+	if role == OwnerRole {
+		s.takeOwnership(room, currentUser)
+	}
+	s.sendRoles(room, currentUser)
+	s.sendMediaStates(room, currentUser)
 
+	if room.Mode == BroadcastRoomMode {
+		return s.sendRoomState(room, currentUser)
+	}
 	return nil
 }
 
@@ -663,39 +1043,79 @@ func (s *service) joinRoom(ctx context.Context, currentUser *User, req *WsReques
     }
 */
 
+// connect connects source to sink, the source sends its media to the sink.
+func connect(ctx context.Context, session Session, source, sink *MediaObject) error {
+	raw, err := json.Marshal(map[string]string{"sink": sink.ID})
+	if err != nil {
+		return err
+	}
+	payload := &json.RawMessage{}
+	_ = payload.UnmarshalJSON(raw)
+	return session.Invoke(ctx, source, ConnectInvokeOperation, payload)
+}
+
 type MediaConnector struct {
 	Point  *MediaObject `json:"point"`
 	Source *MediaObject `json:"source"`
 }
 
-func NewUser(name string, c *websocket.Conn, in *MediaObject) *User {
+func NewUser(name string, c *websocket.Conn) *User {
 	return &User{
-		name:   name,
-		wsConn: c,
-		lock:   &sync.RWMutex{},
-		In:     in,
-		Out:    make(map[string]*MediaConnector, 0),
+		name:      name,
+		wsConn:    c,
+		lock:      &sync.RWMutex{},
+		portLock:  &sync.Mutex{},
+		writeLock: &sync.Mutex{},
+		stop:      func() {},
+		Role:      ParticipantRole,
+		In:        make(map[string]*MediaObject, 0),
+		Out:       make(map[string]map[string]*MediaConnector, 0),
 	}
 }
 
 type User struct {
 	name string        `json:"-"`
 	lock *sync.RWMutex `json:"-"`
-	// websocket
-	wsConn *websocket.Conn `json:"-"`
-	// in stream
-	In       *MediaObject               `json:"in"`
-	Out      map[string]*MediaConnector `json:"out"`
-	roomName string                     `json:"-"`
+	// websocket, it is written by send under writeLock, lock guards state of the user only
+	wsConn    *websocket.Conn `json:"-"`
+	writeLock *sync.Mutex     `json:"-"`
+	// In: published streams by stream name
+	In map[string]*MediaObject `json:"in"`
+	// Port: port of the user in the hub of the room, nil in SFU rooms
+	Port *MediaObject `json:"port,omitempty"`
+	// portLock: the port is created once by hubPort
+	portLock *sync.Mutex `json:"-"`
+	// Role of the user in the room
+	Role Role `json:"role"`
+	// DisplayName and Capabilities are claims of the join token,
+	// nil Capabilities mean capabilities of the role by the policy
+	DisplayName  string   `json:"display_name,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Virtual: the user is a player or an RTP peer, DefaultStream of In is its PlayerEndpoint or RtpEndpoint
+	Virtual bool `json:"virtual,omitempty"`
+	// Loop: the player is restarted on EndOfStream
+	Loop bool `json:"loop,omitempty"`
+	// stop: stops listening events of the player
+	stop context.CancelFunc
+	// Muted: media types muted by mute, by stream name
+	Muted map[string]map[MediaKind]bool `json:"muted,omitempty"`
+	// Out: received streams by sender, then by stream name
+	Out      map[string]map[string]*MediaConnector `json:"out"`
+	roomName string                                `json:"-"`
 }
 
+// IsEmptyIn: the user has not published any stream.
 func (u *User) IsEmptyIn() bool {
-	return len(u.In.ID) == 0
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	return len(u.In) == 0
 }
 
-func NewRoom() *Room {
+func NewRoom(session Session, mode RoomMode) *Room {
 	return &Room{
 		lock:          &sync.RWMutex{},
+		session:       session,
+		Mode:          mode,
 		MediaPipeline: &MediaObject{Type: MediaPipeline},
 		Users:         make(map[string]*User, 0),
 	}
@@ -703,10 +1123,24 @@ func NewRoom() *Room {
 
 type Room struct {
 	lock *sync.RWMutex `json:"-"`
+	// KMS session of the room, owns all media objects of the room
+	session Session `json:"-"`
 	// link to media pipe line
 	MediaPipeline *MediaObject `json:"media_pipeline"`
+	Mode          RoomMode     `json:"mode"`
+	// Hub: Composite mixing streams of MCU rooms or DispatcherOneToMany of broadcast rooms, nil in SFU rooms
+	Hub *MediaObject `json:"hub,omitempty"`
+	// Presenter: user which publishes in broadcast rooms
+	Presenter string `json:"presenter,omitempty"`
+	// Locked: new users can't join
+	Locked bool `json:"locked,omitempty"`
+	// source: user which In is the source of the dispatcher, it differs from Presenter
+	// until the new presenter publishes
+	source string
 	// users of room
 	Users map[string]*User `json:"users"`
+	// Recording: nil when the room is not recorded
+	Recording *Recording `json:"recording,omitempty"`
 }
 
 func (r *Room) ListUsers() []*User {
@@ -719,6 +1153,94 @@ func (r *Room) ListUsers() []*User {
 	return users
 }
 
+// send writes the form to the websocket of the user, virtual users have no websocket.
+// Every write goes here: the websocket has one writer at a time.
+func (s *service) send(user *User, form interface{}) error {
+	if user.Virtual {
+		return nil
+	}
+	user.writeLock.Lock()
+	defer user.writeLock.Unlock()
+	user.wsConn.SetWriteDeadline(time.Now().Add(s.ws.WriteWait))
+	return user.wsConn.WriteJSON(form)
+}
+
+// broadcast sends the form to every user of the room.
+func (s *service) broadcast(r *Room, form interface{}) {
+	for _, user := range r.ListUsers() {
+		if err := s.send(user, form); err != nil {
+			s.userLog(user).Debug(`can't write to web socket`, logging.Err(err))
+		}
+	}
+}
+
+// snapshot copies the room with its users and recording for encoding, the room is read under room.lock
+// and every user under its lock.
+func (r *Room) snapshot() *Room {
+	r.lock.RLock()
+	room := *r
+	room.lock = &sync.RWMutex{}
+	room.Users = make(map[string]*User, len(r.Users))
+	for name, user := range r.Users {
+		room.Users[name] = user
+	}
+	if r.Recording != nil {
+		recording := *r.Recording
+		recording.Recorders = make(map[string]map[string]*MediaObject, len(r.Recording.Recorders))
+		for name, streams := range r.Recording.Recorders {
+			recording.Recorders[name] = make(map[string]*MediaObject, len(streams))
+			for stream, recorder := range streams {
+				recording.Recorders[name][stream] = recorder
+			}
+		}
+		room.Recording = &recording
+	}
+	r.lock.RUnlock()
+
+	for name, user := range room.Users {
+		room.Users[name] = user.snapshot()
+	}
+	return &room
+}
+
+// snapshot copies the user with its streams under user.lock.
+func (u *User) snapshot() *User {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	user := &User{
+		name:         u.name,
+		lock:         &sync.RWMutex{},
+		In:           make(map[string]*MediaObject, len(u.In)),
+		Port:         u.Port,
+		Role:         u.Role,
+		DisplayName:  u.DisplayName,
+		Capabilities: u.Capabilities,
+		Virtual:      u.Virtual,
+		Loop:         u.Loop,
+		Out:          make(map[string]map[string]*MediaConnector, len(u.Out)),
+		roomName:     u.roomName,
+	}
+	for stream, in := range u.In {
+		user.In[stream] = in
+	}
+	for sender, streams := range u.Out {
+		user.Out[sender] = make(map[string]*MediaConnector, len(streams))
+		for stream, out := range streams {
+			user.Out[sender][stream] = out
+		}
+	}
+	if u.Muted != nil {
+		user.Muted = make(map[string]map[MediaKind]bool, len(u.Muted))
+		for stream, kinds := range u.Muted {
+			user.Muted[stream] = make(map[MediaKind]bool, len(kinds))
+			for kind, muted := range kinds {
+				user.Muted[stream][kind] = muted
+			}
+		}
+	}
+	return user
+}
+
 func (r *Room) HasUser(name string) bool {
 	r.lock.RLock()
 	_, ok := r.Users[name]
@@ -731,3 +1253,23 @@ func (r *Room) AddUser(u *User) {
 	r.Users[u.name] = u
 	r.lock.Unlock()
 }
+
+var (
+	errUserExists = errors.New(`user exists`)
+	errRoomIsFull = errors.New(`room is full`)
+)
+
+// addUser adds the user unless the room has a user of its name or maxParticipants users (0 is no limit).
+// Checks and the insert are one step, so concurrent joins can't replace each other or exceed the limit.
+func (r *Room) addUser(u *User, maxParticipants int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.Users[u.name]; ok {
+		return errUserExists
+	}
+	if maxParticipants != 0 && len(r.Users) >= maxParticipants {
+		return errRoomIsFull
+	}
+	r.Users[u.name] = u
+	return nil
+}
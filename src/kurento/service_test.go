@@ -0,0 +1,113 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http/httptest"
+	"redact"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestServeSchema encodes rooms while users join, publish, receive and mute (run it with -race).
+func TestServeSchema(t *testing.T) {
+	room := NewRoom(&fakeSession{}, SFURoomMode)
+	s := &service{lock: &sync.RWMutex{}, rooms: map[string]*Room{`room`: room}}
+	alice := NewUser(`alice`, nil)
+	room.AddUser(alice)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			user := NewUser(fmt.Sprintf(`user%d`, i), nil)
+			room.AddUser(user)
+			alice.setOut(user.name, DefaultStream, &MediaConnector{Point: &MediaObject{ID: user.name + `-out`}})
+			alice.setMuted(DefaultStream, AudioMedia, i%2 == 0)
+			alice.lock.Lock()
+			alice.In[fmt.Sprintf(`stream%d`, i)] = &MediaObject{ID: user.name + `-in`}
+			alice.lock.Unlock()
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		rec := httptest.NewRecorder()
+		s.ServeSchema(rec, httptest.NewRequest(`GET`, `/_schema`, nil))
+		rooms := map[string]json.RawMessage{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &rooms); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(rooms[`room`]), `"alice"`) {
+			t.Fatalf(`schema has no alice: %s`, rec.Body)
+		}
+	}
+}
+
+// TestAddUser joins users concurrently: one user of a name and no more than the limit are taken.
+func TestAddUser(t *testing.T) {
+	const limit = 5
+	room := NewRoom(&fakeSession{}, SFURoomMode)
+	var (
+		wg             sync.WaitGroup
+		lock           sync.Mutex
+		joined, exists int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := room.addUser(NewUser(fmt.Sprintf(`user%d`, i%10), nil), limit)
+			lock.Lock()
+			defer lock.Unlock()
+			switch err {
+			case nil:
+				joined++
+			case errUserExists:
+				exists++
+			case errRoomIsFull:
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if joined != limit || len(room.ListUsers()) != limit {
+		t.Errorf(`%d users joined, %d are in the room, want %d`, joined, len(room.ListUsers()), limit)
+	}
+	if exists == 0 {
+		t.Error(`no join is refused for the taken name`)
+	}
+}
+
+// TestReceiveVideoFromReleasesSink fails the request after the sink is created: the sink is released and forgotten.
+func TestReceiveVideoFromReleasesSink(t *testing.T) {
+	session := &fakeSession{}
+	room := NewRoom(session, SFURoomMode)
+	s := &service{lock: &sync.RWMutex{}, rooms: map[string]*Room{`room`: room}, log: slog.Default(), redact: redact.New(false)}
+	alice, bob := NewUser(`alice`, nil), NewUser(`bob`, nil)
+	alice.roomName, bob.roomName = `room`, `room`
+	room.AddUser(alice)
+	room.AddUser(bob)
+	in := &MediaObject{ID: `alice-in`}
+	alice.In[DefaultStream] = in
+
+	// fakeSession doesn't subscribe, so the request fails after connect
+	err := s.receiveVideoFrom(context.Background(), bob, &WsRequest{Cmd: ReceiveVideoFromWsCmd, Sender: `alice`})
+	if err == nil {
+		t.Fatal(`no error`)
+	}
+	if _, ok := bob.out(`alice`, DefaultStream); ok {
+		t.Error(`failed sink is kept by the user`)
+	}
+	if len(session.released) != 1 || session.released[0] == in {
+		t.Errorf(`released %v, want the sink`, session.released)
+	}
+}
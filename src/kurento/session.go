@@ -0,0 +1,395 @@
+package kurento
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"logging"
+	"sync"
+	"time"
+)
+
+// releaseTimeout limits cleanup calls made on behalf of a closed session.
+var releaseTimeout = 5 * time.Second
+
+var ErrSessionClosed = errors.New(`kurento session is closed`)
+
+func newSession(cli *kurentoClient, id string) *session {
+	ctx, cancel := context.WithCancel(cli.cctx)
+	return &session{
+		cli:     cli,
+		log:     cli.log.With(`kms_session`, id),
+		ctx:     ctx,
+		cancel:  cancel,
+		id:      id,
+		objects: make([]*MediaObject, 0),
+	}
+}
+
+// session keeps all mutable state of one KMS session under its own lock.
+type session struct {
+	cli    *kurentoClient
+	log    *slog.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock sync.RWMutex
+	id   string
+	// created and not released objects in order of creation
+	objects []*MediaObject
+	closed  bool
+
+	subscriptions sync.WaitGroup
+}
+
+func (s *session) ID() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.id
+}
+
+// setID stores session id answered by KMS (it may be renewed by the server).
+func (s *session) setID(id string) {
+	if id == "" {
+		return
+	}
+	s.lock.Lock()
+	s.id = id
+	s.lock.Unlock()
+}
+
+// call sends request in context of the session.
+func (s *session) call(ctx context.Context, method string, operation InvokeOperation, params interface{}) (json.RawMessage, error) {
+	ctx, cancel := mergeDone(ctx, s.ctx)
+	defer cancel()
+	return s.cli.call(ctx, method, operation, params)
+}
+
+func (s *session) Create(ctx context.Context, obj *MediaObject) error {
+	constructorParams, err := s.cli.types.constructorParams(obj)
+	if err != nil {
+		return err
+	}
+	params := &struct {
+		Type              MediaType              `json:"type"`
+		SessionID         string                 `json:"sessionId"`
+		Properties        map[string]string      `json:"properties"`
+		ConstructorParams map[string]interface{} `json:"constructorParams"`
+	}{
+		Type:              obj.Type,
+		SessionID:         s.ID(),
+		Properties:        make(map[string]string, 0),
+		ConstructorParams: constructorParams,
+	}
+
+	raw, err := s.call(ctx, `create`, "", params)
+	if err != nil {
+		return err
+	}
+	result := &struct {
+		Value     string `json:"value"`
+		SessionID string `json:"sessionId"`
+	}{}
+	err = json.Unmarshal(raw, result)
+	if err != nil {
+		return err
+	}
+	obj.ID = result.Value
+
+	s.lock.Lock()
+	if result.SessionID != "" {
+		s.id = result.SessionID
+	}
+	s.objects = append(s.objects, obj)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *session) Invoke(ctx context.Context, obj *MediaObject, operation InvokeOperation, buffer *json.RawMessage) error {
+	if err := s.cli.types.checkOperation(obj.Type, operation); err != nil {
+		return err
+	}
+	params := &struct {
+		Object          string           `json:"object"`
+		Operation       string           `json:"operation"`
+		OperationParams *json.RawMessage `json:"operationParams,omitempty"`
+		SessionID       string           `json:"sessionId"`
+	}{
+		Object:          obj.ID,
+		Operation:       string(operation),
+		OperationParams: buffer,
+		SessionID:       s.ID(),
+	}
+
+	raw, err := s.call(ctx, `invoke`, operation, params)
+	if err != nil {
+		return err
+	}
+	result := &struct {
+		Value     *json.RawMessage `json:"value"`
+		SessionID string           `json:"sessionId"`
+	}{}
+	err = json.Unmarshal(raw, result)
+	if err != nil {
+		return err
+	}
+	s.setID(result.SessionID)
+	if result.Value != nil && buffer != nil {
+		*buffer = *result.Value
+	}
+	return nil
+}
+
+func (s *session) Subscribe(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan []byte, error) {
+	if _, err := s.cli.types.eventType(obj.Type, topic); err != nil {
+		return nil, err
+	}
+	//registry subscribe path to route queue before subscription, first events come right after answer
+	// KMS sends an event once per subscription, so the topic is subscribed once and its events
+	// are given to every subscriber
+	topicUrl := obj.ID + `/` + string(topic)
+	topicChannel := make(chan *event, 100)
+	s.cli.topicsLock.Lock()
+	topicSubs, ok := s.cli.topics[topicUrl]
+	if !ok {
+		topicSubs = &topicSubscription{subscribed: make(chan struct{})}
+		s.cli.topics[topicUrl] = topicSubs
+	}
+	topicSubs.channels = append(topicSubs.channels, topicChannel)
+	s.cli.topicsLock.Unlock()
+
+	// removeTopic removes the channel of the subscriber, the last one unsubscribes
+	removeTopic := func() {
+		s.cli.topicsLock.Lock()
+		channels := make([]chan *event, 0, len(topicSubs.channels))
+		for _, c := range topicSubs.channels {
+			if c != topicChannel {
+				channels = append(channels, c)
+			}
+		}
+		topicSubs.channels = channels
+		last := len(channels) == 0
+		if last && s.cli.topics[topicUrl] == topicSubs {
+			delete(s.cli.topics, topicUrl)
+		}
+		id := topicSubs.id
+		s.cli.topicsLock.Unlock()
+		if !last || id == "" {
+			return
+		}
+		uctx, cancel := context.WithTimeout(s.cli.cctx, releaseTimeout)
+		defer cancel()
+		if err := s.unsubscribe(uctx, obj, id); err != nil {
+			s.log.Warn(`unsubscribe failed`, `topic`, topicUrl, logging.Err(err))
+		}
+	}
+
+	if !ok {
+		id, err := s.subscribe(ctx, obj, topic)
+		s.cli.topicsLock.Lock()
+		topicSubs.id, topicSubs.err = id, err
+		s.cli.topicsLock.Unlock()
+		close(topicSubs.subscribed)
+	}
+	select {
+	case <-topicSubs.subscribed:
+	case <-ctx.Done():
+		removeTopic()
+		return nil, ctx.Err()
+	}
+	s.cli.topicsLock.RLock()
+	err := topicSubs.err
+	s.cli.topicsLock.RUnlock()
+	if err != nil {
+		removeTopic()
+		return nil, err
+	}
+
+	outBuffer := make(chan []byte, 100)
+	s.subscriptions.Add(1)
+	go func() {
+		defer s.subscriptions.Done()
+		defer close(outBuffer)
+		defer removeTopic()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ctx.Done():
+				return
+			case event := <-topicChannel:
+				if event.Value.Data == nil {
+					continue
+				}
+				select {
+				case outBuffer <- *event.Value.Data:
+				default:
+					s.cli.m.droppedEvents.Inc(`full`)
+					s.log.Warn(`subscriber buffer is full, event was dropped`, `topic`, topicUrl, `event`, s.cli.config.Redact.JSON(event))
+				}
+			}
+		}
+	}()
+
+	return outBuffer, nil
+}
+
+// subscribe subscribes to the topic of the object on KMS and returns the subscription id.
+func (s *session) subscribe(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (string, error) {
+	params := &struct {
+		Type      SubscribeTopic `json:"type"`
+		Object    string         `json:"object"`
+		SessionID string         `json:"sessionId"`
+	}{
+		Type:      topic,
+		Object:    obj.ID,
+		SessionID: s.ID(),
+	}
+
+	raw, err := s.call(ctx, `subscribe`, "", params)
+	if err != nil {
+		return "", err
+	}
+	result := &struct {
+		Value     string `json:"value"`
+		SessionID string `json:"sessionId"`
+	}{}
+	if err = json.Unmarshal(raw, result); err != nil {
+		return "", err
+	}
+	s.setID(result.SessionID)
+	return result.Value, nil
+}
+
+func (s *session) SubscribeEvents(ctx context.Context, obj *MediaObject, topic SubscribeTopic) (<-chan interface{}, error) {
+	eventType, err := s.cli.types.eventType(obj.Type, topic)
+	if err != nil {
+		return nil, err
+	}
+	in, err := s.Subscribe(ctx, obj, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan interface{}, cap(in))
+	go func() {
+		defer close(out)
+		for data := range in {
+			v, err := eventType.decode(data)
+			if err != nil {
+				s.cli.m.droppedEvents.Inc(`decode`)
+				s.log.Warn(`can't decode event`, logging.KMSObject, obj.ID, `topic`, topic, logging.Err(err))
+				continue
+			}
+			out <- v
+		}
+	}()
+	return out, nil
+}
+
+func (s *session) unsubscribe(ctx context.Context, obj *MediaObject, subscriptionID string) error {
+	params := &struct {
+		Subscription string `json:"subscription"`
+		Object       string `json:"object"`
+		SessionID    string `json:"sessionId"`
+	}{
+		Subscription: subscriptionID,
+		Object:       obj.ID,
+		SessionID:    s.ID(),
+	}
+
+	// works after session close too: it is a part of the cleanup
+	_, err := s.cli.call(ctx, `unsubscribe`, "", params)
+	return err
+}
+
+func (s *session) Release(ctx context.Context, obj *MediaObject) error {
+	err := s.release(ctx, obj)
+	if err != nil {
+		return err
+	}
+	s.forget(obj)
+	return nil
+}
+
+func (s *session) release(ctx context.Context, obj *MediaObject) error {
+	params := &struct {
+		Object    string `json:"object"`
+		SessionID string `json:"sessionId"`
+	}{
+		Object:    obj.ID,
+		SessionID: s.ID(),
+	}
+
+	raw, err := s.cli.call(ctx, `release`, "", params)
+	if err != nil {
+		return err
+	}
+	result := &struct {
+		SessionID string `json:"sessionId"`
+	}{}
+	if len(raw) != 0 {
+		if err = json.Unmarshal(raw, result); err != nil {
+			return err
+		}
+	}
+	s.setID(result.SessionID)
+	return nil
+}
+
+// forget removes released object (and its children) from the session.
+func (s *session) forget(obj *MediaObject) {
+	s.lock.Lock()
+	objects := s.objects[:0]
+	for _, o := range s.objects {
+		if o == obj || o.Parent == obj {
+			continue
+		}
+		objects = append(objects, o)
+	}
+	s.objects = objects
+	s.lock.Unlock()
+}
+
+// Close stops subscriptions and releases the objects left in the session,
+// children first.
+func (s *session) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrSessionClosed
+	}
+	s.closed = true
+	objects := s.objects
+	s.objects = nil
+	s.lock.Unlock()
+
+	s.cancel()
+	s.subscriptions.Wait()
+
+	var err error
+	for i := len(objects) - 1; i >= 0; i-- {
+		obj := objects[i]
+		ctx, cancel := context.WithTimeout(s.cli.cctx, releaseTimeout)
+		if rerr := s.release(ctx, obj); rerr != nil {
+			s.log.Warn(`can't release object`, logging.KMSObject, obj.ID, logging.Err(rerr))
+			err = rerr
+		}
+		cancel()
+	}
+	return err
+}
+
+// mergeDone returns context which is done when any of parents is done.
+func mergeDone(ctx, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,89 @@
+package kurento
+
+import (
+	"context"
+	"errors"
+	kurentows "kurento/websocket"
+	"logging"
+	"time"
+)
+
+// ErrShutdown is returned to new connections and rooms during shutdown.
+var ErrShutdown = errors.New(`server is shutting down`)
+
+// drainCheckPeriod is the period of checks that all rooms have left during shutdown.
+const drainCheckPeriod = 500 * time.Millisecond
+
+// ServerShutdownForm asks the client to reconnect (to another instance) after ReconnectAfter seconds.
+type ServerShutdownForm struct {
+	Cmd            WsCmd `json:"cmd"`
+	ReconnectAfter int   `json:"reconnectAfter"`
+}
+
+func (s *service) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	s.lock.Lock()
+	s.shutdown = true
+	users := make([]*User, 0, len(s.conns))
+	for user := range s.conns {
+		users = append(users, user)
+	}
+	s.lock.Unlock()
+
+	s.log.Info(`shutting down`, `connections`, len(users), `rooms`, s.count().rooms)
+	for _, user := range users {
+		err := s.send(user, &ServerShutdownForm{
+			Cmd:            ServerShutdownWsCmd,
+			ReconnectAfter: int(reconnectAfter / time.Second),
+		})
+		if err != nil {
+			s.userLog(user).Debug(`can't notify about shutdown`, logging.Err(err))
+		}
+	}
+
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+wait:
+	for s.count().rooms != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	// rooms which have not drained in time lose their media
+	s.lock.Lock()
+	rooms := s.rooms
+	s.rooms = make(map[string]*Room, 0)
+	s.lock.Unlock()
+	if len(rooms) != 0 {
+		s.log.Warn(`rooms have not drained, releasing their media`, `rooms`, len(rooms))
+	}
+	for name, room := range rooms {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		// recordings are finished before their pipelines are released, so their files are complete
+		if recording := s.finishRecording(releaseCtx, room, s.log.With(logging.Room, name)); recording != nil {
+			s.log.Info(`recording stopped by shutdown`, logging.Room, name, `duration`, time.Since(recording.Started))
+		}
+		err := room.session.Release(releaseCtx, room.MediaPipeline)
+		if err != nil {
+			s.log.Warn(`can't release object`, logging.Room, name, logging.KMSObject, room.MediaPipeline.ID, logging.Err(err))
+		}
+		cancel()
+		if err = room.session.Close(); err != nil {
+			s.log.Warn(`can't close session of room`, logging.Room, name, logging.Err(err))
+		}
+	}
+
+	s.lock.RLock()
+	for user := range s.conns {
+		user.wsConn.Close()
+	}
+	s.lock.RUnlock()
+
+	// the connection to KMS may be lost already
+	if err := s.cli.Close(); err != nil && !errors.Is(err, kurentows.ErrConnClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package kurento
+
+import (
+	"context"
+	"fmt"
+	"logging"
+	"sort"
+)
+
+// DefaultStream is the stream of requests without a stream name, rooms with a hub have it only.
+const DefaultStream = `camera`
+
+// UnpublishWsCmd stops the published stream of the user, e.g. the screen share.
+const UnpublishWsCmd WsCmd = `unpublish`
+
+// streamName returns the stream of the request.
+func streamName(stream string) string {
+	if stream == "" {
+		return DefaultStream
+	}
+	return stream
+}
+
+// stream returns the published stream of the user.
+func (u *User) stream(name string) (*MediaObject, bool) {
+	u.lock.RLock()
+	in, ok := u.In[name]
+	u.lock.RUnlock()
+	return in, ok
+}
+
+// streams returns names of the published streams of the user.
+func (u *User) streams() []string {
+	u.lock.RLock()
+	names := make([]string, 0, len(u.In))
+	for name := range u.In {
+		names = append(names, name)
+	}
+	u.lock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+func (u *User) out(sender, stream string) (*MediaConnector, bool) {
+	u.lock.RLock()
+	connector, ok := u.Out[sender][stream]
+	u.lock.RUnlock()
+	return connector, ok
+}
+
+func (u *User) setOut(sender, stream string, connector *MediaConnector) {
+	u.lock.Lock()
+	if u.Out[sender] == nil {
+		u.Out[sender] = make(map[string]*MediaConnector, 0)
+	}
+	u.Out[sender][stream] = connector
+	u.lock.Unlock()
+}
+
+// deleteOut removes the stream of the sender, all streams when stream is empty,
+// removed connectors are returned.
+func (u *User) deleteOut(sender, stream string) []*MediaConnector {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	var connectors []*MediaConnector
+	for name, connector := range u.Out[sender] {
+		if stream == "" || stream == name {
+			connectors = append(connectors, connector)
+			delete(u.Out[sender], name)
+		}
+	}
+	if len(u.Out[sender]) == 0 {
+		delete(u.Out, sender)
+	}
+	return connectors
+}
+
+func (s *service) unpublish(ctx context.Context, currentUser *User, req *WsRequest) error {
+	currentRoom, err := s.userRoom(currentUser, req.Cmd)
+	if err != nil {
+		return err
+	}
+	return s.unpublishStream(ctx, currentRoom, currentUser, streamName(req.Stream))
+}
+
+// unpublishStream releases the stream of the user with its subscribers and recorder.
+func (s *service) unpublishStream(ctx context.Context, room *Room, publisher *User, stream string) error {
+	in, ok := publisher.stream(stream)
+	if !ok {
+		return fmt.Errorf(`stream %s of user %s is not published`, stream, s.redact.User(publisher.name))
+	}
+
+	room.lock.Lock()
+	recorders := detachRecorders(room, publisher, stream)
+	room.lock.Unlock()
+	s.stopRecorders(ctx, room, publisher, recorders)
+
+	// subscribers of the stream go first, they are connected to it
+	for _, user := range room.ListUsers() {
+		for _, connector := range user.deleteOut(publisher.name, stream) {
+			if err := room.session.Release(ctx, connector.Point); err != nil {
+				s.userLog(user).Warn(`can't release object`, logging.KMSObject, connector.Point.ID, logging.Err(err))
+			}
+		}
+	}
+	publisher.lock.Lock()
+	delete(publisher.In, stream)
+	publisher.lock.Unlock()
+	if err := room.session.Release(ctx, in); err != nil {
+		return err
+	}
+
+	s.broadcast(room, &ParticipantLeavedForm{
+		Cmd:    ParticipantLeavedWsCmd,
+		Name:   publisher.name,
+		Stream: stream,
+	})
+	return nil
+}
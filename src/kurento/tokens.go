@@ -0,0 +1,93 @@
+package kurento
+
+import (
+	"encoding/json"
+	"fmt"
+	"jointoken"
+	"logging"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// verifyJoin checks the token of joinRoom when tokens are required, room and user of the request
+// are taken from its claims. Claims are nil when tokens are not required.
+func (s *service) verifyJoin(req *WsRequest) (*jointoken.Claims, error) {
+	s.lock.RLock()
+	secret := s.runtime.TokenSecret
+	s.lock.RUnlock()
+	if secret == "" {
+		return nil, nil
+	}
+	if req.Token == "" {
+		return nil, fmt.Errorf(`token is required to join room %s`, req.Room)
+	}
+	claims, err := jointoken.Verify([]byte(secret), req.Token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if req.Room != "" && req.Room != claims.Room {
+		return nil, fmt.Errorf(`token is given for room %s, not %s`, claims.Room, req.Room)
+	}
+	if req.User != "" && req.User != claims.User {
+		return nil, fmt.Errorf(`token is given for user %s, not %s`, s.redact.User(claims.User), s.redact.User(req.User))
+	}
+	if claims.Role != "" && !Role(claims.Role).valid() {
+		return nil, fmt.Errorf(`unknown role %q of token`, claims.Role)
+	}
+	for _, capability := range claims.Capabilities {
+		if !jointoken.KnownCapability(capability) {
+			return nil, fmt.Errorf(`unknown capability %q of token`, capability)
+		}
+	}
+	req.Room, req.User = claims.Room, claims.User
+	return claims, nil
+}
+
+// TokenAnswer is the answer of ServeToken.
+type TokenAnswer struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// ServeToken mints a join token for anyone by query params room, user, name, role and caps
+// (comma separated). It is served in dev mode only, the backend of the application mints tokens
+// by package jointoken in production.
+func (s *service) ServeToken(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(rw, "Only GET and POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.lock.RLock()
+	secret, ttl := s.runtime.TokenSecret, s.runtime.TokenTTL
+	s.lock.RUnlock()
+
+	query := r.URL.Query()
+	claims := &jointoken.Claims{
+		Room:    query.Get(`room`),
+		User:    query.Get(`user`),
+		Name:    query.Get(`name`),
+		Role:    query.Get(`role`),
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+	// caps= without value gives no capabilities, no caps at all means the role ones
+	if query.Has(`caps`) {
+		claims.Capabilities = []string{}
+		if caps := query.Get(`caps`); caps != "" {
+			claims.Capabilities = strings.Split(caps, `,`)
+		}
+	}
+	if claims.Room == "" || claims.User == "" {
+		http.Error(rw, "room and user are required", http.StatusBadRequest)
+		return
+	}
+	token, err := jointoken.Mint([]byte(secret), claims)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.log.Debug(`dev token minted`, logging.Room, claims.Room, logging.User, s.redact.User(claims.User), `role`, claims.Role)
+	rw.Header().Set(`Content-Type`, `application/json`)
+	json.NewEncoder(rw).Encode(&TokenAnswer{Token: token, Expires: claims.ExpiresAt()})
+}
@@ -0,0 +1,76 @@
+package kurento
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"logging"
+)
+
+// Virtual users are participants without websockets: players and RTP endpoints.
+// They are added by commands of humans or admin routes and leave with the last human.
+
+// virtualRoom returns the room where the virtual user name may join.
+func (s *service) virtualRoom(roomName, name string) (*Room, error) {
+	s.lock.RLock()
+	room, ok := s.rooms[roomName]
+	limits := s.runtime.Limits
+	s.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf(`room %s is not found`, roomName)
+	}
+	if name == "" {
+		return nil, errors.New(`user of the virtual participant is required`)
+	}
+	if name == MixSender || name == PresenterSender {
+		return nil, fmt.Errorf(`user name %s is reserved`, name)
+	}
+	if room.HasUser(name) {
+		return nil, fmt.Errorf(`user %s already exist in room %s`, s.redact.User(name), roomName)
+	}
+	if limits.MaxParticipants != 0 && len(room.ListUsers()) >= limits.MaxParticipants {
+		return nil, fmt.Errorf(`limit of participants %d of room %s is reached`, limits.MaxParticipants, roomName)
+	}
+	return room, nil
+}
+
+// virtualUser returns the virtual user name of the room.
+func (s *service) virtualUser(roomName, name string) (*Room, *User, error) {
+	s.lock.RLock()
+	room, ok := s.rooms[roomName]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf(`room %s is not found`, roomName)
+	}
+	room.lock.RLock()
+	user, ok := room.Users[name]
+	room.lock.RUnlock()
+	if !ok || !user.Virtual {
+		return nil, nil, fmt.Errorf(`can't find virtual participant %s in room %s`, s.redact.User(name), roomName)
+	}
+	return room, user, nil
+}
+
+// releaseVirtual releases media of the virtual user which has failed to join.
+func (s *service) releaseVirtual(room *Room, user *User) {
+	user.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	objects := []*MediaObject{user.Port}
+	for _, in := range user.In {
+		objects = append(objects, in)
+	}
+	for _, streams := range user.Out {
+		for _, connector := range streams {
+			objects = append(objects, connector.Point)
+		}
+	}
+	for _, obj := range objects {
+		if obj == nil || obj.ID == "" {
+			continue
+		}
+		if err := room.session.Release(ctx, obj); err != nil {
+			s.userLog(user).Warn(`can't release object`, logging.KMSObject, obj.ID, logging.Err(err))
+		}
+	}
+}
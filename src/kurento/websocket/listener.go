@@ -8,23 +8,27 @@ import (
 	"errors"
 	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"context"
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
+	"logging"
+	"strconv"
+	"tracing"
 )
 
 const (
 	CLOSE_STMT = "server is going to shutdown"
 
-	// Time allowed to write a message to the peer.
+	// Time allowed to write a message to the peer, default of Timeouts.Write.
 	WRITE_TIMEOUT = 10 * time.Second
 
-	// Time allowed to read the next pong message from the peer.
+	// Time allowed to read the next pong message from the peer, default of Timeouts.Pong.
 	PONG_TIMEOUT = 2 * time.Second
 
-	// Send pings to peer with this period. Should be less then PONG_TIMEOUT.
+	// Send pings to peer with this period, default of Timeouts.Ping. Should be less then PONG_TIMEOUT.
 	PING_RATE = time.Second
 
 	// Maximum message size allowed from peer. For future use.
@@ -36,25 +40,51 @@ var (
 	ErrNilConnection = errors.New(`nil connection seriously?`)
 )
 
+// Таймауты WS-соединения, нулевые значения заменяются на WRITE_TIMEOUT, PONG_TIMEOUT и PING_RATE.
+type Timeouts struct {
+	// Write: время на запись сообщения
+	Write time.Duration
+	// Pong: время ожидания следующего понга
+	Pong time.Duration
+	// Ping: период пингов, должен быть меньше Pong
+	Ping time.Duration
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Write <= 0 {
+		t.Write = WRITE_TIMEOUT
+	}
+	if t.Pong <= 0 {
+		t.Pong = PONG_TIMEOUT
+	}
+	if t.Ping <= 0 {
+		t.Ping = PING_RATE
+	}
+	return t
+}
+
 // Конструктор обзёрвера пользовательских WS-соединений.
 // Если переданный коннект не активный, перед конструированием
 // обзёрвера производит попытку подключения и, вне зависимости
 // от результата последней, возвращает новый инстанс обзёрвера
 // предварительно запустив две рутины одна для записи, другая для чтения.
-func NewWsListener(ctx context.Context, conn reconnecter) (*WsListener, error) {
+func NewWsListener(ctx context.Context, conn reconnecter, timeouts Timeouts, logger *slog.Logger) (*WsListener, error) {
 	if ctx == nil {
 		return nil, ErrNilContext
 	}
 	if conn == nil {
 		return nil, ErrNilConnection
 	}
+	timeouts = timeouts.withDefaults()
 	wsListener := &WsListener{
-		conn:    conn,
-		wg:      new(sync.WaitGroup),
-		done:    make(chan struct{}),
-		readCh:  make(chan []byte, 10),
-		writeCh: make(chan []byte, 10),
-		ticker:  time.NewTicker(PING_RATE),
+		conn:     conn,
+		log:      logging.OrDefault(logger).With(logging.Component, `kms_ws`),
+		timeouts: timeouts,
+		wg:       new(sync.WaitGroup),
+		done:     make(chan struct{}),
+		readCh:   make(chan []byte, 10),
+		writeCh:  make(chan outMessage, 10),
+		ticker:   time.NewTicker(timeouts.Ping),
 	}
 
 	conn.SetPongHandler(wsListener.pongHandler)
@@ -71,12 +101,36 @@ func NewWsListener(ctx context.Context, conn reconnecter) (*WsListener, error) {
 
 // Обзёрвер пользовательских WS-соединений.
 type WsListener struct {
-	conn    reconnecter
-	wg      *sync.WaitGroup
-	done    chan struct{}
-	readCh  chan []byte
-	writeCh chan []byte
-	ticker  *time.Ticker
+	conn     reconnecter
+	log      *slog.Logger
+	timeouts Timeouts
+	wg       *sync.WaitGroup
+	done     chan struct{}
+	readCh   chan []byte
+	writeCh  chan outMessage
+	ticker   *time.Ticker
+
+	reconnects        uint64
+	reconnectFailures uint64
+	droppedWrites     uint64
+}
+
+// Сообщение на отправку со спаном трассировки записи (может быть nil).
+type outMessage struct {
+	data []byte
+	span *tracing.Span
+}
+
+// Счетчики обзёрвера для метрик.
+type Stats struct {
+	// соединение активно
+	Connected bool
+	// успешные реконнекты
+	Reconnects uint64
+	// неудачные попытки реконнекта
+	ReconnectFailures uint64
+	// сообщения, которые не удалось записать в соединение
+	DroppedWrites uint64
 }
 
 const (
@@ -109,7 +163,11 @@ func (l *WsListener) startReader() {
 			}
 
 			if msgType == websocket.TextMessage {
-				l.readCh <- data
+				select {
+				case l.readCh <- data:
+				case <-l.done:
+					return
+				}
 			}
 		}
 	}
@@ -132,15 +190,21 @@ func (l *WsListener) startWriter() {
 		case <-l.done:
 			return
 		case msg := <-l.writeCh:
-			err := l.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			err := l.conn.SetWriteDeadline(time.Now().Add(l.timeouts.Write))
 			if err != nil {
+				atomic.AddUint64(&l.droppedWrites, 1)
+				msg.span.SetError(err)
+				msg.span.End()
 
 				time.Sleep(RECONNECT_TIMEOUT / 10)
 				continue
 			}
 
-			err = l.conn.WriteMessage(websocket.TextMessage, msg)
+			err = l.conn.WriteMessage(websocket.TextMessage, msg.data)
+			msg.span.SetError(err)
+			msg.span.End()
 			if err != nil {
+				atomic.AddUint64(&l.droppedWrites, 1)
 
 				time.Sleep(RECONNECT_TIMEOUT / 10)
 			}
@@ -171,9 +235,27 @@ func (l *WsListener) Read() <-chan []byte {
 	return l.readCh
 }
 
-// Отправляет байты в канал на отправку по WS.
+// Отправляет байты в канал на отправку по WS, после закрытия обзёрвера сообщение отбрасывается.
 func (l *WsListener) Write(msg []byte) {
-	l.writeCh <- msg
+	select {
+	case l.writeCh <- outMessage{data: msg}:
+	case <-l.done:
+		atomic.AddUint64(&l.droppedWrites, 1)
+	}
+}
+
+// Отправляет байты в канал на отправку по WS, запись трассируется спаном
+// вложенным в спан контекста (время в очереди + запись в соединение).
+func (l *WsListener) WriteContext(ctx context.Context, msg []byte) {
+	_, span := tracing.Start(ctx, `kms_ws.write`)
+	span.SetAttr(`bytes`, strconv.Itoa(len(msg)))
+	select {
+	case l.writeCh <- outMessage{data: msg, span: span}:
+	case <-l.done:
+		atomic.AddUint64(&l.droppedWrites, 1)
+		span.SetError(ErrConnClosed)
+		span.End()
+	}
 }
 
 // Разовый реконнект WS-соединения.
@@ -182,42 +264,55 @@ func (l *WsListener) Reconnect() {
 	if !l.conn.IsActive() {
 		resp, err := l.conn.Reconnect()
 		if err != nil {
-			log.Printf(`Reconnect: %s`, err)
+			atomic.AddUint64(&l.reconnectFailures, 1)
+			l.log.Warn(`reconnect failed`, logging.Err(err))
+		} else {
+			atomic.AddUint64(&l.reconnects, 1)
+			l.log.Info(`reconnected`)
 		}
 		if resp != nil {
 			_, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				log.Printf(`Reconnect: %s`, err)
+				l.log.Warn(`can't read reconnect response`, logging.Err(err))
 			}
 
 		}
 	}
 }
 
+// Возвращает текущие счетчики обзёрвера.
+func (l *WsListener) Stats() Stats {
+	return Stats{
+		Connected:         l.conn.IsActive(),
+		Reconnects:        atomic.LoadUint64(&l.reconnects),
+		ReconnectFailures: atomic.LoadUint64(&l.reconnectFailures),
+		DroppedWrites:     atomic.LoadUint64(&l.droppedWrites),
+	}
+}
+
 // Завершение работы обзервера. Останавливает опорные рутины и закрывает соотв. WS коннект.
+// Рутины останавливаются и когда соединение уже разорвано, тогда возвращается ошибка отправки сообщения о закрытии.
 func (l *WsListener) Close() error {
 	// отправляем сообщение о закрытии WS-соединения другой стороне
 	l.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
 
-	if err := l.conn.WriteControl(
+	err := l.conn.WriteControl(
 		websocket.CloseMessage,
 		websocket.FormatCloseMessage(websocket.CloseNormalClosure, CLOSE_STMT),
 		time.Now().Add(time.Second),
-	); err != nil {
-		return err
-	}
+	)
 
 	close(l.done)  // закрываем сигнальный канал
 	l.conn.Close() // выходя, закрываем WS коннект
 
 	l.wg.Wait() // дожидаемся завершения рутин чтения и записи
 
-	close(l.writeCh) // закрываем канал на запись
-	close(l.readCh)  // закрываем канал на чтение
+	// канал на запись не закрываем: Write после Close отбрасывает сообщение, а не паникует
+	close(l.readCh) // закрываем канал на чтение
 
-	return nil
+	return err
 }
 
 func (l *WsListener) pongHandler(string) error {
-	return l.conn.SetReadDeadline(time.Now().Add(PONG_TIMEOUT))
+	return l.conn.SetReadDeadline(time.Now().Add(l.timeouts.Pong))
 }
@@ -102,11 +102,8 @@ func (r *reconn) Reconnect() (resp *http.Response, err error) {
 			r.conn.Close()
 		}
 		return resp, err
-	} else {
-		return nil, ErrEmptyDialer
 	}
-
-	return resp, err
+	return nil, ErrEmptyDialer
 }
 
 // Закрывает активное WS-соединение, проксирует ошибку в ответе.
@@ -0,0 +1,119 @@
+// Package logging builds the structured logger of madsquid and keeps names of common fields,
+// so every package logs room, user and so on under the same keys.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"redact"
+	"strings"
+)
+
+// Common fields.
+const (
+	Room      = `room`
+	User      = `user`
+	KMSObject = `kms_object`
+	RequestID = `request_id`
+	Cmd       = `cmd`
+	Method    = `method`
+	Component = `component`
+	Error     = `error`
+)
+
+// Output formats.
+const (
+	TextFormat = `text`
+	JSONFormat = `json`
+)
+
+// ParseLevel parses level name: debug, info, warn or error.
+func ParseLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf(`unknown log level %q`, level)
+	}
+	return lvl, nil
+}
+
+// New returns logger writing to w in the format (text or json) with messages of the level and above.
+// The level may be changed at runtime. Errors are redacted by r when it is enabled, see Err.
+func New(w io.Writer, format string, level *slog.LevelVar, r *redact.Redactor) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case TextFormat, "":
+		h = slog.NewTextHandler(w, opts)
+	case JSONFormat:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf(`unknown log format %q`, format)
+	}
+	if r.Enabled() {
+		h = &redactHandler{Handler: h, r: r}
+	}
+	return slog.New(h), nil
+}
+
+// Err is the field of an error. Loggers of New redact every Error field, errors of network
+// connections carry IP addresses of peers.
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.String(Error, "")
+	}
+	return slog.String(Error, err.Error())
+}
+
+// OrDefault returns l or the default logger when l is nil.
+func OrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// redactHandler redacts Error fields of records and of loggers made by With.
+type redactHandler struct {
+	slog.Handler
+	r *redact.Redactor
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return &redactHandler{Handler: h.Handler.WithAttrs(redacted), r: h.r}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{Handler: h.Handler.WithGroup(name), r: h.r}
+}
+
+func (h *redactHandler) redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = h.redact(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case a.Key == Error:
+		a.Value = slog.StringValue(h.r.Text(a.Value.String()))
+	}
+	return a
+}
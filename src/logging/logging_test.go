@@ -0,0 +1,43 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"redact"
+	"strings"
+	"testing"
+)
+
+func TestRedactedErrors(t *testing.T) {
+	err := errors.New(`read tcp 10.0.0.1:10443->192.168.1.20:51234: i/o timeout`)
+	for _, tc := range []struct {
+		name   string
+		format string
+		redact bool
+		log    func(l *slog.Logger)
+	}{
+		{`text`, TextFormat, true, func(l *slog.Logger) { l.Warn(`failed`, Err(err)) }},
+		{`json`, JSONFormat, true, func(l *slog.Logger) { l.Warn(`failed`, Err(err)) }},
+		{`string field`, TextFormat, true, func(l *slog.Logger) { l.Warn(`failed`, Error, err.Error()) }},
+		{`with`, TextFormat, true, func(l *slog.Logger) { l.With(Err(err)).Warn(`failed`) }},
+		{`group`, JSONFormat, true, func(l *slog.Logger) { l.WithGroup(`ws`).Warn(`failed`, slog.Group(`read`, Err(err))) }},
+		{`disabled`, TextFormat, false, func(l *slog.Logger) { l.Warn(`failed`, Err(err)) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			l, lerr := New(out, tc.format, &slog.LevelVar{}, redact.New(tc.redact))
+			if lerr != nil {
+				t.Fatal(lerr)
+			}
+			tc.log(l)
+			leaked := strings.Contains(out.String(), `192.168.1.20`)
+			if leaked == tc.redact {
+				t.Errorf(`address is leaked: %t, log: %s`, leaked, out)
+			}
+			if !strings.Contains(out.String(), `i/o timeout`) {
+				t.Errorf(`error is lost: %s`, out)
+			}
+		})
+	}
+}
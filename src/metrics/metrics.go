@@ -0,0 +1,335 @@
+// Package metrics keeps counters, gauges and histograms and serves them in Prometheus text exposition format.
+// Methods of nil metrics do nothing, so components may be built without a registry.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are buckets of latencies in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry of metrics, it is a http.Handler of the exposition.
+type Registry struct {
+	lock    sync.RWMutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric, 0)}
+}
+
+func (r *Registry) register(m metric) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic(`metrics: duplicate metric ` + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// Counter registers a counter with the label names.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, `counter`, labels)}
+	r.register(c)
+	return c
+}
+
+// Gauge registers a gauge with the label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, `gauge`, labels)}
+	r.register(g)
+	return g
+}
+
+// GaugeFunc registers a gauge which value is taken from f on every scrape.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, `gauge`, nil), f: f})
+}
+
+// CounterFunc registers a counter which value is taken from f on every scrape.
+func (r *Registry) CounterFunc(name, help string, f func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, `counter`, nil), f: f})
+}
+
+// Histogram registers a histogram with the upper bounds of buckets (nil means DefBuckets).
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{vec: newVec(name, help, `histogram`, labels), buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// WriteTo writes all metrics in text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.lock.RUnlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set(`Content-Type`, `text/plain; version=0.0.4; charset=utf-8`)
+	r.WriteTo(rw)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// series is one combination of label values.
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type vec struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{metricName: name, help: help, typ: typ, labels: labels, series: make(map[string]*series, 0)}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// get returns series of the label values, v.lock must be held.
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf(`metrics: %s has %d labels, got %d values`, v.metricName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, escapeHelp(v.help), v.metricName, v.typ)
+}
+
+// sorted returns series ordered by label values, v.lock must be held.
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*series, len(keys))
+	for i, k := range keys {
+		out[i] = v.series[k]
+	}
+	return out
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.header(w)
+	for _, s := range v.sorted() {
+		writeSample(w, v.metricName, v.labels, s.labels, "", "", s.value)
+	}
+}
+
+type Counter struct {
+	*vec
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(delta float64, labels ...string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.get(labels).value += delta
+	c.lock.Unlock()
+}
+
+type Gauge struct {
+	*vec
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.get(labels).value = value
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Add(delta float64, labels ...string) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.get(labels).value += delta
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Inc(labels ...string) {
+	g.Add(1, labels...)
+}
+
+func (g *Gauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+type funcMetric struct {
+	*vec
+	f func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.header(w)
+	writeSample(w, m.metricName, nil, nil, "", "", m.f())
+}
+
+type Histogram struct {
+	*vec
+	buckets []float64
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.get(labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.header(w)
+	for _, s := range h.sorted() {
+		for i, bound := range h.buckets {
+			var n uint64
+			if s.buckets != nil {
+				n = s.buckets[i]
+			}
+			writeSample(w, h.metricName+`_bucket`, h.labels, s.labels, `le`, formatFloat(bound), float64(n))
+		}
+		writeSample(w, h.metricName+`_bucket`, h.labels, s.labels, `le`, `+Inf`, float64(s.count))
+		writeSample(w, h.metricName+`_sum`, h.labels, s.labels, "", "", s.sum)
+		writeSample(w, h.metricName+`_count`, h.labels, s.labels, "", "", float64(s.count))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return `+Inf`
+	case math.IsInf(v, -1):
+		return `-Inf`
+	case math.IsNaN(v):
+		return `NaN`
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
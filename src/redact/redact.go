@@ -0,0 +1,89 @@
+// Package redact removes private data from log messages: SDP secrets (ICE credentials, DTLS fingerprints,
+// SRTP keys), IP addresses of candidates and user names.
+// Disabled (or nil) Redactor returns everything as is.
+package redact
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+const mask = `[redacted]`
+
+var (
+	// SDP attributes with secrets, value is cut up to the end of line (also escaped in JSON)
+	secretAttrs = regexp.MustCompile(`(a=(?:ice-pwd|ice-ufrag|fingerprint|crypto|key-mgmt)):[^\r\n\\"]*`)
+	ipv4        = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6        = regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){3,7}[0-9a-fA-F]{1,4}\b|\b(?:[0-9a-fA-F]{1,4}:)+:(?:[0-9a-fA-F]{1,4}:?)*\b`)
+)
+
+// Redactor is safe for concurrent use.
+type Redactor struct {
+	enabled bool
+	// salt makes user aliases unlinkable between instances and restarts
+	salt []byte
+}
+
+// New returns redactor, enabled == false turns redaction off.
+func New(enabled bool) *Redactor {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return &Redactor{enabled: enabled, salt: salt}
+}
+
+func (r *Redactor) Enabled() bool {
+	return r != nil && r.enabled
+}
+
+// Text removes SDP secrets and IP addresses from any text: SDP, candidates, JSON, errors.
+func (r *Redactor) Text(s string) string {
+	if !r.Enabled() {
+		return s
+	}
+	s = secretAttrs.ReplaceAllString(s, `$1:`+mask)
+	s = ipv4.ReplaceAllString(s, `x.x.x.x`)
+	return ipv6.ReplaceAllString(s, `x::x`)
+}
+
+// Error is Text for an error message.
+func (r *Redactor) Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return r.Text(err.Error())
+}
+
+// JSON marshals v and redacts the result.
+func (r *Redactor) JSON(v interface{}) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf(`!(%s)`, err)
+	}
+	return r.Text(string(raw))
+}
+
+// User replaces user name by a stable alias, the same name gets the same alias within the process.
+func (r *Redactor) User(name string) string {
+	if !r.Enabled() {
+		return name
+	}
+	h := sha256.New()
+	h.Write(r.salt)
+	h.Write([]byte(name))
+	return `user-` + hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// Dump is JSON for dumps of whole structures (rooms and so on): names are keys there,
+// so with redaction the dump is dropped at all.
+func (r *Redactor) Dump(v interface{}) string {
+	if r.Enabled() {
+		return mask
+	}
+	return r.JSON(v)
+}
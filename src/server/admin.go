@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"kurento"
+	"log/slog"
+	"metrics"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// adminMux returns routes served by the admin listener only.
+func adminMux(rooms kurento.Service, registry *metrics.Registry, logger *slog.Logger) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kurento/_schema", rooms.ServeSchema)
+	mux.Handle("/metrics", registry)
+	mux.Handle("/admin/drain", drainHandler(rooms, logger))
+	mux.HandleFunc("/admin/players", rooms.ServePlayers)
+	mux.HandleFunc("/admin/rtp", rooms.ServeRTP)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// adminAuth requires the bearer token when it is set, client certificates are verified by TLS.
+func adminAuth(token string, next http.Handler, logger *slog.Logger) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			logger.Warn(`unauthorized admin request`, `path`, req.URL.Path, `remote`, req.RemoteAddr)
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="madsquid admin"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// adminTLSConfig returns TLS of the admin listener, it requires client certificates of clientCA when it is set.
+func adminTLSConfig(certs *certReloader, clientCA string) (*tls.Config, error) {
+	c := &tls.Config{GetCertificate: certs.GetCertificate}
+	if clientCA == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(clientCA + `: no certificates`)
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return c, nil
+}
+
+// drainHandler reports drain progress on GET, turns drain mode on by POST and off by DELETE.
+func drainHandler(s kurento.Service, logger *slog.Logger) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			s.Drain(true)
+		case http.MethodDelete:
+			s.Drain(false)
+		default:
+			http.Error(rw, "Only GET, POST and DELETE allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		logger.Debug(`drain request`, `method`, req.Method, `remote`, req.RemoteAddr)
+		rw.Header().Set(`Content-Type`, `application/json`)
+		json.NewEncoder(rw).Encode(s.DrainStatus())
+	}
+}
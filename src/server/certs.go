@@ -0,0 +1,124 @@
+package server
+
+import (
+	"certs"
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"logging"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// certCheckPeriod is the period of checks that certificate files have changed.
+	certCheckPeriod = 10 * time.Second
+	// ephemeralValidity is the validity of the self-signed certificate, it is regenerated on every start.
+	ephemeralValidity = 30 * 24 * time.Hour
+)
+
+// certReloader serves the certificate by tls.Config.GetCertificate and reloads it
+// when its files change or on Reload, so rotation does not drop connections.
+// Without files it serves an ephemeral self-signed certificate.
+type certReloader struct {
+	log *slog.Logger
+
+	lock     sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *slog.Logger) (*certReloader, error) {
+	r := &certReloader{
+		log:      logging.OrDefault(logger).With(logging.Component, `tls`),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.Reload(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate from the files, the previous one is served when they are bad.
+func (r *certReloader) Reload(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return r.selfSigned()
+	}
+	modTime := lastModified(certFile, keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	r.certFile, r.keyFile = certFile, keyFile
+	r.cert = &cert
+	r.modTime = modTime
+	r.lock.Unlock()
+	r.log.Info(`certificate loaded`, `cert`, certFile)
+	return nil
+}
+
+// selfSigned generates the ephemeral certificate once, browsers ask to trust it by its fingerprint.
+func (r *certReloader) selfSigned() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cert != nil && r.certFile == "" {
+		return nil
+	}
+	hosts := certs.DefaultHosts()
+	pair, err := certs.NewServer(nil, hosts, ephemeralValidity)
+	if err != nil {
+		return err
+	}
+	cert := pair.TLS()
+	r.certFile, r.keyFile = "", ""
+	r.cert = &cert
+	r.log.Warn(`no certificate is configured, serving an ephemeral self-signed one`,
+		`hosts`, hosts, `fingerprint`, certs.Fingerprint(pair.Cert))
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate when its files are modified.
+func (r *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.lock.RLock()
+			certFile, keyFile, modTime := r.certFile, r.keyFile, r.modTime
+			r.lock.RUnlock()
+			if certFile == "" || !lastModified(certFile, keyFile).After(modTime) {
+				continue
+			}
+			if err := r.Reload(certFile, keyFile); err != nil {
+				// files may be written one by one, the next check loads them
+				r.log.Warn(`can't reload certificate`, logging.Err(err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// lastModified returns the latest modification time of the files.
+func lastModified(files ...string) time.Time {
+	var last time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
@@ -1,27 +1,187 @@
 package server
 
-import "flag"
-
-var (
-	fTLS  = flag.Bool("tls", true, "Use TLS")
-	fAddr = flag.String("addr", ":10443", "host:port for MadSquid")
-	fCert = flag.String("cert", "server.crt", "Certificate file")
-	fKey  = flag.String("keyfile", "server.key", "Key file")
+import (
+	"config"
+	"flag"
+	"fmt"
+	"kurento"
+	"log/slog"
+	"logging"
+	"os"
+	"redact"
+	"time"
+	"tracing"
+	"ws"
 )
 
-type Config struct {
-	TLS  bool
-	Addr string
-	Cert string
-	Key  string
+var fConfig = flag.String("config", "", "JSON or TOML config file, "+config.EnvFile+" by default")
+
+// flagPaths: flags overriding settings of the config, they are applied over the file and the environment.
+var flagPaths = map[string]string{
+	"addr":                `listen.addr`,
+	"tls":                 `tls.enabled`,
+	"cert":                `tls.cert`,
+	"keyfile":             `tls.key`,
+	"kurento.addr":        `kurento.addr`,
+	"log.redact":          `log.redact`,
+	"log.level":           `log.level`,
+	"log.format":          `log.format`,
+	"trace.exporter":      `trace.exporter`,
+	"trace.file":          `trace.file`,
+	"trace.otlp.endpoint": `trace.otlp_endpoint`,
+	"shutdown.timeout":    `shutdown.timeout`,
+	"shutdown.reconnect":  `shutdown.reconnect_after`,
 }
 
-func GetConfig() *Config {
+var boolFlags = map[string]bool{"tls": true, "log.redact": true}
+
+// overrides: values of flags set in the command line by setting path
+var overrides = map[string]string{}
+
+func init() {
+	for name, path := range flagPaths {
+		path := path
+		usage := fmt.Sprintf("Overrides %s of the config (%s)", path, config.EnvName(path))
+		set := func(value string) error {
+			overrides[path] = value
+			return nil
+		}
+		if boolFlags[name] {
+			flag.BoolFunc(name, usage, set)
+		} else {
+			flag.Func(name, usage, set)
+		}
+	}
+}
+
+// GetConfig parses flags and loads the config from the file, the environment and flags, in order of priority.
+func GetConfig() (*config.Config, error) {
 	flag.Parse()
-	return &Config{
-		TLS:  *fTLS,
-		Addr: *fAddr,
-		Cert: *fCert,
-		Key:  *fKey,
+	return loadConfig()
+}
+
+// loadConfig loads the config again from the sources of GetConfig.
+func loadConfig() (*config.Config, error) {
+	path := *fConfig
+	if path == "" {
+		path = os.Getenv(config.EnvFile)
+	}
+	c, err := config.Load(path, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	for path, value := range overrides {
+		if err = c.Set(path, value); err != nil {
+			return nil, err
+		}
+	}
+	if err = c.Validate(); err != nil {
+		return nil, fmt.Errorf("bad config: %w", err)
+	}
+	return c, nil
+}
+
+// NewLogger returns logger configured by c, its level may be changed by the returned var.
+func NewLogger(c *config.Config) (*slog.Logger, *slog.LevelVar, error) {
+	level, err := logging.ParseLevel(c.Log.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	levelVar := &slog.LevelVar{}
+	levelVar.Set(level)
+	logger, err := logging.New(os.Stderr, c.Log.Format, levelVar, redact.New(c.Log.Redact))
+	if err != nil {
+		return nil, nil, err
+	}
+	return logger, levelVar, nil
+}
+
+// NewTracer returns tracer exporting spans as configured by c, it is nil when tracing is off.
+func NewTracer(c *config.Config, logger *slog.Logger) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch c.Trace.Exporter {
+	case "", "none":
+		return nil, nil
+	case "file":
+		fileExporter, err := tracing.NewJSONFileExporter(c.Trace.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	case "otlp":
+		exporter = tracing.NewOTLPHTTPExporter(c.Trace.OTLPEndpoint, "madsquid")
+	default:
+		return nil, fmt.Errorf(`unknown trace exporter %q`, c.Trace.Exporter)
+	}
+	return tracing.NewTracer(exporter, logger), nil
+}
+
+// clientConfig returns settings of the media server client.
+func clientConfig(c *config.Config) *kurento.ClientConfig {
+	client := kurento.DefaultClientConfig()
+	client.Addr = c.Kurento.Addr
+	client.Timeout = time.Duration(c.Kurento.Timeout)
+	client.Timeouts = make(map[string]time.Duration, len(c.Kurento.Timeouts))
+	for name, timeout := range c.Kurento.Timeouts {
+		client.Timeouts[name] = time.Duration(timeout)
+	}
+	client.Retry = &kurento.RetryPolicy{
+		Attempts: c.Kurento.Retry.Attempts,
+		Backoff:  time.Duration(c.Kurento.Retry.Backoff),
+		Calls:    c.Kurento.Retry.Calls,
+		Codes:    c.Kurento.Retry.Codes,
+	}
+	client.PingInterval = time.Duration(c.Kurento.PingInterval)
+	client.WebSocket = &kurento.WebSocketConfig{
+		WriteWait:  time.Duration(c.Kurento.WebSocket.WriteWait),
+		PongWait:   time.Duration(c.Kurento.WebSocket.PongWait),
+		PingPeriod: time.Duration(c.Kurento.WebSocket.PingPeriod),
+	}
+	return client
+}
+
+// roomsWebSocketConfig returns settings of /kurento websockets.
+func roomsWebSocketConfig(c *config.Config) *kurento.WebSocketConfig {
+	return &kurento.WebSocketConfig{
+		WriteWait:      time.Duration(c.WebSocket.WriteWait),
+		PongWait:       time.Duration(c.WebSocket.PongWait),
+		MaxMessageSize: c.WebSocket.MaxMessageSize,
+	}
+}
+
+// signallingWebSocketConfig returns settings of /ws websockets.
+func signallingWebSocketConfig(c *config.Config) *ws.Config {
+	return &ws.Config{
+		WriteWait:      time.Duration(c.WebSocket.WriteWait),
+		PongWait:       time.Duration(c.WebSocket.PongWait),
+		MaxMessageSize: c.WebSocket.MaxMessageSize,
+	}
+}
+
+// runtimeConfig returns settings of rooms which are reloaded on SIGHUP.
+func runtimeConfig(c *config.Config) kurento.RuntimeConfig {
+	iceServers := make([]kurento.ICEServer, 0, len(c.ICE.Servers))
+	for _, server := range c.ICE.Servers {
+		iceServers = append(iceServers, kurento.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	policy := make(map[kurento.Role][]string, 4)
+	for _, role := range c.Policy.Roles() {
+		policy[kurento.Role(role.Name)] = role.Capabilities
+	}
+	return kurento.RuntimeConfig{
+		Limits: kurento.Limits{
+			MaxRooms:        c.Limits.MaxRooms,
+			MaxParticipants: c.Limits.MaxParticipants,
+		},
+		ICEServers:   iceServers,
+		RecordingURI: c.Recording.URI,
+		PlayerURIs:   c.Player.URIs,
+		TokenSecret:  c.Tokens.Secret,
+		TokenTTL:     time.Duration(c.Tokens.TTL),
+		Policy:       policy,
 	}
 }
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"kurento"
+	"logging"
+	"reflect"
+)
+
+// reload loads the config again and applies settings which are safe to change at runtime:
+// the certificate, log level, limits, ICE servers, the recording uri, the token secret, the policy and shutdown timeouts.
+// Other changes need a restart.
+func (app *App) reload(certs *certReloader, rooms kurento.Service) error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	restart := []string{}
+	for name, changed := range map[string]bool{
+		`listen`:      !reflect.DeepEqual(c.Listen, app.Config.Listen),
+		`admin`:       c.Admin != app.Config.Admin,
+		`tls.enabled`: c.TLS.Enabled != app.Config.TLS.Enabled,
+		`kurento`:     !reflect.DeepEqual(c.Kurento, app.Config.Kurento),
+		`websocket`:   c.WebSocket != app.Config.WebSocket,
+		`static`:      c.Static != app.Config.Static,
+		`tokens.dev`:  c.Tokens.Dev != app.Config.Tokens.Dev,
+		`log.format`:  c.Log.Format != app.Config.Log.Format,
+		`log.redact`:  c.Log.Redact != app.Config.Log.Redact,
+		`trace`:       c.Trace != app.Config.Trace,
+	} {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) != 0 {
+		app.Logger.Warn(`changed settings are applied after restart`, `settings`, restart)
+	}
+
+	if certs != nil {
+		if err = certs.Reload(c.TLS.Cert, c.TLS.Key); err != nil {
+			return err
+		}
+		app.Config.TLS.Cert, app.Config.TLS.Key = c.TLS.Cert, c.TLS.Key
+	}
+
+	level, err := logging.ParseLevel(c.Log.Level)
+	if err != nil {
+		return err
+	}
+	app.LogLevel.Set(level)
+	app.Config.Log.Level = c.Log.Level
+
+	rooms.Reload(runtimeConfig(c))
+	app.Config.Limits = c.Limits
+	app.Config.ICE = c.ICE
+	app.Config.Recording = c.Recording
+	app.Config.Tokens.Secret, app.Config.Tokens.TTL = c.Tokens.Secret, c.Tokens.TTL
+	app.Config.Policy = c.Policy
+	app.Config.Shutdown = c.Shutdown
+
+	app.Logger.Info(`config reloaded`, `log_level`, c.Log.Level)
+	return nil
+}
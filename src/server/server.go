@@ -1,40 +1,172 @@
 package server
 
 import (
+	"config"
 	"handlers"
+	"health"
 
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"kurento"
-	"log"
+	"log/slog"
+	"logging"
+	"metrics"
 	"net/http"
+	"os"
+	"os/signal"
+	"redact"
+	"syscall"
+	"time"
 )
 
+// httpShutdownTimeout limits waiting of active http requests after rooms have drained.
+const httpShutdownTimeout = 5 * time.Second
+
 type App struct {
-	Config *Config
+	Config   *config.Config
+	Logger   *slog.Logger
+	LogLevel *slog.LevelVar
 }
 
-func New(config *Config) *App {
+func New(c *config.Config, logger *slog.Logger, level *slog.LevelVar) *App {
 	return &App{
-		Config: config,
+		Config:   c,
+		Logger:   logger,
+		LogLevel: level,
 	}
 }
 
 func (app *App) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
-	kurentoService, err := kurento.NewService(ctx)
+	defer cancel()
+	registry := metrics.NewRegistry()
+	checker := health.NewChecker()
+	tracer, err := NewTracer(app.Config, app.Logger)
 	if err != nil {
-		panic(err)
+		app.Logger.Error(`can't start tracing`, logging.Err(err))
+		os.Exit(1)
 	}
-	defer cancel()
-	service := handlers.NewService()
-	http.HandleFunc("/ws", service.WSHandle)
-	http.Handle("/kurento/_schema", kurentoService)
-	http.Handle("/kurento", kurentoService)
-	http.HandleFunc("/messages", service.PostMessage)
-	http.Handle("/", http.FileServer(http.Dir("public/kurento")))
-	if app.Config.TLS {
-		log.Fatal(http.ListenAndServeTLS(app.Config.Addr, app.Config.Cert, app.Config.Key, nil))
+	defer tracer.Close()
+	kurentoService, err := kurento.NewService(ctx, &kurento.ServiceConfig{
+		Client:    clientConfig(app.Config),
+		Redact:    redact.New(app.Config.Log.Redact),
+		Logger:    app.Logger,
+		Metrics:   registry,
+		Tracer:    tracer,
+		Health:    checker,
+		WebSocket: roomsWebSocketConfig(app.Config),
+		Runtime:   runtimeConfig(app.Config),
+	})
+	if err != nil {
+		app.Logger.Error(`can't start kurento service`, logging.Err(err))
+		os.Exit(1)
+	}
+	service := handlers.NewService(signallingWebSocketConfig(app.Config), app.Logger, registry)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", service.WSHandle)
+	mux.Handle("/kurento", kurentoService)
+	mux.HandleFunc("/messages", service.PostMessage)
+	if app.Config.Tokens.Dev {
+		// anyone gets any role, it is never enabled in production
+		app.Logger.Warn(`dev endpoint of join tokens is served`, `path`, `/kurento/token`)
+		mux.HandleFunc("/kurento/token", kurentoService.ServeToken)
+	}
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.Handle("/readyz", checker)
+	mux.Handle("/", http.FileServer(http.Dir(app.Config.Static.Root)))
+	public := &listener{name: `public`, srv: &http.Server{Addr: app.Config.Listen.Addr, Handler: mux}}
+	listeners := []*listener{public}
+
+	// the certificate is rotated without restart, on SIGHUP or when its files change
+	var certs *certReloader
+	if app.Config.TLS.Enabled {
+		certs, err = newCertReloader(app.Config.TLS.Cert, app.Config.TLS.Key, app.Logger)
+		if err != nil {
+			app.Logger.Error(`can't load certificate`, logging.Err(err))
+			os.Exit(1)
+		}
+		go certs.watch(ctx)
+		public.srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+
+	// admin routes are not served without the admin listener
+	if app.Config.Admin.Addr != "" {
+		admin := &listener{name: `admin`, srv: &http.Server{
+			Addr:    app.Config.Admin.Addr,
+			Handler: adminAuth(app.Config.Admin.Token, adminMux(kurentoService, registry, app.Logger), app.Logger),
+		}}
+		if certs != nil {
+			if admin.srv.TLSConfig, err = adminTLSConfig(certs, app.Config.Admin.ClientCA); err != nil {
+				app.Logger.Error(`can't load admin client CA`, logging.Err(err))
+				os.Exit(1)
+			}
+		}
+		listeners = append(listeners, admin)
+	}
+
+	stopped := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go l.serve(app.Logger, stopped)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+wait:
+	for {
+		select {
+		case err = <-stopped:
+			app.Logger.Error(`server stopped`, logging.Err(err))
+			tracer.Close()
+			os.Exit(1)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err = app.reload(certs, kurentoService); err != nil {
+					app.Logger.Error(`can't reload config`, logging.Err(err))
+				}
+				continue
+			}
+			app.Logger.Info(`shutting down`, `signal`, sig.String(), `timeout`, time.Duration(app.Config.Shutdown.Timeout))
+			break wait
+		}
+	}
+
+	// readiness goes down first, http is served until rooms have drained
+	checker.Shutdown()
+	service.Shutdown(time.Duration(app.Config.Shutdown.ReconnectAfter))
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(app.Config.Shutdown.Timeout))
+	defer cancelShutdown()
+	if err = kurentoService.Shutdown(shutdownCtx, time.Duration(app.Config.Shutdown.ReconnectAfter)); err != nil {
+		app.Logger.Warn(`kurento service shutdown failed`, logging.Err(err))
+	}
+
+	// hijacked websockets are not waited by the http server
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancelClose()
+	for _, l := range listeners {
+		if err = l.srv.Shutdown(closeCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Warn(`http server shutdown failed`, `listener`, l.name, logging.Err(err))
+		}
+	}
+	app.Logger.Info(`server stopped`)
+}
+
+// listener is a http server of a set of routes: public signalling or admin.
+type listener struct {
+	name string
+	srv  *http.Server
+}
+
+// serve sends to stopped the error of the server, TLS is served when the server has TLSConfig.
+func (l *listener) serve(logger *slog.Logger, stopped chan<- error) {
+	logger.Info(`listening`, `listener`, l.name, `addr`, l.srv.Addr, `tls`, l.srv.TLSConfig != nil)
+	var err error
+	if l.srv.TLSConfig != nil {
+		err = l.srv.ListenAndServeTLS("", "")
 	} else {
-		log.Fatal(http.ListenAndServe(app.Config.Addr, nil))
+		err = l.srv.ListenAndServe()
 	}
+	stopped <- fmt.Errorf(`%s listener: %w`, l.name, err)
 }
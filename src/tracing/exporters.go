@@ -0,0 +1,192 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JSONFileExporter appends spans to a file, one JSON object per line.
+type JSONFileExporter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{file: f}, nil
+}
+
+type jsonSpan struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	DurationMs float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+func (e *JSONFileExporter) Export(ctx context.Context, spans []*SpanData) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, s := range spans {
+		js := &jsonSpan{
+			TraceID:    s.TraceID.String(),
+			SpanID:     s.SpanID.String(),
+			Name:       s.Name,
+			Start:      s.Start,
+			End:        s.End,
+			DurationMs: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.HasParent() {
+			js.ParentID = s.ParentID.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := e.file.Write(buf.Bytes())
+	return err
+}
+
+func (e *JSONFileExporter) Close() error {
+	return e.file.Close()
+}
+
+// DefaultOTLPEndpoint is the traces endpoint of a local OpenTelemetry collector.
+const DefaultOTLPEndpoint = `http://localhost:4318/v1/traces`
+
+// OTLPHTTPExporter sends spans to an OpenTelemetry collector by OTLP/HTTP in JSON encoding.
+type OTLPHTTPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func NewOTLPHTTPExporter(endpoint, service string) *OTLPHTTPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &OTLPHTTPExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+func (e *OTLPHTTPExporter) Export(ctx context.Context, spans []*SpanData) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.HasParent() {
+			span.ParentSpanID = s.ParentID.String()
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttr{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	body := map[string]interface{}{
+		`resourceSpans`: []interface{}{
+			map[string]interface{}{
+				`resource`: map[string]interface{}{
+					`attributes`: []otlpAttr{{Key: `service.name`, Value: otlpValue{StringValue: e.service}}},
+				},
+				`scopeSpans`: []interface{}{
+					map[string]interface{}{
+						`scope`: map[string]string{`name`: `madsquid`},
+						`spans`: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(`Content-Type`, `application/json`)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf(`collector answered %s`, resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPHTTPExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,246 @@
+// Package tracing records spans of work (websocket commands, KMS calls, websocket writes)
+// and sends them to a pluggable exporter.
+//
+// A root span is started by Tracer.Start, nested spans are started by the package function Start
+// from the context of the parent span. Without a parent span nothing is recorded, and methods
+// of a nil *Span do nothing, so code may be traced unconditionally.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"logging"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanData is a finished span passed to the exporter.
+type SpanData struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	// Error: error message of failed work, empty on success
+	Error string
+}
+
+func (d *SpanData) HasParent() bool {
+	return d.ParentID != SpanID{}
+}
+
+// Exporter sends finished spans to a storage or a collector.
+type Exporter interface {
+	Export(ctx context.Context, spans []*SpanData) error
+	Close() error
+}
+
+// Span is a span in progress, it is safe for concurrent use.
+type Span struct {
+	tracer *Tracer
+
+	lock sync.Mutex
+	data SpanData
+	done bool
+}
+
+// SetAttr sets attribute of the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string, 0)
+	}
+	s.data.Attributes[key] = value
+	s.lock.Unlock()
+}
+
+// SetError marks the span failed, nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.Error = err.Error()
+	s.lock.Unlock()
+}
+
+// End finishes the span and queues it to export. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.done {
+		s.lock.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+
+	s.tracer.queue(&data)
+}
+
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+type spanKey struct{}
+
+// FromContext returns span of the context or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a span nested to the span of ctx. Without a parent span it returns ctx and nil span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, parent)
+}
+
+// Tracer starts root spans and exports finished spans in batches.
+type Tracer struct {
+	exporter Exporter
+	log      *slog.Logger
+
+	spans chan *SpanData
+	stop  chan struct{}
+	once  sync.Once
+	done  chan struct{}
+}
+
+const (
+	batchSize     = 100
+	flushInterval = 5 * time.Second
+	queueSize     = 4096
+)
+
+// NewTracer starts export of spans by exporter. Nil exporter returns nil tracer, which records nothing.
+func NewTracer(exporter Exporter, logger *slog.Logger) *Tracer {
+	if exporter == nil {
+		return nil
+	}
+	t := &Tracer{
+		exporter: exporter,
+		log:      logging.OrDefault(logger).With(logging.Component, `tracing`),
+		spans:    make(chan *SpanData, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Start starts a root span, it is nested to the span of ctx if there is one.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	return t.start(ctx, name, FromContext(ctx))
+}
+
+func (t *Tracer) start(ctx context.Context, name string, parent *Span) (context.Context, *Span) {
+	s := &Span{tracer: t}
+	s.data.Name = name
+	s.data.Start = time.Now()
+	rand.Read(s.data.SpanID[:])
+	if parent != nil {
+		s.data.TraceID = parent.data.TraceID
+		s.data.ParentID = parent.data.SpanID
+	} else {
+		rand.Read(s.data.TraceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (t *Tracer) queue(data *SpanData) {
+	select {
+	case <-t.stop:
+		// spans ended after Close are dropped
+	case t.spans <- data:
+	default:
+		t.log.Warn(`span queue is full, span was dropped`, `span`, data.Name)
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			t.log.Warn(`can't export spans`, `spans`, len(batch), logging.Err(err))
+		}
+		cancel()
+		batch = make([]*SpanData, 0, batchSize)
+	}
+
+	for {
+		select {
+		case <-t.stop:
+			for {
+				select {
+				case data := <-t.spans:
+					batch = append(batch, data)
+				default:
+					flush()
+					return
+				}
+			}
+		case data := <-t.spans:
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close exports queued spans and closes the exporter, spans ended after Close are dropped.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	var err error
+	t.once.Do(func() {
+		close(t.stop)
+		<-t.done
+		err = t.exporter.Close()
+	})
+	return err
+}
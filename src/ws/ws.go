@@ -2,7 +2,8 @@ package ws
 
 import (
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
+	"logging"
 	"net/http"
 	"time"
 )
@@ -15,36 +16,50 @@ var (
 			return true
 		},
 	}
+)
 
+// Config of websockets.
+type Config struct {
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
+	WriteWait time.Duration
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
+	PongWait time.Duration
 	// Maximum message size allowed from peer.
 	// (If you want send many tracks in one stream SDP may be very big)
-	maxMessageSize int64 = 8 * 1024
-)
+	MaxMessageSize int64
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		WriteWait:      10 * time.Second,
+		PongWait:       60 * time.Second,
+		MaxMessageSize: 8 * 1024,
+	}
+}
 
 type WS struct {
-	conn *websocket.Conn
-	in   chan []byte
-	done chan struct{}
+	conn   *websocket.Conn
+	log    *slog.Logger
+	config *Config
+	in     chan []byte
+	done   chan struct{}
 }
 
-func NewWS(rw http.ResponseWriter, req *http.Request) (*WS, error) {
+// NewWS upgrades the request to a websocket, nil config means DefaultConfig().
+func NewWS(rw http.ResponseWriter, req *http.Request, config *Config, logger *slog.Logger) (*WS, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
 	wsConn, err := upgrader.Upgrade(rw, req, nil)
 	if err != nil {
 		return nil, err
 	}
 	return &WS{
-		conn: wsConn,
-		in:   make(chan []byte, 100),
-		done: make(chan struct{}),
+		conn:   wsConn,
+		log:    logging.OrDefault(logger),
+		config: config,
+		in:     make(chan []byte, 100),
+		done:   make(chan struct{}),
 	}, nil
 }
 
@@ -86,12 +101,11 @@ func (s *WS) Run() <-chan []byte {
 			}
 		}
 	}
-
-	return out
 }
 
 func (s *WS) pingProcess(runned chan<- struct{}) {
-	ticker := time.NewTicker(pingPeriod)
+	// Send pings to peer with this period. Must be less than PongWait.
+	ticker := time.NewTicker((s.config.PongWait * 9) / 10)
 	defer func() {
 		ticker.Stop()
 		s.conn.Close()
@@ -102,7 +116,7 @@ func (s *WS) pingProcess(runned chan<- struct{}) {
 		select {
 		case <-ticker.C:
 			if err := s.write(websocket.PingMessage, []byte{}); err != nil {
-				log.Printf("WEBSOCKET PING ERROR: %s", err)
+				s.log.Warn("websocket ping error", logging.Err(err))
 				return
 			}
 
@@ -118,18 +132,18 @@ func (s *WS) receiveProcess(out chan<- []byte, runned chan<- struct{}) {
 		close(s.done)
 	}()
 
-	s.conn.SetReadLimit(maxMessageSize)
-	s.conn.SetReadDeadline(time.Now().Add(pongWait))
-	s.conn.SetPongHandler(func(string) error { s.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	s.conn.SetReadLimit(s.config.MaxMessageSize)
+	s.conn.SetReadDeadline(time.Now().Add(s.config.PongWait))
+	s.conn.SetPongHandler(func(string) error { s.conn.SetReadDeadline(time.Now().Add(s.config.PongWait)); return nil })
 
 	runned <- struct{}{}
 
 	for {
 		_, msg, err := s.conn.ReadMessage()
 		if err != nil {
-			log.Printf("WEBSOCKET RECEIVE ERROR: %s", err)
+			s.log.Info("websocket receive error", logging.Err(err))
 			if err = s.conn.Close(); err != nil {
-				log.Printf("WEBSOCKET CLOSE ERROR: %s", err)
+				s.log.Debug("websocket close error", logging.Err(err))
 			}
 			return
 		}
@@ -138,7 +152,7 @@ func (s *WS) receiveProcess(out chan<- []byte, runned chan<- struct{}) {
 }
 
 func (s *WS) write(messageType int, data []byte) error {
-	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteWait))
 	w, err := s.conn.NextWriter(messageType)
 	if err != nil {
 		return err